@@ -11,6 +11,7 @@ type Configuration struct {
 	Server        ServerConfiguration
 	Elasticsearch ElasticOptions
 	Appsearch     AppsearchOptions
+	Crawler       CrawlerOptions
 }
 
 // ElasticOptions holds configuration values for the elasticsearch cluster
@@ -18,6 +19,20 @@ type ElasticOptions struct {
 	Endpoint string
 	Username string
 	Password string
+
+	// Crawled pages are indexed with the _bulk API once any of these thresholds is reached
+	BulkFlushDocs           int
+	BulkFlushBytes          int
+	BulkFlushIntervalMillis int
+
+	// MappingsDir holds the mapping files crawl requests can create indices with
+	MappingsDir string
+
+	// RebuildRetention is how many previous generations of an index a rebuild keeps
+	RebuildRetention int
+
+	// StateIndex holds the state of crawled pages incremental crawls fetch them conditionally with
+	StateIndex string
 }
 
 // AppsearchOptions holds config values for the app-search instance
@@ -27,6 +42,24 @@ type AppsearchOptions struct {
 	Token    string
 }
 
+// CrawlerOptions holds the defaults applied to crawl requests that don't set them
+type CrawlerOptions struct {
+	Robots  string
+	Retries RetryOptions
+
+	// TrackingParams are the query parameters stripped from links before they are crawled
+	TrackingParams []string
+
+	// Documents are the formats of linked documents indexed alongside pages, e.g. "pdf"
+	Documents []string
+}
+
+// RetryOptions holds how many times failed page fetches and document writes are retried
+type RetryOptions struct {
+	Enabled bool
+	Number  int
+}
+
 //ServerConfiguration holds configuration values for the server
 type ServerConfiguration struct {
 	Port                    int
@@ -37,9 +37,20 @@ func TestSetup(t *testing.T) {
 					Token:    "private-somefakek3y",
 				},
 				Elasticsearch: ElasticOptions{
-					Endpoint: "http://localhost:9200",
-					Username: "elastic",
-					Password: "changeme",
+					Endpoint:         "http://localhost:9200",
+					Username:         "elastic",
+					Password:         "changeme",
+					BulkFlushDocs:    1000,
+					MappingsDir:      "conf/mappings",
+					RebuildRetention: 1,
+					StateIndex:       "webcrawler-state",
+				},
+				Crawler: CrawlerOptions{
+					Robots:  "respect",
+					Retries: RetryOptions{Enabled: true, Number: 3},
+
+					TrackingParams: []string{"utm_*", "gclid", "fbclid"},
+					Documents:      []string{"pdf"},
 				},
 			}, errMsg: ""},
 		"incorrect env": {env: "other", conf: nil, errMsg: "Error reading config file. env: other error: Config File \"other\" Not"},
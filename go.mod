@@ -4,21 +4,23 @@ go 1.13
 
 require (
 	github.com/PuerkitoBio/goquery v1.5.0
-	github.com/antchfx/htmlquery v1.2.1 // indirect
+	github.com/andybalholm/cascadia v1.0.0
+	github.com/antchfx/htmlquery v1.2.1
 	github.com/antchfx/xmlquery v1.2.2 // indirect
-	github.com/antchfx/xpath v1.1.4 // indirect
+	github.com/antchfx/xpath v1.1.4
 	github.com/elastic/go-elasticsearch/v8 v8.0.0-20191218082911-5398a82b748f
-	github.com/gobwas/glob v0.2.3 // indirect
+	github.com/gobwas/glob v0.2.3
 	github.com/gocolly/colly v1.2.0
 	github.com/google/go-cmp v0.2.0
 	github.com/google/logger v1.0.1
 	github.com/gookit/color v1.2.1
 	github.com/julienschmidt/httprouter v1.3.0
 	github.com/kennygrant/sanitize v1.2.4 // indirect
+	github.com/ledongthuc/pdf v0.0.0-20220302134840-0c2507a12d80
 	github.com/saintfish/chardet v0.0.0-20120816061221-3af4cd4741ca // indirect
 	github.com/sirupsen/logrus v1.4.2
 	github.com/spf13/viper v1.6.1
 	github.com/stretchr/testify v1.5.1 // indirect
-	github.com/temoto/robotstxt v1.1.1 // indirect
-	golang.org/x/net v0.7.0 // indirect
+	github.com/temoto/robotstxt v1.1.1
+	golang.org/x/net v0.7.0
 )
@@ -0,0 +1,200 @@
+package clients
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+)
+
+// GenerationLayout is the UTC timestamp appended to an index name to name a generation of it,
+// e.g. "demo-20200120160405"
+const GenerationLayout = "20060102150405"
+
+// ErrNotAlias is the kind of error returned when a rebuild targets an index that exists but isn't
+// an alias, so it can't be swapped to the new generation
+var ErrNotAlias = errors.New("index isn't an alias")
+
+// fatalError marks an error after which a sink cannot write any more pages
+type fatalError struct {
+	error
+}
+
+func (e *fatalError) Unwrap() error {
+	return e.error
+}
+
+// Fatal reports that the sink cannot write any more pages
+func (e *fatalError) Fatal() bool {
+	return true
+}
+
+// generationName returns the name of the generation of the index stamped with t
+func generationName(index string, t time.Time) string {
+	return index + "-" + t.UTC().Format(GenerationLayout)
+}
+
+// createGeneration creates a new generation of the index behind the alias, failing if the alias
+// is an index itself or the generation already exists
+func createGeneration(ctx context.Context, elasticClient *elasticsearch.Client, alias, generation string, m *Mapping) error {
+	res, err := esapi.IndicesExistsRequest{Index: []string{alias}}.Do(ctx, elasticClient)
+	if err != nil {
+		return fmt.Errorf("Error checking index %s exists: %w", alias, err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode == 200 {
+		res, err := esapi.IndicesExistsAliasRequest{Name: []string{alias}}.Do(ctx, elasticClient)
+		if err != nil {
+			return fmt.Errorf("Error checking alias %s exists: %w", alias, err)
+		}
+		res.Body.Close()
+
+		if res.StatusCode == 404 {
+			return &fatalError{fmt.Errorf("%w: %s is an index, delete or reindex it before rebuilding into an alias of that name", ErrNotAlias, alias)}
+		}
+	}
+
+	created, err := createIndex(ctx, elasticClient, generation, m)
+	if err != nil {
+		return err
+	}
+	if !created {
+		return fmt.Errorf("Index %s already exists, another rebuild of %s started in the same second", generation, alias)
+	}
+
+	return nil
+}
+
+// aliasedIndices returns the indices the alias points to, if any
+func aliasedIndices(ctx context.Context, elasticClient *elasticsearch.Client, alias string) ([]string, error) {
+	res, err := esapi.IndicesGetAliasRequest{Name: []string{alias}}.Do(ctx, elasticClient)
+	if err != nil {
+		return nil, fmt.Errorf("Error getting alias %s: %w", alias, err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == 404 {
+		return nil, nil
+	}
+	if res.IsError() {
+		return nil, &StatusError{StatusCode: res.StatusCode, Msg: fmt.Sprintf("[%s] Error getting alias %s, err=%s", res.Status(), alias, res.String())}
+	}
+
+	var r map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return nil, fmt.Errorf("Error deserializing alias %s: %w", alias, err)
+	}
+
+	indices := make([]string, 0, len(r))
+	for index := range r {
+		indices = append(indices, index)
+	}
+	sort.Strings(indices)
+
+	return indices, nil
+}
+
+// swapAliases points every alias at its new generation in one atomic request, removing it from
+// the indices it pointed to before. Aliases without a generation are only removed.
+func swapAliases(ctx context.Context, elasticClient *elasticsearch.Client, generations map[string]string) error {
+	aliases := make([]string, 0, len(generations))
+	for alias := range generations {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+
+	var actions []map[string]interface{}
+	for _, alias := range aliases {
+		current, err := aliasedIndices(ctx, elasticClient, alias)
+		if err != nil {
+			return err
+		}
+		for _, index := range current {
+			actions = append(actions, map[string]interface{}{"remove": map[string]string{"index": index, "alias": alias}})
+		}
+		if generations[alias] != "" {
+			actions = append(actions, map[string]interface{}{"add": map[string]string{"index": generations[alias], "alias": alias}})
+		}
+	}
+
+	body, err := json.Marshal(map[string]interface{}{"actions": actions})
+	if err != nil {
+		return err
+	}
+
+	res, err := esapi.IndicesUpdateAliasesRequest{Body: bytes.NewReader(body)}.Do(ctx, elasticClient)
+	if err != nil {
+		return fmt.Errorf("Error swapping aliases %s: %w", strings.Join(aliases, ","), err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return &StatusError{StatusCode: res.StatusCode, Msg: fmt.Sprintf("[%s] Error swapping aliases %s, err=%s", res.Status(), strings.Join(aliases, ","), res.String())}
+	}
+
+	return nil
+}
+
+// olderGenerations returns the generations of the index created before the given one, newest first
+func olderGenerations(ctx context.Context, elasticClient *elasticsearch.Client, alias, generation string) ([]string, error) {
+	res, err := esapi.IndicesGetAliasRequest{Index: []string{alias + "-*"}}.Do(ctx, elasticClient)
+	if err != nil {
+		return nil, fmt.Errorf("Error listing generations of %s: %w", alias, err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return nil, &StatusError{StatusCode: res.StatusCode, Msg: fmt.Sprintf("[%s] Error listing generations of %s, err=%s", res.Status(), alias, res.String())}
+	}
+
+	var r map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return nil, fmt.Errorf("Error deserializing generations of %s: %w", alias, err)
+	}
+
+	// The pattern also matches other indices sharing the prefix, such as language indices
+	re := regexp.MustCompile("^" + regexp.QuoteMeta(alias) + `-\d{14}$`)
+
+	var older []string
+	for index := range r {
+		if re.MatchString(index) && index < generation {
+			older = append(older, index)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(older)))
+
+	return older, nil
+}
+
+// deleteIndices deletes the indices, ignoring any that don't exist
+func deleteIndices(ctx context.Context, elasticClient *elasticsearch.Client, indices []string) error {
+	if len(indices) == 0 {
+		return nil
+	}
+
+	ignoreUnavailable := true
+	req := esapi.IndicesDeleteRequest{
+		Index:             indices,
+		IgnoreUnavailable: &ignoreUnavailable,
+	}
+	res, err := req.Do(ctx, elasticClient)
+	if err != nil {
+		return fmt.Errorf("Error deleting indices %s: %w", strings.Join(indices, ","), err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return &StatusError{StatusCode: res.StatusCode, Msg: fmt.Sprintf("[%s] Error deleting indices %s, err=%s", res.Status(), strings.Join(indices, ","), res.String())}
+	}
+
+	return nil
+}
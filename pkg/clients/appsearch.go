@@ -1,20 +1,122 @@
 package clients
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/sirupsen/logrus"
 )
 
 // AppsearchDocument represents the document sent to App Search
 type AppsearchDocument struct {
-	ID          string              `json:"id"`
-	Description string              `json:"description"`
-	URI         string              `json:"uri"`
-	Source      map[string][]string `json:"source"`
-	OgImage     string              `json:"ogimage"`
-	Title       string              `json:"title"`
-	Keywords    string              `json:"keywords"`
+	ID           string              `json:"id"`
+	Description  string              `json:"description"`
+	URI          string              `json:"uri"`
+	Source       map[string][]string `json:"source"`
+	OgImage      string              `json:"ogimage"`
+	Title        string              `json:"title"`
+	Keywords     string              `json:"keywords"`
+	LastModified string              `json:"last_modified,omitempty"`
+	Language     string              `json:"language,omitempty"`
+	BodyText     string              `json:"body_text,omitempty"`
+	Summary      string              `json:"summary,omitempty"`
+	Site         string              `json:"site,omitempty"`
+	LastSeen     string              `json:"last_seen,omitempty"`
+	Aliases      []string            `json:"aliases,omitempty"`
+	ContentType  string              `json:"content_type,omitempty"`
+	FileName     string              `json:"file_name,omitempty"`
+	FileAuthor   string              `json:"file_author,omitempty"`
+	FilePages    int                 `json:"file_page_count,omitempty"`
+	FileSize     int                 `json:"file_size,omitempty"`
+	Inlinks      int                 `json:"inlinks"`
+	AnchorText   []string            `json:"anchor_text,omitempty"`
+	PageScore    float64             `json:"page_score"`
+
+	Fields map[string]interface{} `json:"-"`
+
+	// Structured holds the page's structured data, images and outlinks flattened into top level fields, e.g.
+	// schema_type and images_alt, as App Search doesn't support nested objects
+	Structured map[string]interface{} `json:"-"`
+}
+
+// MarshalJSON writes the extracted fields and structured data of the document alongside its other fields
+func (d AppsearchDocument) MarshalJSON() ([]byte, error) {
+	type document AppsearchDocument
+	return marshalWithFields(document(d), d.Fields, d.Structured)
+}
+
+// appsearchStructured returns the nested fields of the page flattened into App Search fields, its
+// structured data, images and outlinks
+func appsearchStructured(p RenderedPage) map[string]interface{} {
+	if len(p.Images) == 0 && len(p.Outlinks) == 0 {
+		return p.Structured
+	}
+
+	fields := make(map[string]interface{})
+	if len(p.Images) > 0 {
+		fields["images"] = p.Images
+	}
+	if len(p.Outlinks) > 0 {
+		fields["outlinks"] = p.Outlinks
+	}
+	for key, value := range p.Structured {
+		fields[key] = value
+	}
+	return fields
+}
+
+// flattenFields flattens nested objects into fields named by their path joined with underscores.
+// Lists of objects become one list per field of the objects, e.g. schema_breadcrumbs_name.
+func flattenFields(fields map[string]interface{}) map[string]interface{} {
+	if len(fields) == 0 {
+		return nil
+	}
+
+	// Round trip through JSON so structs are flattened like the maps they are written as
+	body, err := json.Marshal(fields)
+	if err != nil {
+		return nil
+	}
+	var nested map[string]interface{}
+	if err := json.Unmarshal(body, &nested); err != nil {
+		return nil
+	}
+
+	flat := make(map[string]interface{})
+	var flatten func(prefix string, v interface{}, list bool)
+	flatten = func(prefix string, v interface{}, list bool) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			for key, value := range v {
+				flatten(prefix+"_"+key, value, list)
+			}
+		case []interface{}:
+			for _, e := range v {
+				flatten(prefix, e, true)
+			}
+		default:
+			if !list {
+				flat[prefix] = v
+				return
+			}
+			values, _ := flat[prefix].([]interface{})
+			flat[prefix] = append(values, v)
+		}
+	}
+	for key, value := range nested {
+		flatten(key, value, false)
+	}
+
+	return flat
 }
 
 // AppsearchClient represents the HTTP client and configs used to send requests to App Search
@@ -45,3 +147,273 @@ func CreateAppsearchClient(e string, t string, a string) *AppsearchClient {
 		API:      a,
 	}
 }
+
+// maxAppsearchBatch is the most documents the App Search documents API accepts in one request
+const maxAppsearchBatch = 100
+
+var (
+	// ErrAppsearchUnauthorized is the kind of error returned when App Search rejects the API token
+	ErrAppsearchUnauthorized = errors.New("App Search rejected the API token")
+	// ErrAppsearchEngineNotFound is the kind of error returned when the engine doesn't exist
+	ErrAppsearchEngineNotFound = errors.New("App Search engine not found")
+	// ErrAppsearchValidation is the kind of error returned when App Search rejects a document or request
+	ErrAppsearchValidation = errors.New("App Search rejected the document")
+	// ErrAppsearchRateLimited is the kind of error returned when App Search is throttling requests
+	ErrAppsearchRateLimited = errors.New("App Search rate limit exceeded")
+)
+
+// AppsearchError represents an error returned by the App Search API. It matches its Kind with errors.Is.
+type AppsearchError struct {
+	Kind       error
+	StatusCode int
+	DocumentID string
+	Messages   []string
+}
+
+func (e *AppsearchError) Error() string {
+	msg := "App Search error"
+	if e.Kind != nil {
+		msg = e.Kind.Error()
+	}
+	if e.StatusCode != 0 {
+		msg = fmt.Sprintf("[%d] %s", e.StatusCode, msg)
+	}
+	if e.DocumentID != "" {
+		msg += fmt.Sprintf(" ID=%s", e.DocumentID)
+	}
+	if len(e.Messages) > 0 {
+		msg += ", err=" + strings.Join(e.Messages, "; ")
+	}
+	return msg
+}
+
+// Unwrap returns the kind of the error
+func (e *AppsearchError) Unwrap() error {
+	return e.Kind
+}
+
+// Temporary reports whether the request may succeed if it is retried
+func (e *AppsearchError) Temporary() bool {
+	return e.Kind == ErrAppsearchRateLimited || e.StatusCode >= 500
+}
+
+// Fatal reports whether no further request to the engine can succeed
+func (e *AppsearchError) Fatal() bool {
+	return e.Kind == ErrAppsearchUnauthorized || e.Kind == ErrAppsearchEngineNotFound
+}
+
+// appsearchDocumentResult represents the outcome of one document in a documents API response
+type appsearchDocumentResult struct {
+	ID     string   `json:"id"`
+	Errors []string `json:"errors"`
+}
+
+// appsearchErrorBody represents the body of an App Search error response, which uses either field
+type appsearchErrorBody struct {
+	Error  string   `json:"error"`
+	Errors []string `json:"errors"`
+}
+
+// newAppsearchError decodes an App Search error response into a typed error
+func newAppsearchError(resp *http.Response) *AppsearchError {
+	e := &AppsearchError{StatusCode: resp.StatusCode}
+
+	switch resp.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		e.Kind = ErrAppsearchUnauthorized
+	case http.StatusNotFound:
+		e.Kind = ErrAppsearchEngineNotFound
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity:
+		e.Kind = ErrAppsearchValidation
+	case http.StatusTooManyRequests:
+		e.Kind = ErrAppsearchRateLimited
+	}
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	var b appsearchErrorBody
+	if err := json.Unmarshal(body, &b); err == nil && (b.Error != "" || len(b.Errors) > 0) {
+		if b.Error != "" {
+			e.Messages = append(e.Messages, b.Error)
+		}
+		e.Messages = append(e.Messages, b.Errors...)
+	} else if len(body) > 0 {
+		e.Messages = []string{string(body)}
+	}
+
+	return e
+}
+
+// IndexDocuments creates or updates up to 100 documents in the engine. Documents App Search rejects are
+// reported as *AppsearchError values in the result, while an error is returned if the request failed.
+func (ac *AppsearchClient) IndexDocuments(ctx context.Context, engine string, docs []AppsearchDocument) (result BatchResult, err error) {
+	var bearer = "Bearer " + ac.Token
+	var endpoint = ac.Endpoint + ac.API + "engines/" + engine + "/documents"
+
+	bodyJSON, err := json.Marshal(docs)
+	if err != nil {
+		return result, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(bodyJSON))
+	if err != nil {
+		return result, err
+	}
+	req.Header.Add("Authorization", bearer)
+	req.Header.Add("Content-Type", "application/json")
+
+	resp, err := ac.Client.Do(req)
+	if err != nil {
+		return result, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return result, newAppsearchError(resp)
+	}
+
+	var results []appsearchDocumentResult
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		return result, fmt.Errorf("Error deserializing the App Search response object: %s", err)
+	}
+
+	for _, r := range results {
+		if len(r.Errors) == 0 {
+			result.Indexed++
+			continue
+		}
+		result.Failed++
+		result.FailedIDs = append(result.FailedIDs, r.ID)
+		result.Errors = append(result.Errors, &AppsearchError{Kind: ErrAppsearchValidation, DocumentID: r.ID, Messages: r.Errors})
+	}
+
+	return result, nil
+}
+
+// NewAppsearchDocument returns the document sent to App Search for the page
+func NewAppsearchDocument(p RenderedPage) AppsearchDocument {
+	doc := AppsearchDocument{
+		ID:           pageID(p),
+		Description:  p.Meta.Desc,
+		URI:          p.URI,
+		Source:       p.Source,
+		OgImage:      p.Meta.OgImage,
+		Title:        p.Meta.Title,
+		Keywords:     p.Meta.Keywords,
+		LastModified: p.LastModified,
+		Language:     p.Language,
+		BodyText:     p.BodyText,
+		Summary:      p.Summary,
+		Site:         p.Site,
+		LastSeen:     p.LastSeen,
+		Aliases:      p.Aliases,
+		ContentType:  p.ContentType,
+		Inlinks:      p.Inlinks,
+		AnchorText:   p.AnchorText,
+		PageScore:    p.PageScore,
+		Fields:       p.Fields,
+		Structured:   flattenFields(appsearchStructured(p)),
+	}
+	if p.File != nil {
+		doc.FileName = p.File.Name
+		doc.FileAuthor = p.File.Author
+		doc.FilePages = p.File.PageCount
+		doc.FileSize = p.File.Size
+	}
+	return doc
+}
+
+// AppsearchSink buffers crawled pages and sends them to an App Search engine in batches
+type AppsearchSink struct {
+	Client *AppsearchClient
+	Engine string
+	Retry  RetryPolicy
+	Log    *logrus.Logger
+
+	mu     sync.Mutex
+	docs   []AppsearchDocument
+	report func(BatchResult)
+}
+
+func init() {
+	RegisterSink("app-search", newAppsearchSink)
+}
+
+func newAppsearchSink(cfg SinkConfig) (Sink, error) {
+	if cfg.Engine == "" {
+		return nil, errors.New("Crawl type of 'app-search' requires an 'engine' in the request.")
+	}
+	if cfg.Mapping != "" || cfg.LanguageIndices {
+		return nil, errors.New("Crawl type of 'app-search' doesn't support a 'mapping' or 'language_indices', engines are configured in App Search.")
+	}
+	if cfg.Rebuild {
+		return nil, errors.New("Crawl type of 'app-search' doesn't support the 'rebuild' mode.")
+	}
+
+	return &AppsearchSink{Client: cfg.AppsearchClient, Engine: cfg.Engine, Retry: cfg.Retry, Log: cfg.Log}, nil
+}
+
+// SetReport registers the function called with the outcome of every batch
+func (s *AppsearchSink) SetReport(report func(BatchResult)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.report = report
+}
+
+// Write adds the page to the batch, sending the batch once it is full
+func (s *AppsearchSink) Write(ctx context.Context, page RenderedPage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.docs = append(s.docs, NewAppsearchDocument(page))
+
+	// Failures of the batch are delivered through the report, not attributed to this page
+	if len(s.docs) >= maxAppsearchBatch {
+		s.flush(ctx)
+	}
+
+	return nil
+}
+
+// Flush sends the buffered pages to App Search
+func (s *AppsearchSink) Flush(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.flush(ctx)
+}
+
+// flush sends the batch and reports the outcome of every document. It must be called with the lock held.
+func (s *AppsearchSink) flush(ctx context.Context) error {
+	if len(s.docs) == 0 {
+		return nil
+	}
+
+	docs := s.docs
+	s.docs = nil
+
+	var result BatchResult
+	notify := retryNotifier(s.Log, s.Retry, fmt.Sprintf("batch of %d documents to engine %s", len(docs), s.Engine))
+	retries, err := s.Retry.Do(ctx, func() (err error) {
+		result, err = s.Client.IndexDocuments(ctx, s.Engine, docs)
+		return err
+	}, notify)
+	if err != nil {
+		result = BatchResult{Failed: len(docs), Errors: []error{giveUpError(retries, err)}}
+		for _, doc := range docs {
+			result.FailedIDs = append(result.FailedIDs, doc.ID)
+		}
+		if retries > 0 {
+			result.GaveUp = 1
+		}
+	}
+	result.Retries = retries
+	if s.report != nil {
+		s.report(result)
+	}
+
+	return err
+}
+
+// Close sends the remaining buffered pages
+func (s *AppsearchSink) Close(ctx context.Context) error {
+	return s.Flush(ctx)
+}
@@ -1,7 +1,11 @@
 package clients
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"github.com/gookit/color"
@@ -34,3 +38,57 @@ func TestCreateAppsearchClient(t *testing.T) {
 		t.Errorf("\n%s:\n\n%s\n\n%s:\n\n%s", green("[expected]"), endpoint, red("[actual]"), client.Endpoint)
 	}
 }
+
+func TestIndexDocuments(t *testing.T) {
+	tests := map[string]struct {
+		status  int
+		body    string
+		kind    error
+		fatal   bool
+		errMsg  string
+		indexed int
+		failed  int
+	}{
+		"indexed":         {status: 200, body: `[{"id":"1","errors":[]},{"id":"2","errors":["Invalid field value: ogimage"]}]`, indexed: 1, failed: 1},
+		"unauthorized":    {status: 401, body: `{"error":"You need to sign in or sign up before continuing."}`, kind: ErrAppsearchUnauthorized, fatal: true, errMsg: "[401] App Search rejected the API token, err=You need to sign in or sign up before continuing."},
+		"missing-engine":  {status: 404, body: `{"errors":["Could not find engine."]}`, kind: ErrAppsearchEngineNotFound, fatal: true, errMsg: "[404] App Search engine not found, err=Could not find engine."},
+		"invalid-request": {status: 400, body: `{"errors":["Too many documents"]}`, kind: ErrAppsearchValidation, errMsg: "[400] App Search rejected the document, err=Too many documents"},
+		"rate-limited":    {status: 429, body: `Retry later`, kind: ErrAppsearchRateLimited, errMsg: "[429] App Search rate limit exceeded, err=Retry later"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tc.status)
+				w.Write([]byte(tc.body))
+			}))
+			defer srv.Close()
+
+			client := CreateAppsearchClient(srv.URL, "private-token", "/api/as/v1/")
+			result, err := client.IndexDocuments(context.Background(), "test", []AppsearchDocument{{ID: "1"}, {ID: "2"}})
+
+			if tc.kind == nil {
+				if err != nil {
+					t.Fatalf("Unexpected error indexing documents: %s", err)
+				}
+				if result.Indexed != tc.indexed || result.Failed != tc.failed {
+					t.Fatalf("unexpected result: %+v", result)
+				}
+				if !errors.Is(result.Errors[0], ErrAppsearchValidation) {
+					t.Fatalf("document errors should be validation errors: %v", result.Errors[0])
+				}
+				return
+			}
+
+			if !errors.Is(err, tc.kind) {
+				t.Fatalf("\n%s:\n\n%v\n\n%s:\n\n%v", green("[expected]"), tc.kind, red("[actual]"), err)
+			}
+			if IsFatal(err) != tc.fatal {
+				t.Fatalf("fatal - expected : %t, received : %t", tc.fatal, IsFatal(err))
+			}
+			if err.Error() != tc.errMsg {
+				t.Fatalf("\n%s:\n\n%s\n\n%s:\n\n%s", green("[expected]"), tc.errMsg, red("[actual]"), err.Error())
+			}
+		})
+	}
+}
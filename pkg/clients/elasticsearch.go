@@ -1,20 +1,27 @@
 package clients
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/elastic/go-elasticsearch/v8"
 	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"github.com/sirupsen/logrus"
 )
 
 // ElasticDocument represents the doc that gets indexed in Elasticsearch
+//
+// Deprecated: pages are written through the Sink returned by NewSink.
 type ElasticDocument struct {
 	Index, DocumentID string
 	Body              io.Reader
@@ -49,8 +56,19 @@ func CreateElasticClient(cfg elasticsearch.Config) (client *elasticsearch.Client
 	return client, nil
 }
 
-// IndexDocument takes a document and indexes it in Elasticsearch
+// IndexDocument takes a document and indexes it in Elasticsearch. It refreshes the index after
+// every document, which is slow when indexing many.
+//
+// Deprecated: the crawler no longer uses it. Write pages to the Sink returned by NewSink, which
+// sends them in bulk and refreshes the index once.
 func IndexDocument(elasticClient *elasticsearch.Client, d ElasticDocument) (resSlice []string, errSlice []error) {
+	return IndexDocumentContext(context.Background(), elasticClient, d)
+}
+
+// IndexDocumentContext is IndexDocument giving up if ctx is done
+//
+// Deprecated: write pages to the Sink returned by NewSink instead.
+func IndexDocumentContext(ctx context.Context, elasticClient *elasticsearch.Client, d ElasticDocument) (resSlice []string, errSlice []error) {
 	var (
 		r  map[string]interface{}
 		wg sync.WaitGroup
@@ -73,10 +91,11 @@ func IndexDocument(elasticClient *elasticsearch.Client, d ElasticDocument) (resS
 		}
 
 		// Perform the request with the provided client
-		res, err := req.Do(context.Background(), elasticClient)
+		res, err := req.Do(ctx, elasticClient)
 		if err != nil {
 			// Fatal error if the indexing request throws
 			errSlice = append(errSlice, fmt.Errorf("Error getting index response: %s", err))
+			return
 		}
 		defer res.Body.Close()
 
@@ -96,3 +115,586 @@ func IndexDocument(elasticClient *elasticsearch.Client, d ElasticDocument) (resS
 
 	return resSlice, errSlice
 }
+
+// NewElasticDocument returns the document to be indexed in Elasticsearch for the page
+//
+// Deprecated: write pages to the Sink returned by NewSink instead.
+func NewElasticDocument(i string, p RenderedPage) (doc ElasticDocument, err error) {
+	bodyJSON, err := json.Marshal(p)
+	if err != nil {
+		return doc, err
+	}
+	doc = ElasticDocument{
+		Index:      i,
+		DocumentID: pageID(p),
+		Body:       bytes.NewReader(bodyJSON),
+	}
+
+	return doc, nil
+}
+
+// BulkOptions controls when the Elasticsearch sink sends its buffered documents with the _bulk API.
+// Zero values fall back to DefaultBulkOptions.
+type BulkOptions struct {
+	FlushDocs     int
+	FlushBytes    int
+	FlushInterval time.Duration
+}
+
+// DefaultBulkOptions flushes every 500 documents, 5MB or 5 seconds, whichever comes first
+var DefaultBulkOptions = BulkOptions{
+	FlushDocs:     500,
+	FlushBytes:    5 * 1024 * 1024,
+	FlushInterval: 5 * time.Second,
+}
+
+// withDefaults fills the unset options in from DefaultBulkOptions
+func (o BulkOptions) withDefaults() BulkOptions {
+	if o.FlushDocs <= 0 {
+		o.FlushDocs = DefaultBulkOptions.FlushDocs
+	}
+	if o.FlushBytes <= 0 {
+		o.FlushBytes = DefaultBulkOptions.FlushBytes
+	}
+	if o.FlushInterval <= 0 {
+		o.FlushInterval = DefaultBulkOptions.FlushInterval
+	}
+	return o
+}
+
+// bulkResponse represents the parts of the _bulk API response used to report per document errors
+type bulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		ID     string `json:"_id"`
+		Status int    `json:"status"`
+		Error  *struct {
+			Type   string `json:"type"`
+			Reason string `json:"reason"`
+		} `json:"error"`
+	} `json:"items"`
+}
+
+// LanguageIndex represents the index suffix and mapping the pages of a language are routed to
+type LanguageIndex struct {
+	Suffix  string
+	Mapping string
+}
+
+// LanguageIndices maps the languages with a dedicated mapping to the index their pages are routed to.
+// Pages in other languages stay in the crawl's index.
+var LanguageIndices = map[string]LanguageIndex{
+	"en": {Suffix: "en", Mapping: "english"},
+	"zh": {Suffix: "cjk", Mapping: "cjk"},
+	"ja": {Suffix: "cjk", Mapping: "cjk"},
+	"ko": {Suffix: "cjk", Mapping: "cjk"},
+}
+
+// ElasticSink buffers crawled pages and indexes them in Elasticsearch with the _bulk API, refreshing
+// the index once when it is closed
+type ElasticSink struct {
+	Client  *elasticsearch.Client
+	Index   string
+	Options BulkOptions
+	Mapping *Mapping
+	Retry   RetryPolicy
+	Log     *logrus.Logger
+
+	// Languages holds the mappings of the per-language indices pages are routed to, keyed by
+	// mapping name. Pages aren't routed by language when it is nil.
+	Languages map[string]*Mapping
+
+	// Rebuild writes pages to a new generation of every index, named with the Generation
+	// timestamp, and Commit swaps the index alias to it keeping the Retain previous generations
+	Rebuild    bool
+	Generation time.Time
+	Retain     int
+
+	// sending is held for the whole of every bulk request so they are sent in the order their pages
+	// were taken from the buffer, while mu is only held to take them
+	sending sync.Mutex
+
+	mu      sync.Mutex
+	buf     bytes.Buffer
+	pending int
+	ids     []string
+	sent    bool
+	written map[string]bool
+	report  func(BatchResult)
+
+	// indices holds the index every document was written to, for updating it
+	indices map[string]string
+
+	// prepared holds the outcome of setting up every index the sink has written to
+	preparedMu sync.Mutex
+	prepared   map[string]error
+
+	start sync.Once
+	stop  sync.Once
+	done  chan struct{}
+}
+
+func init() {
+	RegisterSink("elasticsearch", newElasticSink)
+}
+
+func newElasticSink(cfg SinkConfig) (Sink, error) {
+	if cfg.Index == "" {
+		return nil, errors.New("Crawl type of 'elasticsearch' requires an 'index' in the request.")
+	}
+
+	var mapping *Mapping
+	if cfg.Mapping != "" {
+		var err error
+		if mapping, err = LoadMapping(mappingsDir(cfg), cfg.Mapping); err != nil {
+			return nil, err
+		}
+	}
+
+	var languages map[string]*Mapping
+	if cfg.LanguageIndices {
+		languages = make(map[string]*Mapping)
+		for _, li := range LanguageIndices {
+			if languages[li.Mapping] != nil {
+				continue
+			}
+
+			m, err := LoadMapping(mappingsDir(cfg), li.Mapping)
+			if err != nil {
+				return nil, err
+			}
+			languages[li.Mapping] = m
+		}
+	}
+
+	if cfg.Retain < 0 {
+		return nil, errors.New("Elasticsearch rebuilds must retain zero or more previous generations.")
+	}
+
+	return &ElasticSink{
+		Client:     cfg.ElasticClient,
+		Index:      cfg.Index,
+		Options:    cfg.Bulk.withDefaults(),
+		Mapping:    mapping,
+		Retry:      cfg.Retry,
+		Log:        cfg.Log,
+		Languages:  languages,
+		Rebuild:    cfg.Rebuild,
+		Generation: time.Now(),
+		Retain:     cfg.Retain,
+		written:    make(map[string]bool),
+		indices:    make(map[string]string),
+		prepared:   make(map[string]error),
+		done:       make(chan struct{}),
+	}, nil
+}
+
+// mappingsDir returns the directory the mapping files of the config are read from
+func mappingsDir(cfg SinkConfig) string {
+	if cfg.MappingsDir == "" {
+		return DefaultMappingsDir
+	}
+	return cfg.MappingsDir
+}
+
+// Prepare creates the index from the sink's mapping if it doesn't exist, failing if it exists with
+// an incompatible mapping. Without a mapping the index is left to dynamic mapping.
+func (s *ElasticSink) Prepare(ctx context.Context) error {
+	return s.prepare(ctx, s.Index, s.Mapping)
+}
+
+// prepare creates the index from the mapping the first time the sink uses it, or its new generation
+// when rebuilding, remembering the outcome so a failure isn't retried for every page
+func (s *ElasticSink) prepare(ctx context.Context, index string, m *Mapping) error {
+	if m == nil && !s.Rebuild {
+		return nil
+	}
+
+	s.preparedMu.Lock()
+	defer s.preparedMu.Unlock()
+
+	if err, ok := s.prepared[index]; ok {
+		return err
+	}
+
+	notify := retryNotifier(s.Log, s.Retry, fmt.Sprintf("creating index %s", index))
+	retries, err := s.Retry.Do(ctx, func() error {
+		if s.Rebuild {
+			return createGeneration(ctx, s.Client, index, s.physical(index), m)
+		}
+		return EnsureIndex(ctx, s.Client, index, m)
+	}, notify)
+	err = giveUpError(retries, err)
+
+	// Errors caused by the crawl stopping are left for the next crawl to retry
+	if ctx.Err() == nil {
+		s.prepared[index] = err
+	}
+
+	return err
+}
+
+// physical returns the index pages for the index are written to, which is a new generation of it
+// when rebuilding
+func (s *ElasticSink) physical(index string) string {
+	if !s.Rebuild {
+		return index
+	}
+	return generationName(index, s.Generation)
+}
+
+// preparedIndices returns the sorted indices the sink has set up
+func (s *ElasticSink) preparedIndices() []string {
+	s.preparedMu.Lock()
+	defer s.preparedMu.Unlock()
+
+	indices := make([]string, 0, len(s.prepared))
+	for index, err := range s.prepared {
+		if err == nil {
+			indices = append(indices, index)
+		}
+	}
+	sort.Strings(indices)
+
+	return indices
+}
+
+// indexFor returns the index the page is written to and the mapping that index is created with
+func (s *ElasticSink) indexFor(page RenderedPage) (string, *Mapping) {
+	if s.Languages == nil {
+		return s.Index, s.Mapping
+	}
+
+	li, ok := LanguageIndices[page.Language]
+	if !ok {
+		return s.Index, s.Mapping
+	}
+
+	return s.Index + "-" + li.Suffix, s.Languages[li.Mapping]
+}
+
+// SetReport registers the function called with the outcome of every bulk request
+func (s *ElasticSink) SetReport(report func(BatchResult)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.report = report
+}
+
+// Write adds the page to the buffer, sending the buffer if it has reached the flush size
+func (s *ElasticSink) Write(ctx context.Context, page RenderedPage) error {
+	// The interval flush runs from the first write so sinks that are never used don't leak a goroutine
+	s.start.Do(func() {
+		go s.flushEvery(ctx, s.Options.FlushInterval)
+	})
+
+	index, mapping := s.indexFor(page)
+	if err := s.prepare(ctx, index, mapping); err != nil {
+		return err
+	}
+
+	action, err := json.Marshal(map[string]interface{}{
+		"index": map[string]string{"_index": s.physical(index), "_id": pageID(page)},
+	})
+	if err != nil {
+		return err
+	}
+	bodyJSON, err := json.Marshal(page)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.buf.Grow(len(action) + len(bodyJSON) + 2)
+	s.buf.Write(action)
+	s.buf.WriteByte('\n')
+	s.buf.Write(bodyJSON)
+	s.buf.WriteByte('\n')
+	s.pending++
+	s.ids = append(s.ids, pageID(page))
+	s.written[s.physical(index)] = true
+	s.indices[pageID(page)] = s.physical(index)
+	full := s.pending >= s.Options.FlushDocs || s.buf.Len() >= s.Options.FlushBytes
+	s.mu.Unlock()
+
+	// Failures of the flush are delivered through the report, not attributed to this page
+	if full {
+		s.flush(ctx)
+	}
+
+	return nil
+}
+
+// flushEvery flushes the buffer on an interval until the sink is closed or ctx is done
+func (s *ElasticSink) flushEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.Flush(ctx)
+		case <-s.done:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Flush sends every buffered page to Elasticsearch
+func (s *ElasticSink) Flush(ctx context.Context) error {
+	return s.flush(ctx)
+}
+
+// flush sends the buffer with the _bulk API and reports the outcome of every document. The buffer
+// is taken under the lock and sent without it, so pages can be written during the request and its
+// retries.
+func (s *ElasticSink) flush(ctx context.Context) error {
+	s.sending.Lock()
+	defer s.sending.Unlock()
+
+	s.mu.Lock()
+	pending := s.pending
+	ids := s.ids
+	body := make([]byte, s.buf.Len())
+	copy(body, s.buf.Bytes())
+	s.buf.Reset()
+	s.pending = 0
+	s.ids = nil
+	report := s.report
+	s.mu.Unlock()
+
+	if pending == 0 {
+		return nil
+	}
+
+	var result BatchResult
+	notify := retryNotifier(s.Log, s.Retry, fmt.Sprintf("bulk request of %d documents", pending))
+	retries, err := s.Retry.Do(ctx, func() (err error) {
+		result, err = bulkIndex(ctx, s.Client, body)
+		return err
+	}, notify)
+	if err != nil {
+		result = BatchResult{Failed: pending, Errors: []error{giveUpError(retries, err)}, FailedIDs: ids}
+		if retries > 0 {
+			result.GaveUp = 1
+		}
+	}
+	result.Retries = retries
+	if result.Indexed > 0 {
+		s.mu.Lock()
+		s.sent = true
+		s.mu.Unlock()
+	}
+	if report != nil {
+		report(result)
+	}
+
+	return err
+}
+
+// bulkIndex sends the NDJSON body to the _bulk API and collects the errors of the documents that failed
+func bulkIndex(ctx context.Context, elasticClient *elasticsearch.Client, body []byte) (result BatchResult, err error) {
+	req := esapi.BulkRequest{
+		Body: bytes.NewReader(body),
+	}
+
+	res, err := req.Do(ctx, elasticClient)
+	if err != nil {
+		return result, fmt.Errorf("Error getting bulk response: %s", err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return result, &StatusError{StatusCode: res.StatusCode, Msg: fmt.Sprintf("[%s] Error indexing documents in bulk, err=%s", res.Status(), res.String())}
+	}
+
+	var r bulkResponse
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return result, fmt.Errorf("Error deserializing the bulk response object: %s", err)
+	}
+
+	for _, item := range r.Items {
+		for _, op := range item {
+			if op.Error == nil && op.Status < 300 {
+				result.Indexed++
+				continue
+			}
+
+			result.Failed++
+			result.FailedIDs = append(result.FailedIDs, op.ID)
+			if op.Error != nil {
+				result.Errors = append(result.Errors, fmt.Errorf("[%d] Error indexing document ID=%s, err=%s: %s", op.Status, op.ID, op.Error.Type, op.Error.Reason))
+			} else {
+				result.Errors = append(result.Errors, fmt.Errorf("[%d] Error indexing document ID=%s", op.Status, op.ID))
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// Close sends the remaining buffered pages and refreshes the indices written to once so they are searchable
+func (s *ElasticSink) Close(ctx context.Context) error {
+	s.stop.Do(func() {
+		close(s.done)
+	})
+
+	if err := s.flush(ctx); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	sent := s.sent
+	indices := make([]string, 0, len(s.written))
+	for index := range s.written {
+		indices = append(indices, index)
+	}
+	s.mu.Unlock()
+	if !sent {
+		return nil
+	}
+	sort.Strings(indices)
+
+	return refreshIndices(ctx, s.Client, indices)
+}
+
+// refreshIndices refreshes the indices so the documents written to them are searchable
+func refreshIndices(ctx context.Context, elasticClient *elasticsearch.Client, indices []string) error {
+	names := strings.Join(indices, ",")
+
+	// An index whose every document was rejected may not exist, which mustn't stop the others refreshing
+	ignoreUnavailable := true
+	req := esapi.IndicesRefreshRequest{
+		Index:             indices,
+		IgnoreUnavailable: &ignoreUnavailable,
+	}
+	res, err := req.Do(ctx, elasticClient)
+	if err != nil {
+		return fmt.Errorf("Error refreshing index %s: %s", names, err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return fmt.Errorf("[%s] Error refreshing index %s, err=%s", res.Status(), names, res.String())
+	}
+
+	return nil
+}
+
+// Commit swaps the alias of every index a rebuild wrote to over to its new generation, then
+// deletes the previous generations beyond the Retain most recent. The new generations are live once
+// the aliases are swapped, so failing to delete the previous ones is logged and reported as a
+// warning rather than returned.
+func (s *ElasticSink) Commit(ctx context.Context) error {
+	if !s.Rebuild {
+		return nil
+	}
+
+	generations := make(map[string]string)
+	for _, index := range s.preparedIndices() {
+		generations[index] = s.physical(index)
+	}
+
+	// A language index the rebuild wrote no pages to would keep serving the previous generation's
+	// pages, so it is swapped to an empty generation, or its alias removed when pages are no
+	// longer routed by language
+	var stale map[string]string
+	notify := retryNotifier(s.Log, s.Retry, "listing language aliases")
+	retries, err := s.Retry.Do(ctx, func() (err error) {
+		stale, err = s.staleLanguageIndices(ctx, generations)
+		return err
+	}, notify)
+	if err != nil {
+		return giveUpError(retries, err)
+	}
+	for alias, mapping := range stale {
+		if s.Languages == nil {
+			generations[alias] = ""
+			continue
+		}
+		if err := s.prepare(ctx, alias, s.Languages[mapping]); err != nil {
+			return err
+		}
+		generations[alias] = s.physical(alias)
+	}
+
+	notify = retryNotifier(s.Log, s.Retry, "swapping aliases")
+	retries, err = s.Retry.Do(ctx, func() error {
+		return swapAliases(ctx, s.Client, generations)
+	}, notify)
+	if err != nil {
+		return giveUpError(retries, err)
+	}
+
+	var warnings int
+	for alias, generation := range generations {
+		if s.Log != nil {
+			if generation == "" {
+				s.Log.Infof("Alias %s removed", alias)
+			} else {
+				s.Log.Infof("Alias %s now points to %s", alias, generation)
+			}
+		}
+
+		older, err := olderGenerations(ctx, s.Client, alias, s.physical(alias))
+		if err == nil && len(older) > s.Retain {
+			err = deleteIndices(ctx, s.Client, older[s.Retain:])
+		}
+		if err != nil {
+			if s.Log != nil {
+				s.Log.Warnf("Failed to delete the previous generations of %s: %v", alias, err)
+			}
+			warnings++
+		}
+	}
+
+	s.mu.Lock()
+	report := s.report
+	s.mu.Unlock()
+	if warnings > 0 && report != nil {
+		report(BatchResult{Warnings: warnings})
+	}
+
+	return nil
+}
+
+// staleLanguageIndices returns the language indices that are aliases but aren't in generations,
+// with the name of their mapping
+func (s *ElasticSink) staleLanguageIndices(ctx context.Context, generations map[string]string) (map[string]string, error) {
+	stale := make(map[string]string)
+	for _, li := range LanguageIndices {
+		alias := s.Index + "-" + li.Suffix
+		if _, ok := generations[alias]; ok {
+			continue
+		}
+		if _, ok := stale[alias]; ok {
+			continue
+		}
+
+		current, err := aliasedIndices(ctx, s.Client, alias)
+		if err != nil {
+			return nil, err
+		}
+		if len(current) > 0 {
+			stale[alias] = li.Mapping
+		}
+	}
+
+	return stale, nil
+}
+
+// Discard deletes the generations a rebuild that didn't complete wrote to, leaving the aliases on
+// the previous ones
+func (s *ElasticSink) Discard(ctx context.Context) error {
+	if !s.Rebuild {
+		return nil
+	}
+
+	var generations []string
+	for _, index := range s.preparedIndices() {
+		generations = append(generations, s.physical(index))
+	}
+
+	return deleteIndices(ctx, s.Client, generations)
+}
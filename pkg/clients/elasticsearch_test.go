@@ -1,12 +1,23 @@
 package clients
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"crypto/md5"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
 )
 
 var (
@@ -81,3 +92,464 @@ func TestIndexDocument(t *testing.T) {
 		t.Errorf("Unexpected error indexing documents: %v", errSlice)
 	}
 }
+
+func TestElasticSinkBulk(t *testing.T) {
+	var (
+		bulks     []int
+		refreshes int
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/_bulk":
+			var items []string
+			scanner := bufio.NewScanner(r.Body)
+			for n := 0; scanner.Scan(); n++ {
+				// Every other line is a document, the first document of each bulk fails
+				if n%2 == 0 {
+					continue
+				}
+				if len(items) == 0 {
+					items = append(items, `{"index":{"_id":"1","status":400,"error":{"type":"mapper_parsing_exception","reason":"failed to parse"}}}`)
+				} else {
+					items = append(items, `{"index":{"_id":"2","status":201}}`)
+				}
+			}
+			bulks = append(bulks, len(items))
+			fmt.Fprintf(w, `{"errors":true,"items":[%s]}`, strings.Join(items, ","))
+		case "/test/_refresh":
+			refreshes++
+			fmt.Fprint(w, `{}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	client, err := CreateElasticClient(GenerateElasticConfig([]string{srv.URL}, username, password))
+	if err != nil {
+		t.Fatalf("Unexpected error creating Elasticsearch client: %s", err)
+	}
+
+	sink, err := NewSink("elasticsearch", SinkConfig{Index: "test", ElasticClient: client, Bulk: BulkOptions{FlushDocs: 2, FlushInterval: time.Hour}})
+	if err != nil {
+		t.Fatalf("Unexpected error creating sink: %s", err)
+	}
+
+	var got BatchResult
+	sink.(Reporter).SetReport(func(r BatchResult) {
+		got.Indexed += r.Indexed
+		got.Failed += r.Failed
+		got.Errors = append(got.Errors, r.Errors...)
+	})
+
+	for _, uri := range []string{"https://www.example.com/1", "https://www.example.com/2", "https://www.example.com/3"} {
+		if err := sink.Write(context.Background(), RenderedPage{URI: uri}); err != nil {
+			t.Fatalf("Unexpected error writing page: %s", err)
+		}
+	}
+
+	if diff := cmp.Diff([]int{2}, bulks); diff != "" {
+		t.Fatalf("the buffer should be sent once it holds FlushDocs pages: %s", diff)
+	}
+
+	if err := sink.Close(context.Background()); err != nil {
+		t.Fatalf("Unexpected error closing sink: %s", err)
+	}
+
+	if diff := cmp.Diff([]int{2, 1}, bulks); diff != "" {
+		t.Fatalf("closing should send the remaining pages: %s", diff)
+	}
+	if refreshes != 1 {
+		t.Fatalf("refreshes - expected : 1, received : %d", refreshes)
+	}
+	if got.Indexed != 1 || got.Failed != 2 || len(got.Errors) != 2 {
+		t.Fatalf("unexpected bulk results: %+v", got)
+	}
+	if want := "[400] Error indexing document ID=1, err=mapper_parsing_exception: failed to parse"; got.Errors[0].Error() != want {
+		t.Fatalf("\n%s:\n\n%s\n\n%s:\n\n%s", green("[expected]"), want, red("[actual]"), got.Errors[0].Error())
+	}
+}
+
+func TestElasticSinkWriteDuringFlush(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		bulks []int
+	)
+	received := make(chan struct{}, 1)
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/_bulk":
+			var items []string
+			scanner := bufio.NewScanner(r.Body)
+			for n := 0; scanner.Scan(); n++ {
+				if n%2 == 1 {
+					items = append(items, `{"index":{"_id":"1","status":201}}`)
+				}
+			}
+			mu.Lock()
+			bulks = append(bulks, len(items))
+			first := len(bulks) == 1
+			mu.Unlock()
+
+			// The first bulk request is held until the test has written a page during it
+			if first {
+				received <- struct{}{}
+				<-release
+			}
+			fmt.Fprintf(w, `{"errors":false,"items":[%s]}`, strings.Join(items, ","))
+		default:
+			fmt.Fprint(w, `{}`)
+		}
+	}))
+	defer srv.Close()
+
+	client, err := CreateElasticClient(GenerateElasticConfig([]string{srv.URL}, username, password))
+	if err != nil {
+		t.Fatalf("Unexpected error creating Elasticsearch client: %s", err)
+	}
+
+	sink, err := NewSink("elasticsearch", SinkConfig{Index: "test", ElasticClient: client, Bulk: BulkOptions{FlushDocs: 10, FlushInterval: time.Hour}})
+	if err != nil {
+		t.Fatalf("Unexpected error creating sink: %s", err)
+	}
+
+	if err := sink.Write(context.Background(), RenderedPage{URI: "https://www.example.com/1"}); err != nil {
+		t.Fatalf("Unexpected error writing page: %s", err)
+	}
+	flushed := make(chan error)
+	go func() {
+		flushed <- sink.Flush(context.Background())
+	}()
+	<-received
+
+	written := make(chan error)
+	go func() {
+		written <- sink.Write(context.Background(), RenderedPage{URI: "https://www.example.com/2"})
+	}()
+	select {
+	case err := <-written:
+		if err != nil {
+			t.Fatalf("Unexpected error writing page: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		close(release)
+		t.Fatal("writing a page should not wait for the bulk request in flight")
+	}
+
+	close(release)
+	if err := <-flushed; err != nil {
+		t.Fatalf("Unexpected error flushing sink: %s", err)
+	}
+	if err := sink.Close(context.Background()); err != nil {
+		t.Fatalf("Unexpected error closing sink: %s", err)
+	}
+
+	if diff := cmp.Diff([]int{1, 1}, bulks); diff != "" {
+		t.Fatalf("the page written during the bulk request should be sent in the next one: %s", diff)
+	}
+}
+
+func TestElasticSinkLanguageIndices(t *testing.T) {
+	var (
+		mu        sync.Mutex
+		created   []string
+		indices   []string
+		refreshed string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == http.MethodHead:
+			w.WriteHeader(http.StatusNotFound)
+		case r.Method == http.MethodPut:
+			created = append(created, r.URL.Path)
+			fmt.Fprint(w, `{"acknowledged":true}`)
+		case r.URL.Path == "/_bulk":
+			var items []string
+			scanner := bufio.NewScanner(r.Body)
+			for n := 0; scanner.Scan(); n++ {
+				if n%2 != 0 {
+					continue
+				}
+				var action map[string]map[string]string
+				json.Unmarshal(scanner.Bytes(), &action)
+				indices = append(indices, action["index"]["_index"])
+				items = append(items, `{"index":{"status":201}}`)
+			}
+			fmt.Fprintf(w, `{"errors":false,"items":[%s]}`, strings.Join(items, ","))
+		case strings.HasSuffix(r.URL.Path, "/_refresh"):
+			refreshed = r.URL.Path
+			fmt.Fprint(w, `{}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	client, err := CreateElasticClient(GenerateElasticConfig([]string{srv.URL}, username, password))
+	if err != nil {
+		t.Fatalf("Unexpected error creating Elasticsearch client: %s", err)
+	}
+
+	sink, err := NewSink("elasticsearch", SinkConfig{Index: "test", ElasticClient: client, LanguageIndices: true, MappingsDir: "../../conf/mappings", Bulk: BulkOptions{FlushInterval: time.Hour}})
+	if err != nil {
+		t.Fatalf("Unexpected error creating sink: %s", err)
+	}
+
+	for i, lang := range []string{"en", "ja", "", "en", "ko"} {
+		if err := sink.Write(context.Background(), RenderedPage{URI: fmt.Sprintf("https://www.example.com/%d", i), Language: lang}); err != nil {
+			t.Fatalf("Unexpected error writing page: %s", err)
+		}
+	}
+	if err := sink.Close(context.Background()); err != nil {
+		t.Fatalf("Unexpected error closing sink: %s", err)
+	}
+
+	if diff := cmp.Diff([]string{"/test-en", "/test-cjk"}, created); diff != "" {
+		t.Fatalf("every language index should be created once, when it is first used: %s", diff)
+	}
+	if diff := cmp.Diff([]string{"test-en", "test-cjk", "test", "test-en", "test-cjk"}, indices); diff != "" {
+		t.Fatalf("pages should be routed by language: %s", diff)
+	}
+	if refreshed != "/test,test-cjk,test-en/_refresh" {
+		t.Fatalf("every index written to should be refreshed, received : %s", refreshed)
+	}
+}
+
+func TestElasticSinkRebuild(t *testing.T) {
+	tests := map[string]struct {
+		alias       bool
+		err         error
+		commit      bool
+		swapped     string
+		deleted     []string
+		deleteFails bool
+		warnings    int
+	}{
+		"first-rebuild": {
+			commit:  true,
+			swapped: `{"actions":[{"add":{"alias":"test","index":"test-20200120160405"}}]}`,
+			deleted: []string{"/test-20200118160405"},
+		},
+		"swap": {
+			alias:   true,
+			commit:  true,
+			swapped: `{"actions":[{"remove":{"alias":"test","index":"test-20200119160405"}},{"add":{"alias":"test","index":"test-20200120160405"}}]}`,
+			deleted: []string{"/test-20200118160405"},
+		},
+		// The alias already points to the new generation, so the old one left behind is only a warning
+		"cleanup-fails": {
+			alias:       true,
+			commit:      true,
+			swapped:     `{"actions":[{"remove":{"alias":"test","index":"test-20200119160405"}},{"add":{"alias":"test","index":"test-20200120160405"}}]}`,
+			deleted:     []string{"/test-20200118160405"},
+			deleteFails: true,
+			warnings:    1,
+		},
+		"discard":   {alias: true, deleted: []string{"/test-20200120160405"}},
+		"not-alias": {err: ErrNotAlias},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var (
+				created []string
+				swapped string
+				deleted []string
+			)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				switch {
+				case r.Method == http.MethodHead && r.URL.Path == "/test":
+					if !tc.alias && tc.err == nil {
+						w.WriteHeader(http.StatusNotFound)
+					}
+				case r.Method == http.MethodHead && r.URL.Path == "/_alias/test":
+					if !tc.alias {
+						w.WriteHeader(http.StatusNotFound)
+					}
+				case r.Method == http.MethodPut:
+					created = append(created, r.URL.Path)
+					fmt.Fprint(w, `{"acknowledged":true}`)
+				case r.URL.Path == "/_bulk":
+					fmt.Fprint(w, `{"errors":false,"items":[{"index":{"status":201}}]}`)
+				case r.URL.Path == "/_alias/test":
+					if !tc.alias {
+						w.WriteHeader(http.StatusNotFound)
+						fmt.Fprint(w, `{}`)
+						return
+					}
+					fmt.Fprint(w, `{"test-20200119160405":{"aliases":{"test":{}}}}`)
+				case r.URL.Path == "/_aliases":
+					body, _ := ioutil.ReadAll(r.Body)
+					swapped = string(body)
+					fmt.Fprint(w, `{"acknowledged":true}`)
+				case r.URL.Path == "/test-*/_alias":
+					fmt.Fprint(w, `{"test-20200118160405":{},"test-20200119160405":{},"test-20200120160405":{"aliases":{"test":{}}},"test-en-20200101000000":{},"test-20200121160405":{}}`)
+				case r.Method == http.MethodDelete:
+					deleted = append(deleted, r.URL.Path)
+					if tc.deleteFails {
+						w.WriteHeader(http.StatusInternalServerError)
+						fmt.Fprint(w, `{"error":"boom"}`)
+						return
+					}
+					fmt.Fprint(w, `{"acknowledged":true}`)
+				default:
+					fmt.Fprint(w, `{}`)
+				}
+			}))
+			defer srv.Close()
+
+			client, err := CreateElasticClient(GenerateElasticConfig([]string{srv.URL}, username, password))
+			if err != nil {
+				t.Fatalf("Unexpected error creating Elasticsearch client: %s", err)
+			}
+
+			s, err := NewSink("elasticsearch", SinkConfig{Index: "test", ElasticClient: client, Rebuild: true, Retain: 1, Bulk: BulkOptions{FlushInterval: time.Hour}})
+			if err != nil {
+				t.Fatalf("Unexpected error creating sink: %s", err)
+			}
+			sink := s.(*ElasticSink)
+			sink.Generation = time.Date(2020, 1, 20, 16, 4, 5, 0, time.UTC)
+			var warnings int
+			sink.SetReport(func(r BatchResult) { warnings += r.Warnings })
+
+			err = sink.Prepare(context.Background())
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("error - expected : %v, received : %v", tc.err, err)
+			}
+			if err != nil {
+				if !IsFatal(err) {
+					t.Fatalf("rebuilding into an index should be fatal: %v", err)
+				}
+				return
+			}
+			if diff := cmp.Diff([]string{"/test-20200120160405"}, created); diff != "" {
+				t.Fatalf("the new generation should be created: %s", diff)
+			}
+
+			if err := sink.Write(context.Background(), RenderedPage{URI: "https://www.example.com"}); err != nil {
+				t.Fatalf("Unexpected error writing page: %s", err)
+			}
+			if err := sink.Close(context.Background()); err != nil {
+				t.Fatalf("Unexpected error closing sink: %s", err)
+			}
+
+			if tc.commit {
+				err = sink.Commit(context.Background())
+			} else {
+				err = sink.Discard(context.Background())
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+
+			if swapped != tc.swapped {
+				t.Fatalf("\n%s:\n\n%s\n\n%s:\n\n%s", green("[expected]"), tc.swapped, red("[actual]"), swapped)
+			}
+			if diff := cmp.Diff(tc.deleted, deleted); diff != "" {
+				t.Fatalf("only generations older than the retained ones should be deleted: %s", diff)
+			}
+			if warnings != tc.warnings {
+				t.Fatalf("warnings - expected : %d, received : %d", tc.warnings, warnings)
+			}
+		})
+	}
+}
+
+func TestElasticSinkRebuildLanguageIndices(t *testing.T) {
+	tests := map[string]struct {
+		languages bool
+		created   []string
+		swapped   string
+	}{
+		// The rebuild wrote no CJK pages, so the CJK alias is swapped to an empty generation
+		"languages": {
+			languages: true,
+			created:   []string{"/test-20200120160405", "/test-en-20200120160405", "/test-cjk-20200120160405"},
+			swapped:   `{"actions":[{"add":{"alias":"test","index":"test-20200120160405"}},{"remove":{"alias":"test-cjk","index":"test-cjk-20200119160405"}},{"add":{"alias":"test-cjk","index":"test-cjk-20200120160405"}},{"add":{"alias":"test-en","index":"test-en-20200120160405"}}]}`,
+		},
+		// Pages are no longer routed by language, so the CJK alias is removed
+		"no-languages": {
+			created: []string{"/test-20200120160405"},
+			swapped: `{"actions":[{"add":{"alias":"test","index":"test-20200120160405"}},{"remove":{"alias":"test-cjk","index":"test-cjk-20200119160405"}}]}`,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var (
+				mu      sync.Mutex
+				created []string
+				swapped string
+			)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+
+				w.Header().Set("Content-Type", "application/json")
+				switch {
+				case r.Method == http.MethodHead && (r.URL.Path == "/test-cjk" || r.URL.Path == "/_alias/test-cjk"):
+					fmt.Fprint(w, `{}`)
+				case r.Method == http.MethodHead:
+					w.WriteHeader(http.StatusNotFound)
+				case r.Method == http.MethodPut:
+					created = append(created, r.URL.Path)
+					fmt.Fprint(w, `{"acknowledged":true}`)
+				case r.URL.Path == "/_bulk":
+					fmt.Fprint(w, `{"errors":false,"items":[{"index":{"status":201}}]}`)
+				case r.URL.Path == "/_alias/test-cjk":
+					fmt.Fprint(w, `{"test-cjk-20200119160405":{"aliases":{"test-cjk":{}}}}`)
+				case strings.HasPrefix(r.URL.Path, "/_alias/"):
+					w.WriteHeader(http.StatusNotFound)
+					fmt.Fprint(w, `{}`)
+				case r.URL.Path == "/_aliases":
+					body, _ := ioutil.ReadAll(r.Body)
+					swapped = string(body)
+					fmt.Fprint(w, `{"acknowledged":true}`)
+				default:
+					fmt.Fprint(w, `{}`)
+				}
+			}))
+			defer srv.Close()
+
+			client, err := CreateElasticClient(GenerateElasticConfig([]string{srv.URL}, username, password))
+			if err != nil {
+				t.Fatalf("Unexpected error creating Elasticsearch client: %s", err)
+			}
+
+			s, err := NewSink("elasticsearch", SinkConfig{Index: "test", ElasticClient: client, Rebuild: true, LanguageIndices: tc.languages, MappingsDir: "../../conf/mappings", Bulk: BulkOptions{FlushInterval: time.Hour}})
+			if err != nil {
+				t.Fatalf("Unexpected error creating sink: %s", err)
+			}
+			sink := s.(*ElasticSink)
+			sink.Generation = time.Date(2020, 1, 20, 16, 4, 5, 0, time.UTC)
+
+			if err := sink.Prepare(context.Background()); err != nil {
+				t.Fatalf("Unexpected error preparing sink: %s", err)
+			}
+			if err := sink.Write(context.Background(), RenderedPage{URI: "https://www.example.com", Language: "en"}); err != nil {
+				t.Fatalf("Unexpected error writing page: %s", err)
+			}
+			if err := sink.Close(context.Background()); err != nil {
+				t.Fatalf("Unexpected error closing sink: %s", err)
+			}
+			if err := sink.Commit(context.Background()); err != nil {
+				t.Fatalf("Unexpected error committing sink: %s", err)
+			}
+
+			if diff := cmp.Diff(tc.created, created); diff != "" {
+				t.Fatalf("unexpected generations created: %s", diff)
+			}
+			if swapped != tc.swapped {
+				t.Fatalf("\n%s:\n\n%s\n\n%s:\n\n%s", green("[expected]"), tc.swapped, red("[actual]"), swapped)
+			}
+		})
+	}
+}
@@ -0,0 +1,259 @@
+package clients
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+)
+
+// DefaultMappingsDir is where mapping files are read from when the configuration doesn't say
+const DefaultMappingsDir = "conf/mappings"
+
+// mappingSuffix is appended to a mapping name to find its file, e.g. "english" is read from
+// english_mapping.json
+const mappingSuffix = "_mapping.json"
+
+// ErrIncompatibleMapping is the kind of error returned when the target index already exists with
+// a mapping that differs from the one the crawl asked for
+var ErrIncompatibleMapping = errors.New("index mapping is incompatible")
+
+// MappingError is returned when an index exists with a mapping incompatible with the one requested
+type MappingError struct {
+	Index     string
+	Mapping   string
+	Conflicts []string
+}
+
+func (e *MappingError) Error() string {
+	return fmt.Sprintf("%s: index %s doesn't match mapping %s: %s", ErrIncompatibleMapping, e.Index, e.Mapping, strings.Join(e.Conflicts, "; "))
+}
+
+// Is makes errors.Is(err, ErrIncompatibleMapping) report true for a MappingError
+func (e *MappingError) Is(target error) bool {
+	return target == ErrIncompatibleMapping
+}
+
+// Fatal reports that no page can be written to the index until its mapping is fixed
+func (e *MappingError) Fatal() bool {
+	return true
+}
+
+// Mapping represents the settings and mappings an index is created with, read from a mapping file
+type Mapping struct {
+	Name string
+	Body []byte
+
+	properties map[string]interface{}
+}
+
+// MappingNames returns the sorted names of the mapping files in dir
+func MappingNames(dir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*"+mappingSuffix))
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(files))
+	for _, f := range files {
+		names = append(names, strings.TrimSuffix(filepath.Base(f), mappingSuffix))
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// LoadMapping reads the mapping with the given name from dir
+func LoadMapping(dir, name string) (*Mapping, error) {
+	if name == "" || strings.ContainsAny(name, `/\.`) {
+		return nil, fmt.Errorf("Mapping: %q is not a valid mapping name", name)
+	}
+
+	body, err := ioutil.ReadFile(filepath.Join(dir, name+mappingSuffix))
+	if os.IsNotExist(err) {
+		names, _ := MappingNames(dir)
+		return nil, fmt.Errorf("Mapping: %s is not supported. Must be one of '%s'", name, strings.Join(names, "', '"))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error reading mapping %s: %w", name, err)
+	}
+
+	var m struct {
+		Mappings struct {
+			Properties map[string]interface{} `json:"properties"`
+		} `json:"mappings"`
+	}
+	if err := json.Unmarshal(body, &m); err != nil {
+		return nil, fmt.Errorf("Error deserializing mapping %s: %w", name, err)
+	}
+
+	return &Mapping{Name: name, Body: body, properties: m.Mappings.Properties}, nil
+}
+
+// EnsureIndex creates the index with the mapping if it doesn't exist. If it does, the fields of the
+// mapping the index lacks are added to it, and a *MappingError is returned if any field it already
+// has is mapped differently.
+func EnsureIndex(ctx context.Context, elasticClient *elasticsearch.Client, index string, m *Mapping) error {
+	res, err := esapi.IndicesExistsRequest{Index: []string{index}}.Do(ctx, elasticClient)
+	if err != nil {
+		return fmt.Errorf("Error checking index %s exists: %w", index, err)
+	}
+	res.Body.Close()
+
+	switch {
+	case res.StatusCode == 404:
+		created, err := createIndex(ctx, elasticClient, index, m)
+		if err != nil || created {
+			return err
+		}
+		// Another crawl created the index first, so its mapping is checked instead
+	case res.IsError():
+		return &StatusError{StatusCode: res.StatusCode, Msg: fmt.Sprintf("[%s] Error checking index %s exists", res.Status(), index)}
+	}
+
+	existing, err := getMapping(ctx, elasticClient, index)
+	if err != nil {
+		return err
+	}
+
+	missing, conflicts := compareMappings("", m.properties, existing)
+	if len(conflicts) > 0 {
+		return &MappingError{Index: index, Mapping: m.Name, Conflicts: conflicts}
+	}
+	if len(missing) > 0 {
+		return putMapping(ctx, elasticClient, index, m.Name, missing)
+	}
+
+	return nil
+}
+
+// putMapping adds the field properties to the mapping of the index
+func putMapping(ctx context.Context, elasticClient *elasticsearch.Client, index, name string, properties map[string]interface{}) error {
+	body, err := json.Marshal(map[string]interface{}{"properties": properties})
+	if err != nil {
+		return fmt.Errorf("Error serializing the fields of mapping %s: %w", name, err)
+	}
+
+	res, err := esapi.IndicesPutMappingRequest{Index: []string{index}, Body: bytes.NewReader(body)}.Do(ctx, elasticClient)
+	if err != nil {
+		return fmt.Errorf("Error adding the fields of mapping %s to index %s: %w", name, index, err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return &StatusError{StatusCode: res.StatusCode, Msg: fmt.Sprintf("[%s] Error adding the fields of mapping %s to index %s, err=%s", res.Status(), name, index, res.String())}
+	}
+
+	return nil
+}
+
+// createIndex creates the index from the mapping, or for dynamic mapping if m is nil, returning
+// false if it already exists
+func createIndex(ctx context.Context, elasticClient *elasticsearch.Client, index string, m *Mapping) (bool, error) {
+	req := esapi.IndicesCreateRequest{
+		Index: index,
+	}
+	name := "dynamic"
+	if m != nil {
+		req.Body = bytes.NewReader(m.Body)
+		name = m.Name
+	}
+
+	res, err := req.Do(ctx, elasticClient)
+	if err != nil {
+		return false, fmt.Errorf("Error creating index %s: %w", index, err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		if strings.Contains(res.String(), "resource_already_exists_exception") {
+			return false, nil
+		}
+		return false, &StatusError{StatusCode: res.StatusCode, Msg: fmt.Sprintf("[%s] Error creating index %s with mapping %s, err=%s", res.Status(), index, name, res.String())}
+	}
+
+	return true, nil
+}
+
+// getMapping returns the field properties of the index, or of the index an alias points to
+func getMapping(ctx context.Context, elasticClient *elasticsearch.Client, index string) (map[string]interface{}, error) {
+	res, err := esapi.IndicesGetMappingRequest{Index: []string{index}}.Do(ctx, elasticClient)
+	if err != nil {
+		return nil, fmt.Errorf("Error getting mapping of index %s: %w", index, err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return nil, &StatusError{StatusCode: res.StatusCode, Msg: fmt.Sprintf("[%s] Error getting mapping of index %s, err=%s", res.Status(), index, res.String())}
+	}
+
+	var r map[string]struct {
+		Mappings struct {
+			Properties map[string]interface{} `json:"properties"`
+		} `json:"mappings"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return nil, fmt.Errorf("Error deserializing the mapping of index %s: %w", index, err)
+	}
+
+	for _, idx := range r {
+		return idx.Mappings.Properties, nil
+	}
+
+	return nil, nil
+}
+
+// mappedAttributes are the attributes of a field that must match for an existing mapping to be compatible
+var mappedAttributes = []string{"type", "analyzer", "search_analyzer"}
+
+// compareMappings returns the properties of the fields in want that are missing from got, to be
+// added to it, and a description of every field mapped differently. Fields only in got are ignored.
+func compareMappings(prefix string, want, got map[string]interface{}) (missing map[string]interface{}, conflicts []string) {
+	fields := make([]string, 0, len(want))
+	for field := range want {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	missing = make(map[string]interface{})
+	for _, field := range fields {
+		path := prefix + field
+		w, _ := want[field].(map[string]interface{})
+		g, ok := got[field].(map[string]interface{})
+		if !ok {
+			missing[field] = want[field]
+			continue
+		}
+
+		for _, attr := range mappedAttributes {
+			if wv, ok := w[attr]; ok && wv != g[attr] {
+				conflicts = append(conflicts, fmt.Sprintf("%s has %s %v instead of %v", path, attr, g[attr], wv))
+			}
+		}
+
+		if wp, ok := w["properties"].(map[string]interface{}); ok {
+			gp, _ := g["properties"].(map[string]interface{})
+			subMissing, subConflicts := compareMappings(path+".", wp, gp)
+			conflicts = append(conflicts, subConflicts...)
+			if len(subMissing) > 0 {
+				// An object field is extended by putting it with only its new properties
+				object := map[string]interface{}{"properties": subMissing}
+				if t, ok := w["type"]; ok {
+					object["type"] = t
+				}
+				missing[field] = object
+			}
+		}
+	}
+
+	return missing, conflicts
+}
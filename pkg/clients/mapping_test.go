@@ -0,0 +1,147 @@
+package clients
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+const testMappingsDir = "../../conf/mappings"
+
+func TestMappingNames(t *testing.T) {
+	names, err := MappingNames(testMappingsDir)
+	if err != nil {
+		t.Fatalf("Unexpected error listing mappings: %s", err)
+	}
+	if diff := cmp.Diff([]string{"autocomplete", "cjk", "english"}, names); diff != "" {
+		t.Fatalf(diff)
+	}
+}
+
+func TestLoadMapping(t *testing.T) {
+	tests := map[string]struct {
+		name   string
+		errMsg string
+	}{
+		"english":   {name: "english"},
+		"cjk":       {name: "cjk"},
+		"unknown":   {name: "french", errMsg: "Mapping: french is not supported. Must be one of 'autocomplete', 'cjk', 'english'"},
+		"traversal": {name: "../test", errMsg: `Mapping: "../test" is not a valid mapping name`},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			m, err := LoadMapping(testMappingsDir, tc.name)
+
+			var errMsg string
+			if err != nil {
+				errMsg = err.Error()
+			}
+			if errMsg != tc.errMsg {
+				t.Fatalf("error - expected : %q, received : %q", tc.errMsg, errMsg)
+			}
+			if err == nil && m.properties["uri"] == nil {
+				t.Fatalf("mapping %s has no uri field: %s", tc.name, m.Body)
+			}
+		})
+	}
+}
+
+func TestEnsureIndex(t *testing.T) {
+	m, err := LoadMapping(testMappingsDir, "english")
+	if err != nil {
+		t.Fatalf("Unexpected error loading mapping: %s", err)
+	}
+
+	var compatible map[string]interface{}
+	if err := json.Unmarshal(m.Body, &compatible); err != nil {
+		t.Fatalf("Unexpected error decoding mapping: %s", err)
+	}
+	existing, _ := json.Marshal(map[string]interface{}{"test-v1": map[string]interface{}{"mappings": compatible["mappings"]}})
+	dynamic := `{"test":{"mappings":{"properties":{"uri":{"type":"text","fields":{"keyword":{"type":"keyword"}}}}}}}`
+
+	// An index created before page_score and the images' page were added to the mapping
+	properties := compatible["mappings"].(map[string]interface{})["properties"].(map[string]interface{})
+	older := make(map[string]interface{}, len(properties))
+	for field, p := range properties {
+		older[field] = p
+	}
+	delete(older, "page_score")
+	olderImages := make(map[string]interface{})
+	for field, p := range properties["images"].(map[string]interface{})["properties"].(map[string]interface{}) {
+		olderImages[field] = p
+	}
+	delete(olderImages, "page")
+	older["images"] = map[string]interface{}{"properties": olderImages}
+	outdated, _ := json.Marshal(map[string]interface{}{"test": map[string]interface{}{"mappings": map[string]interface{}{"properties": older}}})
+	added := `{"properties":{"images":{"properties":{"page":{"type":"keyword"}}},"page_score":{"type":"float"}}}`
+
+	tests := map[string]struct {
+		exists  bool
+		mapping string
+		created bool
+		added   string
+		err     error
+	}{
+		"missing":       {created: true},
+		"compatible":    {exists: true, mapping: string(existing)},
+		"missing-field": {exists: true, mapping: string(outdated), added: added},
+		"incompatible":  {exists: true, mapping: dynamic, err: ErrIncompatibleMapping},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var created, put []byte
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				switch {
+				case r.Method == http.MethodHead && r.URL.Path == "/test":
+					if !tc.exists {
+						w.WriteHeader(http.StatusNotFound)
+					}
+				case r.Method == http.MethodPut && r.URL.Path == "/test":
+					created, _ = ioutil.ReadAll(r.Body)
+					fmt.Fprint(w, `{"acknowledged":true}`)
+				case r.Method == http.MethodGet && r.URL.Path == "/test/_mapping":
+					fmt.Fprint(w, tc.mapping)
+				case r.Method == http.MethodPut && r.URL.Path == "/test/_mapping":
+					put, _ = ioutil.ReadAll(r.Body)
+					fmt.Fprint(w, `{"acknowledged":true}`)
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			}))
+			defer srv.Close()
+
+			client, err := CreateElasticClient(GenerateElasticConfig([]string{srv.URL}, username, password))
+			if err != nil {
+				t.Fatalf("Unexpected error creating Elasticsearch client: %s", err)
+			}
+
+			err = EnsureIndex(context.Background(), client, "test", m)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("error - expected : %v, received : %v", tc.err, err)
+			}
+			if tc.err != nil && !strings.Contains(err.Error(), "uri has type text instead of keyword") {
+				t.Fatalf("the error should name the conflicting field: %s", err)
+			}
+			if (created != nil) != tc.created {
+				t.Fatalf("index created - expected : %t, received : %s", tc.created, created)
+			}
+			if tc.created && string(created) != string(m.Body) {
+				t.Fatalf("the index should be created with the mapping file: %s", created)
+			}
+			if diff := cmp.Diff(tc.added, string(put)); diff != "" {
+				t.Fatalf("only the missing fields should be added: %s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,303 @@
+package clients
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+)
+
+// MaxPruneURIs is the most stale page URIs a PruneResult lists
+const MaxPruneURIs = 100
+
+// Pruner is implemented by sinks that can remove the pages of a site a crawl no longer found
+type Pruner interface {
+	// Prune deletes the pages of the site last seen before the given time, other than the ones with
+	// the document IDs in keep, or only finds them if dryRun is set
+	Prune(ctx context.Context, site string, before time.Time, keep []string, dryRun bool) (PruneResult, error)
+}
+
+// PruneResult represents the stale pages a Pruner found and deleted
+type PruneResult struct {
+	Stale   int
+	Deleted int
+	// URIs lists up to MaxPruneURIs of the stale pages
+	URIs []string
+}
+
+// staleQuery returns the Elasticsearch query matching the pages of the site last seen before the
+// time, other than the ones with the document IDs in keep
+func staleQuery(site string, before time.Time, keep []string) map[string]interface{} {
+	if keep == nil {
+		keep = []string{}
+	}
+
+	return map[string]interface{}{
+		"bool": map[string]interface{}{
+			"must_not": map[string]interface{}{"ids": map[string]interface{}{"values": keep}},
+			"filter": []interface{}{
+				// Indices created by dynamic mapping hold the site in a keyword sub-field
+				map[string]interface{}{"bool": map[string]interface{}{
+					"should": []interface{}{
+						map[string]interface{}{"term": map[string]string{"site": site}},
+						map[string]interface{}{"term": map[string]string{"site.keyword": site}},
+					},
+					"minimum_should_match": 1,
+				}},
+				map[string]interface{}{"range": map[string]interface{}{
+					"last_seen": map[string]string{"lt": before.UTC().Format(LastSeenLayout)},
+				}},
+			},
+		},
+	}
+}
+
+// pruneIndices returns the indices the sink has written the pages of a crawl to
+func (s *ElasticSink) pruneIndices() []string {
+	indices := map[string]bool{s.Index: true}
+	for _, index := range s.preparedIndices() {
+		indices[index] = true
+	}
+
+	s.mu.Lock()
+	for index := range s.written {
+		indices[index] = true
+	}
+	s.mu.Unlock()
+
+	names := make([]string, 0, len(indices))
+	for index := range indices {
+		names = append(names, index)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Prune finds the stale pages of the site with a search, then deletes them with _delete_by_query
+// unless dryRun is set
+func (s *ElasticSink) Prune(ctx context.Context, site string, before time.Time, keep []string, dryRun bool) (result PruneResult, err error) {
+	indices := s.pruneIndices()
+	query := staleQuery(site, before, keep)
+	ignoreUnavailable := true
+
+	body, err := json.Marshal(map[string]interface{}{"query": query, "_source": []string{"uri"}})
+	if err != nil {
+		return result, err
+	}
+	size := MaxPruneURIs
+	req := esapi.SearchRequest{
+		Index:             indices,
+		Body:              bytes.NewReader(body),
+		Size:              &size,
+		TrackTotalHits:    true,
+		IgnoreUnavailable: &ignoreUnavailable,
+	}
+	res, err := req.Do(ctx, s.Client)
+	if err != nil {
+		return result, fmt.Errorf("Error searching for stale pages of %s: %s", site, err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return result, &StatusError{StatusCode: res.StatusCode, Msg: fmt.Sprintf("[%s] Error searching for stale pages of %s, err=%s", res.Status(), site, res.String())}
+	}
+
+	var r struct {
+		Hits struct {
+			Total struct {
+				Value int `json:"value"`
+			} `json:"total"`
+			Hits []struct {
+				Source struct {
+					URI string `json:"uri"`
+				} `json:"_source"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return result, fmt.Errorf("Error deserializing the stale pages of %s: %s", site, err)
+	}
+
+	result.Stale = r.Hits.Total.Value
+	for _, hit := range r.Hits.Hits {
+		result.URIs = append(result.URIs, hit.Source.URI)
+	}
+	if dryRun || result.Stale == 0 {
+		return result, nil
+	}
+
+	body, err = json.Marshal(map[string]interface{}{"query": query})
+	if err != nil {
+		return result, err
+	}
+	refresh := true
+	dreq := esapi.DeleteByQueryRequest{
+		Index:             indices,
+		Body:              bytes.NewReader(body),
+		Conflicts:         "proceed",
+		Refresh:           &refresh,
+		IgnoreUnavailable: &ignoreUnavailable,
+	}
+	dres, err := dreq.Do(ctx, s.Client)
+	if err != nil {
+		return result, fmt.Errorf("Error deleting stale pages of %s: %s", site, err)
+	}
+	defer dres.Body.Close()
+
+	if dres.IsError() {
+		return result, &StatusError{StatusCode: dres.StatusCode, Msg: fmt.Sprintf("[%s] Error deleting stale pages of %s, err=%s", dres.Status(), site, dres.String())}
+	}
+
+	var d struct {
+		Deleted int `json:"deleted"`
+	}
+	if err := json.NewDecoder(dres.Body).Decode(&d); err != nil {
+		return result, fmt.Errorf("Error deserializing the delete by query response: %s", err)
+	}
+	result.Deleted = d.Deleted
+
+	return result, nil
+}
+
+// appsearchRequest sends a JSON request to the documents API of the engine
+func (ac *AppsearchClient) appsearchRequest(ctx context.Context, method, engine, path string, body interface{}) (*http.Response, error) {
+	bodyJSON, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, ac.Endpoint+ac.API+"engines/"+engine+"/documents"+path, bytes.NewReader(bodyJSON))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Authorization", "Bearer "+ac.Token)
+	req.Header.Add("Content-Type", "application/json")
+
+	resp, err := ac.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		return nil, newAppsearchError(resp)
+	}
+
+	return resp, nil
+}
+
+// AppsearchListedDocument represents the fields of a listed document used to find stale pages
+type AppsearchListedDocument struct {
+	ID       string `json:"id"`
+	URI      string `json:"uri"`
+	Site     string `json:"site"`
+	LastSeen string `json:"last_seen"`
+}
+
+// ListDocuments returns a page, counting from 1, of up to 100 documents in the engine along with the
+// number of pages. App Search lists at most the first 10,000 documents of an engine.
+func (ac *AppsearchClient) ListDocuments(ctx context.Context, engine string, page int) (docs []AppsearchListedDocument, totalPages int, err error) {
+	body := map[string]interface{}{"page": map[string]int{"current": page, "size": maxAppsearchBatch}}
+	resp, err := ac.appsearchRequest(ctx, http.MethodPost, engine, "/list", body)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	var r struct {
+		Meta struct {
+			Page struct {
+				TotalPages int `json:"total_pages"`
+			} `json:"page"`
+		} `json:"meta"`
+		Results []AppsearchListedDocument `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return nil, 0, fmt.Errorf("Error deserializing the App Search response object: %s", err)
+	}
+
+	return r.Results, r.Meta.Page.TotalPages, nil
+}
+
+// DeleteDocuments destroys up to 100 documents in the engine, returning how many were deleted
+func (ac *AppsearchClient) DeleteDocuments(ctx context.Context, engine string, ids []string) (deleted int, err error) {
+	resp, err := ac.appsearchRequest(ctx, http.MethodDelete, engine, "", ids)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	var results []struct {
+		ID      string `json:"id"`
+		Deleted bool   `json:"deleted"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		return 0, fmt.Errorf("Error deserializing the App Search response object: %s", err)
+	}
+
+	for _, r := range results {
+		if r.Deleted {
+			deleted++
+		}
+	}
+
+	return deleted, nil
+}
+
+// Prune lists every document in the engine to find the stale pages of the site, then destroys
+// them in batches unless dryRun is set
+func (s *AppsearchSink) Prune(ctx context.Context, site string, before time.Time, keep []string, dryRun bool) (result PruneResult, err error) {
+	kept := make(map[string]bool, len(keep))
+	for _, id := range keep {
+		kept[id] = true
+	}
+
+	var stale []string
+	for page, pages := 1, 1; page <= pages; page++ {
+		var docs []AppsearchListedDocument
+		docs, pages, err = s.Client.ListDocuments(ctx, s.Engine, page)
+		if err != nil {
+			return result, err
+		}
+
+		for _, doc := range docs {
+			if !strings.EqualFold(doc.Site, site) || kept[doc.ID] {
+				continue
+			}
+			if seen, err := time.Parse(LastSeenLayout, doc.LastSeen); err != nil || !seen.Before(before) {
+				continue
+			}
+
+			stale = append(stale, doc.ID)
+			if len(result.URIs) < MaxPruneURIs {
+				result.URIs = append(result.URIs, doc.URI)
+			}
+		}
+	}
+
+	result.Stale = len(stale)
+	if dryRun {
+		return result, nil
+	}
+
+	for i := 0; i < len(stale); i += maxAppsearchBatch {
+		end := i + maxAppsearchBatch
+		if end > len(stale) {
+			end = len(stale)
+		}
+
+		deleted, err := s.Client.DeleteDocuments(ctx, s.Engine, stale[i:end])
+		result.Deleted += deleted
+		if err != nil {
+			return result, err
+		}
+	}
+
+	return result, nil
+}
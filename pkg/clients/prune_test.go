@@ -0,0 +1,129 @@
+package clients
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var pruneBefore = time.Date(2020, 1, 20, 16, 4, 5, 0, time.UTC)
+
+func TestElasticSinkPrune(t *testing.T) {
+	for _, dryRun := range []bool{true, false} {
+		t.Run(fmt.Sprintf("dry-run-%t", dryRun), func(t *testing.T) {
+			var (
+				query   string
+				deleted bool
+			)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				switch r.URL.Path {
+				case "/test/_search":
+					body, _ := ioutil.ReadAll(r.Body)
+					query = string(body)
+					fmt.Fprint(w, `{"hits":{"total":{"value":2},"hits":[{"_source":{"uri":"https://www.example.com/a"}},{"_source":{"uri":"https://www.example.com/b"}}]}}`)
+				case "/test/_delete_by_query":
+					deleted = true
+					fmt.Fprint(w, `{"deleted":2}`)
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			}))
+			defer srv.Close()
+
+			client, err := CreateElasticClient(GenerateElasticConfig([]string{srv.URL}, username, password))
+			if err != nil {
+				t.Fatalf("Unexpected error creating Elasticsearch client: %s", err)
+			}
+			sink, err := NewSink("elasticsearch", SinkConfig{Index: "test", ElasticClient: client})
+			if err != nil {
+				t.Fatalf("Unexpected error creating sink: %s", err)
+			}
+
+			result, err := sink.(Pruner).Prune(context.Background(), "www.example.com", pruneBefore, []string{"kept"}, dryRun)
+			if err != nil {
+				t.Fatalf("Unexpected error pruning: %s", err)
+			}
+
+			if !strings.Contains(query, `"ids":{"values":["kept"]}`) || !strings.Contains(query, `"site":"www.example.com"`) || !strings.Contains(query, `"lt":"2020-01-20T16:04:05.000Z"`) {
+				t.Fatalf("the search should match the site's pages last seen before the crawl: %s", query)
+			}
+			if deleted == dryRun {
+				t.Fatalf("deleted - expected : %t, received : %t", !dryRun, deleted)
+			}
+			want := PruneResult{Stale: 2, URIs: []string{"https://www.example.com/a", "https://www.example.com/b"}}
+			if !dryRun {
+				want.Deleted = 2
+			}
+			if diff := cmp.Diff(want, result); diff != "" {
+				t.Fatalf(diff)
+			}
+		})
+	}
+}
+
+func TestAppsearchSinkPrune(t *testing.T) {
+	var destroyed [][]string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.URL.Path == "/api/as/v1/engines/test/documents/list":
+			var req struct {
+				Page struct {
+					Current int `json:"current"`
+				} `json:"page"`
+			}
+			json.NewDecoder(r.Body).Decode(&req)
+
+			// The second page holds a stale page of another site, a fresh page and an unchanged page
+			if req.Page.Current == 1 {
+				fmt.Fprint(w, `{"meta":{"page":{"current":1,"total_pages":2}},"results":[
+					{"id":"1","uri":"https://www.example.com/old","site":"www.example.com","last_seen":"2020-01-19T00:00:00.000Z"},
+					{"id":"2","uri":"https://www.example.com/unseen","site":"www.example.com"}]}`)
+				return
+			}
+			fmt.Fprint(w, `{"meta":{"page":{"current":2,"total_pages":2}},"results":[
+				{"id":"3","uri":"https://other.example.com/old","site":"other.example.com","last_seen":"2020-01-19T00:00:00.000Z"},
+				{"id":"4","uri":"https://www.example.com/new","site":"www.example.com","last_seen":"2020-01-20T16:04:05.000Z"},
+				{"id":"5","uri":"https://www.example.com/unchanged","site":"www.example.com","last_seen":"2020-01-19T00:00:00.000Z"}]}`)
+		case r.Method == http.MethodDelete && r.URL.Path == "/api/as/v1/engines/test/documents":
+			var ids []string
+			json.NewDecoder(r.Body).Decode(&ids)
+			destroyed = append(destroyed, ids)
+
+			var results []string
+			for _, id := range ids {
+				results = append(results, fmt.Sprintf(`{"id":%q,"deleted":true}`, id))
+			}
+			fmt.Fprintf(w, "[%s]", strings.Join(results, ","))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	sink, err := NewSink("app-search", SinkConfig{Engine: "test", AppsearchClient: CreateAppsearchClient(srv.URL, "private-token", "/api/as/v1/")})
+	if err != nil {
+		t.Fatalf("Unexpected error creating sink: %s", err)
+	}
+
+	result, err := sink.(Pruner).Prune(context.Background(), "www.example.com", pruneBefore, []string{"5"}, false)
+	if err != nil {
+		t.Fatalf("Unexpected error pruning: %s", err)
+	}
+
+	if diff := cmp.Diff([][]string{{"1"}}, destroyed); diff != "" {
+		t.Fatalf("only the stale pages of the site should be destroyed: %s", diff)
+	}
+	if diff := cmp.Diff(PruneResult{Stale: 1, Deleted: 1, URIs: []string{"https://www.example.com/old"}}, result); diff != "" {
+		t.Fatalf(diff)
+	}
+}
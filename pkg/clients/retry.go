@@ -0,0 +1,140 @@
+package clients
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultRetryBaseDelay is the longest wait before the first retry
+	DefaultRetryBaseDelay = 500 * time.Millisecond
+	// DefaultRetryMaxDelay caps the wait between retries however many attempts have failed
+	DefaultRetryMaxDelay = 30 * time.Second
+)
+
+// RetryPolicy retries transient failures with exponential backoff and full jitter
+type RetryPolicy struct {
+	// Attempts is how many times a failed call is retried, 0 disables retrying
+	Attempts  int
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+// NewRetryPolicy returns a policy retrying up to attempts times with the default delays
+func NewRetryPolicy(attempts int) RetryPolicy {
+	return RetryPolicy{Attempts: attempts, BaseDelay: DefaultRetryBaseDelay, MaxDelay: DefaultRetryMaxDelay}
+}
+
+// Backoff returns a random wait before the given retry, counting from 1, of up to BaseDelay doubled
+// for every earlier retry and capped at MaxDelay
+func (p RetryPolicy) Backoff(retry int) time.Duration {
+	d := p.BaseDelay
+	for i := 1; i < retry && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// Do calls f until it succeeds, fails with an error that isn't retryable or runs out of attempts,
+// calling notify before every retry. It returns how many times f was retried.
+func (p RetryPolicy) Do(ctx context.Context, f func() error, notify func(retry int, wait time.Duration, err error)) (retries int, err error) {
+	for {
+		err = f()
+		if err == nil || retries >= p.Attempts || ctx.Err() != nil || !IsRetryable(err) {
+			return retries, err
+		}
+
+		retries++
+		wait := p.Backoff(retries)
+		if notify != nil {
+			notify(retries, wait, err)
+		}
+		if sleepErr := Sleep(ctx, wait); sleepErr != nil {
+			return retries, err
+		}
+	}
+}
+
+// Sleep waits for d, returning early with the context's error if ctx is done first
+func Sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// StatusError represents an unsuccessful HTTP response from Elasticsearch or a crawled site
+type StatusError struct {
+	StatusCode int
+	Msg        string
+}
+
+func (e *StatusError) Error() string {
+	return e.Msg
+}
+
+// Temporary reports whether the request may succeed if it is retried
+func (e *StatusError) Temporary() bool {
+	return RetryableStatus(e.StatusCode)
+}
+
+// RetryableStatus reports whether a response with the status code may succeed if the request is retried
+func RetryableStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= 500
+}
+
+// IsRetryable reports whether err is a transient failure, such as a timeout, a dropped connection,
+// a 5xx response or rate limiting, that may succeed if the call is retried
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var temporary interface{ Temporary() bool }
+	if errors.As(err, &temporary) && temporary.Temporary() {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// retryNotifier returns the notify function that logs every retry of a write made by a sink
+func retryNotifier(log *logrus.Logger, p RetryPolicy, what string) func(int, time.Duration, error) {
+	return func(retry int, wait time.Duration, err error) {
+		if log != nil {
+			log.Warnf("Retrying %s in %s (retry %d of %d): %v", what, wait, retry, p.Attempts, err)
+		}
+	}
+}
+
+// giveUpError wraps the last error of a call that was retried until it ran out of attempts
+func giveUpError(retries int, err error) error {
+	if retries == 0 {
+		return err
+	}
+	return fmt.Errorf("Giving up after %d retries: %w", retries, err)
+}
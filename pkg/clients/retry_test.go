@@ -0,0 +1,80 @@
+package clients
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := RetryPolicy{Attempts: 10, BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+
+	for retry, max := range map[int]time.Duration{1: 100 * time.Millisecond, 2: 200 * time.Millisecond, 4: 800 * time.Millisecond, 8: time.Second} {
+		for i := 0; i < 100; i++ {
+			if d := p.Backoff(retry); d < 0 || d > max {
+				t.Fatalf("backoff of retry %d - expected at most : %s, received : %s", retry, max, d)
+			}
+		}
+	}
+}
+
+func TestRetryPolicyDo(t *testing.T) {
+	tests := map[string]struct {
+		errs    []error
+		retries int
+		failed  bool
+	}{
+		"success":       {errs: []error{nil}},
+		"retried":       {errs: []error{&StatusError{StatusCode: http.StatusServiceUnavailable}, nil}, retries: 1},
+		"rate-limited":  {errs: []error{&StatusError{StatusCode: http.StatusTooManyRequests}, nil}, retries: 1},
+		"not-retryable": {errs: []error{&StatusError{StatusCode: http.StatusBadRequest}}, failed: true},
+		"gave-up":       {errs: []error{&StatusError{StatusCode: 502}, &StatusError{StatusCode: 502}, &StatusError{StatusCode: 502}}, retries: 2, failed: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			p := RetryPolicy{Attempts: 2, BaseDelay: time.Millisecond}
+
+			var calls, notified int
+			retries, err := p.Do(context.Background(), func() error {
+				err := tc.errs[calls]
+				calls++
+				return err
+			}, func(int, time.Duration, error) { notified++ })
+
+			if retries != tc.retries || notified != tc.retries {
+				t.Fatalf("retries - expected : %d, received : %d (notified %d)", tc.retries, retries, notified)
+			}
+			if (err != nil) != tc.failed {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := map[string]struct {
+		err       error
+		retryable bool
+	}{
+		"nil":          {err: nil},
+		"server":       {err: &StatusError{StatusCode: http.StatusInternalServerError}, retryable: true},
+		"wrapped":      {err: fmt.Errorf("bulk: %w", &StatusError{StatusCode: http.StatusServiceUnavailable}), retryable: true},
+		"client":       {err: &StatusError{StatusCode: http.StatusNotFound}},
+		"appsearch":    {err: &AppsearchError{StatusCode: http.StatusBadGateway}, retryable: true},
+		"unauthorized": {err: ErrAppsearchUnauthorized},
+		"cancelled":    {err: context.Canceled},
+		"other":        {err: errors.New("invalid document")},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if retryable := IsRetryable(tc.err); retryable != tc.retryable {
+				t.Fatalf("retryable - expected : %t, received : %t", tc.retryable, retryable)
+			}
+		})
+	}
+}
@@ -0,0 +1,293 @@
+package clients
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/sirupsen/logrus"
+)
+
+// Meta represents the data scraped from the metdata of the HTML head on the page
+type Meta struct {
+	OgImage  string `json:"ogimage"`
+	Title    string `json:"title"`
+	Desc     string `json:"description"`
+	Keywords string `json:"keywords"`
+}
+
+// FileInfo represents the metadata of a document such as a PDF
+type FileInfo struct {
+	Name      string `json:"name,omitempty"`
+	Author    string `json:"author,omitempty"`
+	PageCount int    `json:"page_count,omitempty"`
+	Size      int    `json:"size,omitempty"`
+}
+
+// Image represents an image of a page. Every field is written, even when empty, so App Search gets
+// lists of the same length for each of them.
+type Image struct {
+	Src     string `json:"src"`
+	Alt     string `json:"alt"`
+	Title   string `json:"title"`
+	Caption string `json:"caption"`
+	Width   int    `json:"width"`
+	Height  int    `json:"height"`
+
+	// Page is the URI of the page the image was found on, which is only set in the documents of
+	// image indices
+	Page string `json:"page,omitempty"`
+}
+
+// Link represents a link of a page and its anchor text
+type Link struct {
+	URL  string `json:"url"`
+	Text string `json:"text"`
+}
+
+// RenderedPage represents the structred data scraped from the page
+type RenderedPage struct {
+	ID           string              `json:"id,omitempty"`
+	URI          string              `json:"uri"`
+	Source       map[string][]string `json:"source"`
+	Meta         Meta                `json:"meta"`
+	LastModified string              `json:"last_modified,omitempty"`
+	Language     string              `json:"language,omitempty"`
+
+	// BodyText is the text of the page's main content, without navigation, banners or footers, and
+	// Summary its leading sentences
+	BodyText string `json:"body_text,omitempty"`
+	Summary  string `json:"summary,omitempty"`
+
+	// Site is the host the page was crawled from and LastSeen when the crawl that last found it
+	// started, formatted with LastSeenLayout
+	Site     string `json:"site,omitempty"`
+	LastSeen string `json:"last_seen,omitempty"`
+
+	// Aliases are the other URLs the page was found under, including pages with the same content
+	Aliases []string `json:"aliases,omitempty"`
+
+	// ContentType is the media type of the page, e.g. "text/html" or "application/pdf", and File
+	// describes the documents that aren't web pages
+	ContentType string    `json:"content_type,omitempty"`
+	File        *FileInfo `json:"file,omitempty"`
+
+	// Images are the images of the page, in order
+	Images []Image `json:"images,omitempty"`
+
+	// Outlinks are the links of the page. Inlinks counts the crawled pages linking to it,
+	// AnchorText holds the text of those links and PageScore ranks the page by them, which are only
+	// known once the crawl is over.
+	Outlinks   []Link   `json:"outlinks,omitempty"`
+	Inlinks    int      `json:"inlinks"`
+	AnchorText []string `json:"anchor_text,omitempty"`
+	PageScore  float64  `json:"page_score"`
+
+	// Fields holds the values extracted by the crawl's extraction spec, which are written alongside
+	// the other fields of the document
+	Fields map[string]interface{} `json:"-"`
+
+	// Structured holds the OpenGraph and Twitter card properties and the schema.org data of the
+	// page, keyed by their field, e.g. "opengraph" or "schema"
+	Structured map[string]interface{} `json:"-"`
+}
+
+// MarshalJSON writes the extracted fields and structured data of the page alongside its other fields
+func (p RenderedPage) MarshalJSON() ([]byte, error) {
+	type page RenderedPage
+	return marshalWithFields(page(p), p.Fields, p.Structured)
+}
+
+// reservedFields are the fields of the documents written to any sink, which extracted fields can't replace
+var reservedFields = map[string]bool{
+	"id": true, "uri": true, "source": true, "meta": true, "last_modified": true, "language": true,
+	"site": true, "last_seen": true, "aliases": true, "description": true, "ogimage": true,
+	"title": true, "keywords": true, "body_text": true, "summary": true, "opengraph": true,
+	"twitter": true, "article": true, "book": true, "profile": true, "music": true, "video": true,
+	"schema": true, "content_type": true, "file": true, "file_name": true, "file_author": true,
+	"file_page_count": true, "file_size": true, "images": true,
+	"outlinks": true, "inlinks": true, "anchor_text": true, "page_score": true,
+}
+
+// IsReservedField reports whether the name is already a field of the documents written to sinks
+func IsReservedField(name string) bool {
+	return reservedFields[name]
+}
+
+// marshalWithFields marshals the document, which must be a non-empty JSON object, with the fields
+// added to it
+func marshalWithFields(doc interface{}, fields ...map[string]interface{}) ([]byte, error) {
+	body, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range fields {
+		if len(f) == 0 {
+			continue
+		}
+		extra, err := json.Marshal(f)
+		if err != nil {
+			return nil, err
+		}
+
+		body = append(body[:len(body)-1], ',')
+		body = append(body, extra[1:]...)
+	}
+	return body, nil
+}
+
+// LastSeenLayout formats the LastSeen time of pages in UTC with millisecond precision
+const LastSeenLayout = "2006-01-02T15:04:05.000Z07:00"
+
+// DocumentID returns the ID a page is stored under in every sink, derived from its URI
+func DocumentID(uri string) string {
+	idBytes := md5.Sum([]byte(uri))
+	return hex.EncodeToString(idBytes[:])
+}
+
+// pageID returns the ID the page is stored under, which is its canonical URI's unless it is set
+func pageID(p RenderedPage) string {
+	if p.ID != "" {
+		return p.ID
+	}
+	return DocumentID(p.URI)
+}
+
+// Sink represents a destination crawled pages are written to
+type Sink interface {
+	// Write sends the page to the destination, or buffers it until the next Flush
+	Write(ctx context.Context, page RenderedPage) error
+	// Flush sends any buffered pages to the destination
+	Flush(ctx context.Context) error
+	// Close flushes the sink and releases its resources once the crawl is over
+	Close(ctx context.Context) error
+}
+
+// BatchResult represents the outcome of a batch of pages a Sink sent to its destination
+type BatchResult struct {
+	Indexed int
+	Failed  int
+	Errors  []error
+
+	// FailedIDs holds the document IDs of the pages that failed
+	FailedIDs []string
+
+	// Retries counts the retried requests, GaveUp the batches still failing once retries ran out
+	Retries int
+	GaveUp  int
+
+	// Warnings counts failures that left the written pages searchable, such as previous generations
+	// that couldn't be deleted
+	Warnings int
+}
+
+// Reporter is implemented by sinks that send pages in batches. Pages written to them are counted
+// when the sink reports the batch they were sent in, rather than when Write returns.
+type Reporter interface {
+	// SetReport registers the function called with the outcome of every batch
+	SetReport(report func(BatchResult))
+}
+
+// Preparer is implemented by sinks that set up their destination, such as creating an index,
+// before any page is written to them
+type Preparer interface {
+	Prepare(ctx context.Context) error
+}
+
+// Committer is implemented by sinks that write a crawl somewhere new and only publish it once the
+// crawl succeeds
+type Committer interface {
+	// Commit publishes the pages written by a crawl that ran to completion
+	Commit(ctx context.Context) error
+	// Discard removes the pages written by a crawl that failed or was cancelled
+	Discard(ctx context.Context) error
+}
+
+// Updater is implemented by sinks that can set fields of the documents they hold once a crawl is over
+type Updater interface {
+	// Update sets the fields of the documents keyed by their IDs, leaving their other fields as they
+	// are. It is called after Close and before Commit. Documents the sink doesn't hold are skipped.
+	// The result counts the documents updated as indexed.
+	Update(ctx context.Context, updates map[string]map[string]interface{}) (BatchResult, error)
+}
+
+// FatalError is implemented by errors after which a sink cannot write any more pages, such as
+// rejected credentials or a missing destination
+type FatalError interface {
+	Fatal() bool
+}
+
+// IsFatal reports whether err, or an error it wraps, is a FatalError
+func IsFatal(err error) bool {
+	var f FatalError
+	return errors.As(err, &f) && f.Fatal()
+}
+
+// SinkConfig holds the clients and crawl request settings a Sink is created from
+type SinkConfig struct {
+	Index           string
+	Engine          string
+	ElasticClient   *elasticsearch.Client
+	AppsearchClient *AppsearchClient
+	Bulk            BulkOptions
+	Mapping         string
+	MappingsDir     string
+	LanguageIndices bool
+	Rebuild         bool
+	Retain          int
+	Retry           RetryPolicy
+	Log             *logrus.Logger
+}
+
+// SinkFactory creates a Sink, returning an error if the config is missing settings the sink requires
+type SinkFactory func(cfg SinkConfig) (Sink, error)
+
+var (
+	sinksMu sync.RWMutex
+	sinks   = make(map[string]SinkFactory)
+)
+
+// RegisterSink makes a sink available to crawl requests under the given type name
+func RegisterSink(name string, f SinkFactory) {
+	sinksMu.Lock()
+	defer sinksMu.Unlock()
+
+	if _, dup := sinks[name]; dup {
+		panic(fmt.Sprintf("sink %s is already registered", name))
+	}
+	sinks[name] = f
+}
+
+// SinkTypes returns the sorted names of every registered sink
+func SinkTypes() []string {
+	sinksMu.RLock()
+	defer sinksMu.RUnlock()
+
+	names := make([]string, 0, len(sinks))
+	for name := range sinks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// NewSink creates the sink registered under the given type name
+func NewSink(name string, cfg SinkConfig) (Sink, error) {
+	sinksMu.RLock()
+	f, ok := sinks[name]
+	sinksMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("Crawl type of: %s is not supported. Must be one of '%s'", name, strings.Join(SinkTypes(), "', '"))
+	}
+
+	return f(cfg)
+}
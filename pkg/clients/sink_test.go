@@ -0,0 +1,246 @@
+package clients
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSinkTypes(t *testing.T) {
+	if diff := cmp.Diff([]string{"app-search", "elasticsearch"}, SinkTypes()); diff != "" {
+		t.Fatalf(diff)
+	}
+}
+
+func TestRenderedPageFields(t *testing.T) {
+	page := RenderedPage{URI: "https://www.example.com", Fields: map[string]interface{}{"price": "10", "tags": []string{"a", "b"}}}
+
+	for name, doc := range map[string]interface{}{"elasticsearch": page, "app-search": NewAppsearchDocument(page)} {
+		body, err := json.Marshal(doc)
+		if err != nil {
+			t.Fatalf("Unexpected error marshalling the %s document: %s", name, err)
+		}
+
+		var got map[string]interface{}
+		if err := json.Unmarshal(body, &got); err != nil {
+			t.Fatalf("Unexpected error unmarshalling the %s document: %s", name, err)
+		}
+		if got["uri"] != page.URI || got["price"] != "10" || len(got["tags"].([]interface{})) != 2 {
+			t.Fatalf("the extracted fields should be written alongside the %s document's fields: %s", name, body)
+		}
+	}
+}
+
+func TestRenderedPageStructured(t *testing.T) {
+	page := RenderedPage{URI: "https://www.example.com", Structured: map[string]interface{}{
+		"article": map[string]interface{}{"published_time": "2020-01-20", "tag": []string{"go", "crawling"}},
+		"schema": map[string]interface{}{
+			"type":        []string{"BreadcrumbList"},
+			"breadcrumbs": []map[string]string{{"name": "Home", "url": "/"}, {"name": "Docs", "url": "/docs"}},
+		},
+	}, Images: []Image{{Src: "https://www.example.com/a.png", Alt: "A", Width: 10}, {Src: "https://www.example.com/b.png"}}}
+
+	tests := map[string]struct {
+		doc  interface{}
+		want map[string]interface{}
+	}{
+		"elasticsearch": {doc: page, want: map[string]interface{}{
+			"images": []interface{}{
+				map[string]interface{}{"src": "https://www.example.com/a.png", "alt": "A", "title": "", "caption": "", "width": float64(10), "height": float64(0)},
+				map[string]interface{}{"src": "https://www.example.com/b.png", "alt": "", "title": "", "caption": "", "width": float64(0), "height": float64(0)},
+			},
+			"article": map[string]interface{}{"published_time": "2020-01-20", "tag": []interface{}{"go", "crawling"}},
+			"schema": map[string]interface{}{
+				"type": []interface{}{"BreadcrumbList"},
+				"breadcrumbs": []interface{}{
+					map[string]interface{}{"name": "Home", "url": "/"},
+					map[string]interface{}{"name": "Docs", "url": "/docs"},
+				},
+			},
+		}},
+		"app-search": {doc: NewAppsearchDocument(page), want: map[string]interface{}{
+			"article_published_time":  "2020-01-20",
+			"article_tag":             []interface{}{"go", "crawling"},
+			"schema_type":             []interface{}{"BreadcrumbList"},
+			"schema_breadcrumbs_name": []interface{}{"Home", "Docs"},
+			"schema_breadcrumbs_url":  []interface{}{"/", "/docs"},
+			"images_src":              []interface{}{"https://www.example.com/a.png", "https://www.example.com/b.png"},
+			"images_alt":              []interface{}{"A", ""},
+			"images_width":            []interface{}{float64(10), float64(0)},
+		}},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			body, err := json.Marshal(tc.doc)
+			if err != nil {
+				t.Fatalf("Unexpected error marshalling the document: %s", err)
+			}
+
+			var got map[string]interface{}
+			if err := json.Unmarshal(body, &got); err != nil {
+				t.Fatalf("Unexpected error unmarshalling the document: %s", err)
+			}
+			for key, want := range tc.want {
+				if diff := cmp.Diff(want, got[key]); diff != "" {
+					t.Fatalf("%s: %s", key, diff)
+				}
+			}
+		})
+	}
+}
+
+func TestNewSink(t *testing.T) {
+	tests := map[string]struct {
+		name   string
+		cfg    SinkConfig
+		errMsg string
+	}{
+		"elasticsearch":      {name: "elasticsearch", cfg: SinkConfig{Index: "test"}},
+		"app-search":         {name: "app-search", cfg: SinkConfig{Engine: "test"}},
+		"missing-index":      {name: "elasticsearch", cfg: SinkConfig{Engine: "test"}, errMsg: "Crawl type of 'elasticsearch' requires an 'index' in the request."},
+		"missing-engine":     {name: "app-search", cfg: SinkConfig{Index: "test"}, errMsg: "Crawl type of 'app-search' requires an 'engine' in the request."},
+		"mapping":            {name: "elasticsearch", cfg: SinkConfig{Index: "test", Mapping: "cjk", MappingsDir: "../../conf/mappings"}},
+		"unknown-mapping":    {name: "elasticsearch", cfg: SinkConfig{Index: "test", Mapping: "french", MappingsDir: "../../conf/mappings"}, errMsg: "Mapping: french is not supported. Must be one of 'autocomplete', 'cjk', 'english'"},
+		"app-search-mapping": {name: "app-search", cfg: SinkConfig{Engine: "test", Mapping: "english"}, errMsg: "Crawl type of 'app-search' doesn't support a 'mapping' or 'language_indices', engines are configured in App Search."},
+		"unknown":            {name: "test", cfg: SinkConfig{Index: "test"}, errMsg: "Crawl type of: test is not supported. Must be one of 'app-search', 'elasticsearch'"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			sink, err := NewSink(tc.name, tc.cfg)
+
+			var errMsg string
+			if err != nil {
+				errMsg = err.Error()
+			}
+			if diff := cmp.Diff(tc.errMsg, errMsg); diff != "" {
+				t.Fatalf(diff)
+			}
+			if err == nil && sink == nil {
+				t.Fatal("sink should not be nil")
+			}
+		})
+	}
+}
+
+func TestRegisterSinkDuplicate(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("registering a sink twice should panic")
+		}
+	}()
+	RegisterSink("elasticsearch", newElasticSink)
+}
+
+func TestAppsearchSinkBatches(t *testing.T) {
+	var batches [][]AppsearchDocument
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/as/v1/engines/test/documents" || r.Header.Get("Authorization") != "Bearer "+"private-token" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		var docs []AppsearchDocument
+		json.NewDecoder(r.Body).Decode(&docs)
+		batches = append(batches, docs)
+
+		// Reject the first document of every batch
+		var results []appsearchDocumentResult
+		for i, d := range docs {
+			res := appsearchDocumentResult{ID: d.ID, Errors: []string{}}
+			if i == 0 {
+				res.Errors = []string{"Invalid field type: id must be a string"}
+			}
+			results = append(results, res)
+		}
+		json.NewEncoder(w).Encode(results)
+	}))
+	defer srv.Close()
+
+	sink, err := NewSink("app-search", SinkConfig{Engine: "test", AppsearchClient: CreateAppsearchClient(srv.URL, "private-token", "/api/as/v1/")})
+	if err != nil {
+		t.Fatalf("Unexpected error creating sink: %s", err)
+	}
+
+	var got BatchResult
+	sink.(Reporter).SetReport(func(r BatchResult) {
+		got.Indexed += r.Indexed
+		got.Failed += r.Failed
+		got.Errors = append(got.Errors, r.Errors...)
+	})
+
+	page := RenderedPage{
+		URI:          "https://www.example.com",
+		Source:       map[string][]string{"h1": {"Example"}},
+		Meta:         Meta{Title: "Example", Desc: "An example", Keywords: "example", OgImage: "https://www.example.com/logo.png"},
+		LastModified: "2020-01-02",
+	}
+	if err := sink.Write(context.Background(), page); err != nil {
+		t.Fatalf("Unexpected error writing page: %s", err)
+	}
+	for i := 1; i < maxAppsearchBatch+1; i++ {
+		if err := sink.Write(context.Background(), RenderedPage{URI: fmt.Sprintf("https://www.example.com/%d", i)}); err != nil {
+			t.Fatalf("Unexpected error writing page: %s", err)
+		}
+	}
+
+	if len(batches) != 1 || len(batches[0]) != maxAppsearchBatch {
+		t.Fatalf("a full batch should be sent as soon as it is written, sent %d batches", len(batches))
+	}
+
+	if err := sink.Close(context.Background()); err != nil {
+		t.Fatalf("Unexpected error closing sink: %s", err)
+	}
+
+	if len(batches) != 2 || len(batches[1]) != 1 {
+		t.Fatalf("closing should send the remaining page, sent %d batches", len(batches))
+	}
+
+	want := AppsearchDocument{
+		ID:           DocumentID("https://www.example.com"),
+		Description:  "An example",
+		URI:          "https://www.example.com",
+		Source:       map[string][]string{"h1": {"Example"}},
+		OgImage:      "https://www.example.com/logo.png",
+		Title:        "Example",
+		Keywords:     "example",
+		LastModified: "2020-01-02",
+	}
+	if diff := cmp.Diff(want, batches[0][0]); diff != "" {
+		t.Fatalf(diff)
+	}
+
+	if got.Indexed != 99 || got.Failed != 2 || len(got.Errors) != 2 {
+		t.Fatalf("unexpected batch results: %+v", got)
+	}
+}
+
+func TestAppsearchSinkRequestError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"error":"You need to sign in or sign up before continuing."}`))
+	}))
+	defer srv.Close()
+
+	sink, err := NewSink("app-search", SinkConfig{Engine: "test", AppsearchClient: CreateAppsearchClient(srv.URL, "private-token", "/api/as/v1/")})
+	if err != nil {
+		t.Fatalf("Unexpected error creating sink: %s", err)
+	}
+
+	var got BatchResult
+	sink.(Reporter).SetReport(func(r BatchResult) { got = r })
+	sink.Write(context.Background(), RenderedPage{URI: "https://www.example.com"})
+
+	if err := sink.Close(context.Background()); err == nil {
+		t.Fatal("expected an error closing the sink")
+	}
+	if got.Failed != 1 {
+		t.Fatalf("failed - expected : 1, received : %d", got.Failed)
+	}
+}
@@ -0,0 +1,261 @@
+package clients
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+)
+
+// DefaultStateIndex is the Elasticsearch index crawl state is kept in when the configuration doesn't say
+const DefaultStateIndex = "webcrawler-state"
+
+// stateBatch is how many page states are loaded or saved per request
+const stateBatch = 500
+
+// stateMapping is the mapping the crawl state index is created with. Nothing in it is searched
+// except the crawl target and site, so the other fields aren't indexed.
+var stateMapping = []byte(`{
+  "mappings": {
+    "properties": {
+      "target": {"type": "keyword"},
+      "site": {"type": "keyword"},
+      "uri": {"type": "keyword", "index": false},
+      "document_id": {"type": "keyword", "index": false},
+      "etag": {"type": "keyword", "index": false},
+      "last_modified": {"type": "keyword", "index": false},
+      "content_hash": {"type": "keyword", "index": false},
+      "links": {"type": "keyword", "index": false},
+      "updated": {"type": "date"}
+    }
+  }
+}`)
+
+// PageState represents what a crawl recorded about a page to fetch it conditionally next time
+type PageState struct {
+	// Target names the sink and index or engine the page was written to, as pages are only
+	// unchanged relative to a destination that already holds them
+	Target string `json:"target"`
+	Site   string `json:"site"`
+	URI    string `json:"uri"`
+	// DocumentID is the ID of the document the page was written to, which differs from the ID of
+	// its URI when the page is a duplicate or declares another canonical URL
+	DocumentID   string   `json:"document_id,omitempty"`
+	ETag         string   `json:"etag,omitempty"`
+	LastModified string   `json:"last_modified,omitempty"`
+	ContentHash  string   `json:"content_hash,omitempty"`
+	Links        []string `json:"links,omitempty"`
+	Updated      string   `json:"updated"`
+}
+
+// StateStore persists the state of crawled pages between crawls
+type StateStore interface {
+	// Load returns the states of the pages of the site last written to the target, keyed by URI
+	Load(ctx context.Context, target, site string) (map[string]PageState, error)
+	// Save creates or replaces the states
+	Save(ctx context.Context, states []PageState) error
+	// Delete removes the states of the pages of the site written to the target updated before the time
+	Delete(ctx context.Context, target, site string, before time.Time) error
+}
+
+// ElasticStateStore keeps crawl state in an Elasticsearch index, one document per target and page
+type ElasticStateStore struct {
+	Client *elasticsearch.Client
+	Index  string
+
+	mu      sync.Mutex
+	created bool
+}
+
+// NewElasticStateStore returns a store keeping crawl state in the index, or DefaultStateIndex if it is empty
+func NewElasticStateStore(elasticClient *elasticsearch.Client, index string) *ElasticStateStore {
+	if index == "" {
+		index = DefaultStateIndex
+	}
+	return &ElasticStateStore{Client: elasticClient, Index: index}
+}
+
+// ensure creates the state index the first time the store is used
+func (s *ElasticStateStore) ensure(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.created {
+		return nil
+	}
+	if _, err := createIndex(ctx, s.Client, s.Index, &Mapping{Name: "crawl-state", Body: stateMapping}); err != nil {
+		return err
+	}
+	s.created = true
+
+	return nil
+}
+
+// stateQuery returns the Elasticsearch query matching the states of the site's pages written to the
+// target, with any extra filters
+func stateQuery(target, site string, filters ...interface{}) map[string]interface{} {
+	filters = append([]interface{}{
+		map[string]interface{}{"term": map[string]string{"target": target}},
+		map[string]interface{}{"term": map[string]string{"site": site}},
+	}, filters...)
+
+	return map[string]interface{}{"bool": map[string]interface{}{"filter": filters}}
+}
+
+// Load scrolls through the states of the site's pages written to the target
+func (s *ElasticStateStore) Load(ctx context.Context, target, site string) (map[string]PageState, error) {
+	if err := s.ensure(ctx); err != nil {
+		return nil, err
+	}
+
+	body, err := json.Marshal(map[string]interface{}{"query": stateQuery(target, site)})
+	if err != nil {
+		return nil, err
+	}
+
+	size := stateBatch
+	req := esapi.SearchRequest{
+		Index:  []string{s.Index},
+		Body:   bytes.NewReader(body),
+		Size:   &size,
+		Scroll: time.Minute,
+	}
+	res, err := req.Do(ctx, s.Client)
+
+	states := make(map[string]PageState)
+	var scrollID string
+	defer func() {
+		if scrollID == "" {
+			return
+		}
+		if res, err := (esapi.ClearScrollRequest{ScrollID: []string{scrollID}}).Do(ctx, s.Client); err == nil {
+			res.Body.Close()
+		}
+	}()
+
+	for {
+		if err != nil {
+			return nil, fmt.Errorf("Error loading crawl state of %s: %s", site, err)
+		}
+
+		var page []PageState
+		if scrollID, page, err = decodeStatePage(res, site); err != nil {
+			return nil, err
+		}
+		for _, state := range page {
+			states[state.URI] = state
+		}
+		if len(page) < stateBatch {
+			return states, nil
+		}
+
+		res, err = esapi.ScrollRequest{ScrollID: scrollID, Scroll: time.Minute}.Do(ctx, s.Client)
+	}
+}
+
+// decodeStatePage reads a page of scrolled search results and closes the response
+func decodeStatePage(res *esapi.Response, site string) (scrollID string, states []PageState, err error) {
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return "", nil, &StatusError{StatusCode: res.StatusCode, Msg: fmt.Sprintf("[%s] Error loading crawl state of %s, err=%s", res.Status(), site, res.String())}
+	}
+
+	var r struct {
+		ScrollID string `json:"_scroll_id"`
+		Hits     struct {
+			Hits []struct {
+				Source PageState `json:"_source"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return "", nil, fmt.Errorf("Error deserializing the crawl state of %s: %s", site, err)
+	}
+
+	for _, hit := range r.Hits.Hits {
+		states = append(states, hit.Source)
+	}
+
+	return r.ScrollID, states, nil
+}
+
+// Save indexes the states with the _bulk API, failing if any of them is rejected
+func (s *ElasticStateStore) Save(ctx context.Context, states []PageState) error {
+	if err := s.ensure(ctx); err != nil {
+		return err
+	}
+
+	for i := 0; i < len(states); i += stateBatch {
+		end := i + stateBatch
+		if end > len(states) {
+			end = len(states)
+		}
+
+		var body bytes.Buffer
+		for _, state := range states[i:end] {
+			action, err := json.Marshal(map[string]interface{}{
+				"index": map[string]string{"_index": s.Index, "_id": DocumentID(state.Target + " " + state.URI)},
+			})
+			if err != nil {
+				return err
+			}
+			doc, err := json.Marshal(state)
+			if err != nil {
+				return err
+			}
+			body.Write(action)
+			body.WriteByte('\n')
+			body.Write(doc)
+			body.WriteByte('\n')
+		}
+
+		result, err := bulkIndex(ctx, s.Client, body.Bytes())
+		if err != nil {
+			return err
+		}
+		if result.Failed > 0 {
+			return fmt.Errorf("Error saving the crawl state of %d pages: %v", result.Failed, result.Errors[0])
+		}
+	}
+
+	return nil
+}
+
+// Delete removes the states with _delete_by_query
+func (s *ElasticStateStore) Delete(ctx context.Context, target, site string, before time.Time) error {
+	if err := s.ensure(ctx); err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(map[string]interface{}{"query": stateQuery(target, site,
+		map[string]interface{}{"range": map[string]interface{}{
+			"updated": map[string]string{"lt": before.UTC().Format(LastSeenLayout)},
+		}},
+	)})
+	if err != nil {
+		return err
+	}
+
+	req := esapi.DeleteByQueryRequest{
+		Index:     []string{s.Index},
+		Body:      bytes.NewReader(body),
+		Conflicts: "proceed",
+	}
+	res, err := req.Do(ctx, s.Client)
+	if err != nil {
+		return fmt.Errorf("Error deleting the stale crawl state of %s: %s", site, err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return &StatusError{StatusCode: res.StatusCode, Msg: fmt.Sprintf("[%s] Error deleting the stale crawl state of %s, err=%s", res.Status(), site, res.String())}
+	}
+
+	return nil
+}
@@ -0,0 +1,103 @@
+package clients
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestElasticStateStore(t *testing.T) {
+	var (
+		created  int
+		docs     []string
+		cleared  bool
+		deletion string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == http.MethodPut && r.URL.Path == "/state":
+			created++
+			fmt.Fprint(w, `{"acknowledged":true}`)
+		case r.URL.Path == "/_bulk":
+			var items []string
+			scanner := bufio.NewScanner(r.Body)
+			for n := 0; scanner.Scan(); n++ {
+				if n%2 == 0 {
+					continue
+				}
+				docs = append(docs, scanner.Text())
+				items = append(items, `{"index":{"status":201}}`)
+			}
+			fmt.Fprintf(w, `{"errors":false,"items":[%s]}`, strings.Join(items, ","))
+		case r.URL.Path == "/state/_search":
+			var hits []string
+			for _, doc := range docs {
+				hits = append(hits, `{"_source":`+doc+`}`)
+			}
+			fmt.Fprintf(w, `{"_scroll_id":"scroll-1","hits":{"hits":[%s]}}`, strings.Join(hits, ","))
+		case r.Method == http.MethodDelete && r.URL.Path == "/_search/scroll/scroll-1":
+			cleared = true
+			fmt.Fprint(w, `{"succeeded":true}`)
+		case r.URL.Path == "/state/_delete_by_query":
+			body, _ := ioutil.ReadAll(r.Body)
+			deletion = string(body)
+			fmt.Fprint(w, `{"deleted":1}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	client, err := CreateElasticClient(GenerateElasticConfig([]string{srv.URL}, username, password))
+	if err != nil {
+		t.Fatalf("Unexpected error creating Elasticsearch client: %s", err)
+	}
+	store := NewElasticStateStore(client, "state")
+
+	states := []PageState{
+		{Target: "elasticsearch/test", Site: "www.example.com", URI: "https://www.example.com/", ETag: `"abc"`, ContentHash: "01", Links: []string{"https://www.example.com/a"}, Updated: "2020-01-20T16:04:05.000Z"},
+		{Target: "elasticsearch/test", Site: "www.example.com", URI: "https://www.example.com/a", LastModified: "Mon, 20 Jan 2020 16:04:05 GMT", ContentHash: "02", Updated: "2020-01-20T16:04:05.000Z"},
+	}
+	if err := store.Save(context.Background(), states); err != nil {
+		t.Fatalf("Unexpected error saving states: %s", err)
+	}
+
+	loaded, err := store.Load(context.Background(), "elasticsearch/test", "www.example.com")
+	if err != nil {
+		t.Fatalf("Unexpected error loading states: %s", err)
+	}
+	want := map[string]PageState{states[0].URI: states[0], states[1].URI: states[1]}
+	if diff := cmp.Diff(want, loaded); diff != "" {
+		t.Fatalf(diff)
+	}
+	if !cleared {
+		t.Fatalf("the scroll should be cleared once the states are loaded")
+	}
+
+	if err := store.Delete(context.Background(), "elasticsearch/test", "www.example.com", pruneBefore); err != nil {
+		t.Fatalf("Unexpected error deleting states: %s", err)
+	}
+	var query struct {
+		Query struct {
+			Bool struct {
+				Filter []map[string]json.RawMessage `json:"filter"`
+			} `json:"bool"`
+		} `json:"query"`
+	}
+	if err := json.Unmarshal([]byte(deletion), &query); err != nil || len(query.Query.Bool.Filter) != 3 || !strings.Contains(deletion, `"lt":"2020-01-20T16:04:05.000Z"`) {
+		t.Fatalf("the deletion should match the target's states of the site updated before the time: %s", deletion)
+	}
+
+	if created != 1 {
+		t.Fatalf("the state index should be created once: %d", created)
+	}
+}
@@ -0,0 +1,243 @@
+package clients
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+)
+
+// updateIDs returns the IDs of the documents to update, sorted so batches are reproducible
+func updateIDs(updates map[string]map[string]interface{}) []string {
+	ids := make([]string, 0, len(updates))
+	for id := range updates {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Update sets the fields of the documents with partial updates sent with the _bulk API, then
+// refreshes the indices updated once so they are searchable. Documents the sink didn't write during this crawl, such as
+// the unchanged pages of an incremental crawl, are updated in every index the crawl wrote to.
+func (s *ElasticSink) Update(ctx context.Context, updates map[string]map[string]interface{}) (result BatchResult, err error) {
+	s.mu.Lock()
+	indices := make(map[string]string, len(updates))
+	for id := range updates {
+		if index, ok := s.indices[id]; ok {
+			indices[id] = index
+		}
+	}
+	fallback := map[string]bool{s.physical(s.Index): true}
+	for index := range s.written {
+		fallback[index] = true
+	}
+	s.mu.Unlock()
+
+	var all []string
+	for index := range fallback {
+		all = append(all, index)
+	}
+	sort.Strings(all)
+
+	var (
+		buf     bytes.Buffer
+		pending int
+		updated = make(map[string]bool)
+	)
+	send := func() error {
+		if pending == 0 {
+			return nil
+		}
+		body := make([]byte, buf.Len())
+		copy(body, buf.Bytes())
+		buf.Reset()
+
+		var batch BatchResult
+		notify := retryNotifier(s.Log, s.Retry, fmt.Sprintf("bulk update of %d documents", pending))
+		pending = 0
+		retries, err := s.Retry.Do(ctx, func() (err error) {
+			batch, err = bulkUpdate(ctx, s.Client, body)
+			return err
+		}, notify)
+		result.Retries += retries
+		if err != nil {
+			if retries > 0 {
+				result.GaveUp++
+			}
+			return giveUpError(retries, err)
+		}
+
+		result.Indexed += batch.Indexed
+		result.Failed += batch.Failed
+		result.FailedIDs = append(result.FailedIDs, batch.FailedIDs...)
+		result.Errors = append(result.Errors, batch.Errors...)
+		return nil
+	}
+
+	for _, id := range updateIDs(updates) {
+		targets := all
+		if index, ok := indices[id]; ok {
+			targets = []string{index}
+		}
+
+		doc, err := json.Marshal(map[string]interface{}{"doc": updates[id]})
+		if err != nil {
+			return result, err
+		}
+		for _, index := range targets {
+			action, err := json.Marshal(map[string]interface{}{
+				"update": map[string]string{"_index": index, "_id": id},
+			})
+			if err != nil {
+				return result, err
+			}
+			buf.Write(action)
+			buf.WriteByte('\n')
+			buf.Write(doc)
+			buf.WriteByte('\n')
+			pending++
+			updated[index] = true
+		}
+
+		if pending >= s.Options.FlushDocs || buf.Len() >= s.Options.FlushBytes {
+			if err := send(); err != nil {
+				return result, err
+			}
+		}
+	}
+
+	if err := send(); err != nil {
+		return result, err
+	}
+	if len(updated) == 0 {
+		return result, nil
+	}
+
+	targets := make([]string, 0, len(updated))
+	for index := range updated {
+		targets = append(targets, index)
+	}
+	sort.Strings(targets)
+
+	return result, refreshIndices(ctx, s.Client, targets)
+}
+
+// bulkUpdate sends the NDJSON body of update actions to the _bulk API, skipping the documents an
+// index doesn't hold and collecting the errors of the others that failed
+func bulkUpdate(ctx context.Context, elasticClient *elasticsearch.Client, body []byte) (result BatchResult, err error) {
+	req := esapi.BulkRequest{
+		Body: bytes.NewReader(body),
+	}
+
+	res, err := req.Do(ctx, elasticClient)
+	if err != nil {
+		return result, fmt.Errorf("Error getting bulk response: %s", err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return result, &StatusError{StatusCode: res.StatusCode, Msg: fmt.Sprintf("[%s] Error updating documents in bulk, err=%s", res.Status(), res.String())}
+	}
+
+	var r bulkResponse
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return result, fmt.Errorf("Error deserializing the bulk response object: %s", err)
+	}
+
+	for _, item := range r.Items {
+		for _, op := range item {
+			switch {
+			case op.Error == nil && op.Status < 300:
+				result.Indexed++
+			case op.Status == http.StatusNotFound:
+			default:
+				result.Failed++
+				result.FailedIDs = append(result.FailedIDs, op.ID)
+				if op.Error != nil {
+					result.Errors = append(result.Errors, fmt.Errorf("[%d] Error updating document ID=%s, err=%s: %s", op.Status, op.ID, op.Error.Type, op.Error.Reason))
+				} else {
+					result.Errors = append(result.Errors, fmt.Errorf("[%d] Error updating document ID=%s", op.Status, op.ID))
+				}
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// UpdateDocuments sets the fields of up to 100 documents in the engine, each holding its "id". App
+// Search only updates fields already in the engine's schema. Documents it rejects are reported as
+// *AppsearchError values in the result, while an error is returned if the request failed.
+func (ac *AppsearchClient) UpdateDocuments(ctx context.Context, engine string, docs []map[string]interface{}) (result BatchResult, err error) {
+	resp, err := ac.appsearchRequest(ctx, http.MethodPatch, engine, "", docs)
+	if err != nil {
+		return result, err
+	}
+	defer resp.Body.Close()
+
+	var results []appsearchDocumentResult
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		return result, fmt.Errorf("Error deserializing the App Search response object: %s", err)
+	}
+
+	for _, r := range results {
+		if len(r.Errors) == 0 {
+			result.Indexed++
+			continue
+		}
+		result.Failed++
+		result.FailedIDs = append(result.FailedIDs, r.ID)
+		result.Errors = append(result.Errors, &AppsearchError{Kind: ErrAppsearchValidation, DocumentID: r.ID, Messages: r.Errors})
+	}
+
+	return result, nil
+}
+
+// Update sets the fields of the documents in batches of partial updates, flattening nested fields
+// like the documents written to the engine
+func (s *AppsearchSink) Update(ctx context.Context, updates map[string]map[string]interface{}) (result BatchResult, err error) {
+	ids := updateIDs(updates)
+	for start := 0; start < len(ids); start += maxAppsearchBatch {
+		end := start + maxAppsearchBatch
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		docs := make([]map[string]interface{}, 0, end-start)
+		for _, id := range ids[start:end] {
+			doc := flattenFields(updates[id])
+			if doc == nil {
+				doc = make(map[string]interface{})
+			}
+			doc["id"] = id
+			docs = append(docs, doc)
+		}
+
+		var batch BatchResult
+		notify := retryNotifier(s.Log, s.Retry, fmt.Sprintf("update of %d documents in engine %s", len(docs), s.Engine))
+		retries, err := s.Retry.Do(ctx, func() (err error) {
+			batch, err = s.Client.UpdateDocuments(ctx, s.Engine, docs)
+			return err
+		}, notify)
+		result.Retries += retries
+		if err != nil {
+			if retries > 0 {
+				result.GaveUp++
+			}
+			return result, giveUpError(retries, err)
+		}
+
+		result.Indexed += batch.Indexed
+		result.Failed += batch.Failed
+		result.FailedIDs = append(result.FailedIDs, batch.FailedIDs...)
+		result.Errors = append(result.Errors, batch.Errors...)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,146 @@
+package clients
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestElasticSinkUpdate(t *testing.T) {
+	var actions, refreshed []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == http.MethodHead:
+			w.WriteHeader(http.StatusNotFound)
+		case strings.HasSuffix(r.URL.Path, "/_refresh"):
+			refreshed = append(refreshed, r.URL.Path)
+			fmt.Fprint(w, `{}`)
+		case r.URL.Path == "/_bulk":
+			if r.URL.Query().Get("refresh") != "" {
+				t.Errorf("bulk requests shouldn't refresh: %s", r.URL)
+			}
+			body, _ := ioutil.ReadAll(r.Body)
+			lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+
+			var items []string
+			for i := 0; i < len(lines); i += 2 {
+				actions = append(actions, lines[i]+" "+lines[i+1])
+				var action map[string]map[string]string
+				json.Unmarshal([]byte(lines[i]), &action)
+				for op, meta := range action {
+					// Only the test index holds the unwritten document
+					status := 200
+					if op == "update" && meta["_id"] == "unwritten" && meta["_index"] != "test" {
+						status = 404
+					}
+					items = append(items, fmt.Sprintf(`{%q:{"_id":%q,"status":%d}}`, op, meta["_id"], status))
+				}
+			}
+			fmt.Fprintf(w, `{"items":[%s]}`, strings.Join(items, ","))
+		default:
+			fmt.Fprint(w, `{}`)
+		}
+	}))
+	defer srv.Close()
+
+	client, err := CreateElasticClient(GenerateElasticConfig([]string{srv.URL}, username, password))
+	if err != nil {
+		t.Fatalf("Unexpected error creating Elasticsearch client: %s", err)
+	}
+	sink, err := NewSink("elasticsearch", SinkConfig{Index: "test", ElasticClient: client, LanguageIndices: true, MappingsDir: "../../conf/mappings", Bulk: BulkOptions{FlushDocs: 1}})
+	if err != nil {
+		t.Fatalf("Unexpected error creating sink: %s", err)
+	}
+
+	ctx := context.Background()
+	if err := sink.Write(ctx, RenderedPage{ID: "en", URI: "https://www.example.com/en", Language: "en"}); err != nil {
+		t.Fatalf("Unexpected error writing: %s", err)
+	}
+	if err := sink.Close(ctx); err != nil {
+		t.Fatalf("Unexpected error closing: %s", err)
+	}
+	actions, refreshed = nil, nil
+
+	result, err := sink.(Updater).Update(ctx, map[string]map[string]interface{}{
+		"en":        {"inlinks": 2},
+		"unwritten": {"inlinks": 1},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error updating: %s", err)
+	}
+
+	// The written page is updated in its language index, the other in every index the crawl wrote to
+	want := []string{
+		`{"update":{"_id":"en","_index":"test-en"}} {"doc":{"inlinks":2}}`,
+		`{"update":{"_id":"unwritten","_index":"test"}} {"doc":{"inlinks":1}}`,
+		`{"update":{"_id":"unwritten","_index":"test-en"}} {"doc":{"inlinks":1}}`,
+	}
+	if diff := cmp.Diff(want, actions); diff != "" {
+		t.Fatalf(diff)
+	}
+	if result.Indexed != 2 || result.Failed != 0 {
+		t.Fatalf("both documents should be updated once: %+v", result)
+	}
+	// Every update is sent in its own batch, but the indices are refreshed once
+	if diff := cmp.Diff([]string{"/test,test-en/_refresh"}, refreshed); diff != "" {
+		t.Fatalf(diff)
+	}
+}
+
+func TestAppsearchSinkUpdate(t *testing.T) {
+	var patched []map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != http.MethodPatch || r.URL.Path != "/api/as/v1/engines/test/documents" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		var docs []map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&docs)
+		patched = append(patched, docs...)
+
+		var results []string
+		for _, doc := range docs {
+			errors := "[]"
+			if doc["id"] == "missing" {
+				errors = `["Document not found"]`
+			}
+			results = append(results, fmt.Sprintf(`{"id":%q,"errors":%s}`, doc["id"], errors))
+		}
+		fmt.Fprintf(w, "[%s]", strings.Join(results, ","))
+	}))
+	defer srv.Close()
+
+	sink, err := NewSink("app-search", SinkConfig{Engine: "test", AppsearchClient: CreateAppsearchClient(srv.URL, "private-token", "/api/as/v1/")})
+	if err != nil {
+		t.Fatalf("Unexpected error creating sink: %s", err)
+	}
+
+	result, err := sink.(Updater).Update(context.Background(), map[string]map[string]interface{}{
+		"1":       {"inlinks": 2, "anchor_text": []string{"home"}},
+		"missing": {"inlinks": 0},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error updating: %s", err)
+	}
+
+	want := []map[string]interface{}{
+		{"id": "1", "inlinks": float64(2), "anchor_text": []interface{}{"home"}},
+		{"id": "missing", "inlinks": float64(0)},
+	}
+	if diff := cmp.Diff(want, patched); diff != "" {
+		t.Fatalf(diff)
+	}
+	if result.Indexed != 1 || result.Failed != 1 || len(result.Errors) != 1 {
+		t.Fatalf("the missing document should be reported: %+v", result)
+	}
+}
@@ -0,0 +1,153 @@
+package crawler
+
+import (
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/gocolly/colly"
+)
+
+// DefaultTrackingParams are the query parameters stripped from links when neither the crawl request
+// nor the configuration lists them. A trailing * matches any parameter with that prefix.
+var DefaultTrackingParams = []string{"utm_*", "gclid", "dclid", "fbclid", "msclkid", "yclid", "mc_cid", "mc_eid", "_ga", "_hsenc", "_hsmi"}
+
+// canonicalizer normalises the URLs of a crawl so variants of the same page share one document
+type canonicalizer struct {
+	// scheme is the scheme of the crawl's start URL, which pages on its host are stored under
+	scheme string
+	host   string
+	params []string
+}
+
+// newCanonicalizer returns the canonicalizer of a crawl starting at the URL, stripping the tracking
+// parameters, or DefaultTrackingParams if they are nil
+func newCanonicalizer(start string, params []string) *canonicalizer {
+	if params == nil {
+		params = DefaultTrackingParams
+	}
+
+	c := &canonicalizer{params: params}
+	if u, err := url.Parse(c.fetchURL(start)); err == nil {
+		c.scheme = strings.ToLower(u.Scheme)
+		c.host = strings.ToLower(u.Host)
+	}
+
+	return c
+}
+
+// tracking reports whether the query parameter is a tracking parameter
+func (c *canonicalizer) tracking(param string) bool {
+	param = strings.ToLower(param)
+	for _, p := range c.params {
+		p = strings.ToLower(p)
+		if strings.HasSuffix(p, "*") && strings.HasPrefix(param, strings.TrimSuffix(p, "*")) || param == p {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchURL returns the link as it is fetched, without its fragment and tracking parameters and with
+// its scheme, host and port normalised. Links that aren't http or https are returned as they are.
+func (c *canonicalizer) fetchURL(link string) string {
+	u, err := url.Parse(link)
+	if err != nil {
+		return link
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return link
+	}
+
+	host, port := strings.ToLower(u.Hostname()), u.Port()
+	if u.Scheme == "http" && port == "80" || u.Scheme == "https" && port == "443" {
+		port = ""
+	}
+	u.Host = host
+	if port != "" {
+		u.Host += ":" + port
+	}
+	u.Fragment = ""
+	if u.Path == "" && u.Opaque == "" {
+		u.Path = "/"
+	}
+
+	if u.RawQuery != "" {
+		query := u.Query()
+		for param := range query {
+			if c.tracking(param) {
+				query.Del(param)
+			}
+		}
+		// Encode sorts the parameters by name
+		u.RawQuery = query.Encode()
+	}
+
+	return u.String()
+}
+
+// canonical returns the URL a page is stored under. On top of fetchURL it drops trailing and
+// repeated slashes from the path, and stores pages on the crawl's host under its start scheme so
+// http and https variants are one document.
+func (c *canonicalizer) canonical(link string) string {
+	u, err := url.Parse(c.fetchURL(link))
+	if err != nil || u.Scheme != "http" && u.Scheme != "https" {
+		return link
+	}
+
+	if u.Host == c.host && c.scheme != "" {
+		u.Scheme = c.scheme
+	}
+	if u.Path != "" {
+		// path.Clean also resolves dot segments and keeps the root path as "/"
+		u.Path = path.Clean(u.Path)
+		u.RawPath = ""
+	}
+
+	return u.String()
+}
+
+// pageURI returns the canonical URL of the crawled page, honouring its <link rel="canonical"> when
+// it points to the same host
+func (c *canonicalizer) pageURI(e *colly.HTMLElement) string {
+	uri := c.canonical(e.Request.URL.String())
+
+	var declared string
+	e.DOM.ParentsUntil("~").Find("link[rel][href]").EachWithBreak(func(_ int, s *goquery.Selection) bool {
+		rel, _ := s.Attr("rel")
+		for _, r := range strings.Fields(rel) {
+			if strings.EqualFold(r, "canonical") {
+				href, _ := s.Attr("href")
+				declared = e.Request.AbsoluteURL(strings.TrimSpace(href))
+				return false
+			}
+		}
+		return true
+	})
+	if declared == "" {
+		return uri
+	}
+
+	declared = c.canonical(declared)
+	d, err := url.Parse(declared)
+	if err != nil || !strings.EqualFold(d.Hostname(), e.Request.URL.Hostname()) {
+		return uri
+	}
+
+	return declared
+}
+
+// addAlias adds the URL to the sorted aliases unless it is already there
+func addAlias(aliases []string, alias string) []string {
+	i := sort.SearchStrings(aliases, alias)
+	if i < len(aliases) && aliases[i] == alias {
+		return aliases
+	}
+	aliases = append(aliases, "")
+	copy(aliases[i+1:], aliases[i:])
+	aliases[i] = alias
+	return aliases
+}
@@ -0,0 +1,119 @@
+package crawler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/sirupsen/logrus"
+	"github.com/wambozi/elastic-webcrawler/m/pkg/clients"
+)
+
+func TestCanonicalizer(t *testing.T) {
+	c := newCanonicalizer("https://www.example.com/", nil)
+
+	tests := map[string]struct {
+		fetch     string
+		canonical string
+	}{
+		"https://www.example.com/docs":                              {fetch: "https://www.example.com/docs", canonical: "https://www.example.com/docs"},
+		"HTTPS://WWW.Example.com:443/docs/#intro":                   {fetch: "https://www.example.com/docs/", canonical: "https://www.example.com/docs"},
+		"https://www.example.com/docs?utm_source=x&b=2&a=1&gclid=y": {fetch: "https://www.example.com/docs?a=1&b=2", canonical: "https://www.example.com/docs?a=1&b=2"},
+		"http://www.example.com:80//docs//intro/":                   {fetch: "http://www.example.com//docs//intro/", canonical: "https://www.example.com/docs/intro"},
+		"https://www.example.com":                                   {fetch: "https://www.example.com/", canonical: "https://www.example.com/"},
+		"http://other.example.com/docs/":                            {fetch: "http://other.example.com/docs/", canonical: "http://other.example.com/docs"},
+		"mailto:team@example.com":                                   {fetch: "mailto:team@example.com", canonical: "mailto:team@example.com"},
+	}
+
+	for link, want := range tests {
+		t.Run(link, func(t *testing.T) {
+			if got := c.fetchURL(link); got != want.fetch {
+				t.Fatalf("fetch URL - expected : %s, received : %s", want.fetch, got)
+			}
+			if got := c.canonical(link); got != want.canonical {
+				t.Fatalf("canonical URL - expected : %s, received : %s", want.canonical, got)
+			}
+		})
+	}
+}
+
+func TestCanonicalizerTrackingParams(t *testing.T) {
+	c := newCanonicalizer("https://www.example.com/", []string{"ref"})
+
+	if got := c.fetchURL("https://www.example.com/?ref=home&utm_source=x"); got != "https://www.example.com/?utm_source=x" {
+		t.Fatalf("only the configured tracking parameters should be stripped: %s", got)
+	}
+}
+
+// documentSink keeps the last version of every document written to it by ID
+type documentSink struct {
+	mu   sync.Mutex
+	docs map[string]RenderedPage
+}
+
+func (s *documentSink) Write(ctx context.Context, page RenderedPage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.docs[page.ID] = page
+	return nil
+}
+
+func (s *documentSink) Flush(ctx context.Context) error { return nil }
+func (s *documentSink) Close(ctx context.Context) error { return nil }
+
+func TestCrawlDedupe(t *testing.T) {
+	// /a is linked with a tracking parameter and a trailing slash, /b has the same content as /a and
+	// /c declares /d as its canonical URL
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		switch r.URL.Path {
+		case "/":
+			fmt.Fprint(w, `<html><body><p>home</p><a href="/a?utm_source=home">a</a><a href="/a">a</a><a href="/a/">a</a><a href="/b">b</a><a href="/c">c</a></body></html>`)
+		case "/a", "/a/":
+			fmt.Fprint(w, `<html><head><title>A</title></head><body><p>Same   content</p></body></html>`)
+		case "/b":
+			fmt.Fprint(w, `<html><head><title>A</title></head><body><div><p>same content</p></div></body></html>`)
+		case "/c":
+			fmt.Fprint(w, `<html><head><link rel="canonical" href="/d"></head><body><p>page c</p></body></html>`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL)
+	job, err := NewRegistry().Create(CrawlRequest{URL: srv.URL + "/", Domain: u.Host})
+	if err != nil {
+		t.Fatalf("Unexpected error creating job: %s", err)
+	}
+
+	sink := &documentSink{docs: make(map[string]RenderedPage)}
+	if err := Crawl(job.ctx, job, sink, nil, nil, logrus.New()); err != nil {
+		t.Fatalf("Unexpected error crawling: %s", err)
+	}
+
+	aliases := make(map[string][]string)
+	for id, doc := range sink.docs {
+		if id != clients.DocumentID(doc.URI) {
+			t.Fatalf("document %s should be stored under the ID of its URI %s", id, doc.URI)
+		}
+		aliases[doc.URI] = doc.Aliases
+	}
+	want := map[string][]string{
+		srv.URL + "/":  nil,
+		srv.URL + "/a": {srv.URL + "/a/", srv.URL + "/b"},
+		srv.URL + "/d": {srv.URL + "/c"},
+	}
+	if diff := cmp.Diff(want, aliases); diff != "" {
+		t.Fatalf(diff)
+	}
+
+	if stats := job.Status().Stats; stats.PagesVisited != 5 || stats.PagesDuplicate != 2 {
+		t.Fatalf("the tracking parameter variant shouldn't be fetched and the duplicates should be counted: %+v", stats)
+	}
+}
@@ -0,0 +1,213 @@
+package crawler
+
+import (
+	"math"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/PuerkitoBio/goquery"
+	"golang.org/x/net/html"
+)
+
+// MaxSummaryLength is the most characters of a page's summary
+const MaxSummaryLength = 300
+
+// minParagraphLength is the fewest characters a paragraph needs to count towards the score of the
+// block holding it
+const minParagraphLength = 25
+
+var (
+	// boilerplateTags never hold the main content of a page
+	boilerplateTags = "script, style, noscript, template, iframe, svg, canvas, form, button, select, nav, header, footer, aside, [role=navigation], [role=banner], [role=contentinfo], [role=complementary], [aria-hidden=true], [hidden]"
+
+	// unlikelyClass matches the class and id of blocks such as menus, cookie banners and footers
+	unlikelyClass = regexp.MustCompile(`(?i)banner|breadcrumb|combx|comment|community|consent|cookie|disqus|extra|foot|gdpr|header|legends|menu|modal|nav|newsletter|pager|pagination|popup|promo|related|remark|share|shoutbox|sidebar|skip|social|sponsor|subscribe|tags|toolbar|tweet|widget`)
+
+	// likelyClass matches the class and id of blocks holding the content, which outweighs unlikelyClass
+	likelyClass = regexp.MustCompile(`(?i)article|body|content|entry|hentry|main|page|post|story|text`)
+
+	// sentenceEnd matches the end of a sentence followed by whitespace
+	sentenceEnd = regexp.MustCompile(`[.!?。！？]["')\]]*\s`)
+)
+
+// mainContent finds the block of the document holding its main content, readability style. Every
+// paragraph scores the blocks holding it by its length and commas, the scores are weighed by the
+// blocks' tags, classes and link density, and the best block wins. The document is cloned so other
+// callbacks still see every element. It returns nil if the page has no paragraph long enough.
+func mainContent(doc *goquery.Selection) *goquery.Selection {
+	body := doc.Clone()
+	body.Find(boilerplateTags).Remove()
+	body.Find("*").Each(func(_ int, s *goquery.Selection) {
+		if s.Is("html, body, main, article, [role=main]") {
+			return
+		}
+		class := classAndID(s)
+		if unlikelyClass.MatchString(class) && !likelyClass.MatchString(class) {
+			s.Remove()
+		}
+	})
+
+	scores := make(map[*html.Node]float64)
+	var candidates []*goquery.Selection
+	score := func(s *goquery.Selection, points float64) {
+		if len(s.Nodes) == 0 || s.Is("html") {
+			return
+		}
+		n := s.Nodes[0]
+		if _, ok := scores[n]; !ok {
+			scores[n] = blockWeight(s)
+			candidates = append(candidates, s)
+		}
+		scores[n] += points
+	}
+
+	body.Find("p, pre, td, blockquote, li").Each(func(_ int, p *goquery.Selection) {
+		text := collapseSpace(p.Text())
+		if len([]rune(text)) < minParagraphLength {
+			return
+		}
+
+		points := 1 + float64(strings.Count(text, ",")+strings.Count(text, "，")) + math.Min(float64(len([]rune(text)))/100, 3)
+		score(p.Parent(), points)
+		score(p.Parent().Parent(), points/2)
+	})
+
+	var (
+		best      *goquery.Selection
+		bestScore float64
+	)
+	for _, c := range candidates {
+		s := scores[c.Nodes[0]] * (1 - linkDensity(c))
+		if best == nil || s > bestScore {
+			best, bestScore = c, s
+		}
+	}
+
+	return best
+}
+
+// classAndID returns the class and id attributes of the element
+func classAndID(s *goquery.Selection) string {
+	class, _ := s.Attr("class")
+	id, _ := s.Attr("id")
+	return class + " " + id
+}
+
+// blockWeight is the score a block starts with, from its tag and its class and id
+func blockWeight(s *goquery.Selection) (weight float64) {
+	switch goquery.NodeName(s) {
+	case "article", "main":
+		weight = 10
+	case "div":
+		weight = 5
+	case "pre", "td", "blockquote":
+		weight = 3
+	case "ol", "ul", "dl", "dd", "dt", "li":
+		weight = -3
+	case "h1", "h2", "h3", "h4", "h5", "h6", "th":
+		weight = -5
+	}
+
+	class := classAndID(s)
+	if likelyClass.MatchString(class) {
+		weight += 25
+	}
+	if unlikelyClass.MatchString(class) {
+		weight -= 25
+	}
+
+	return weight
+}
+
+// linkDensity is the share of the block's text inside links
+func linkDensity(s *goquery.Selection) float64 {
+	total := len(collapseSpace(s.Text()))
+	if total == 0 {
+		return 0
+	}
+
+	var linked int
+	s.Find("a").Each(func(_ int, a *goquery.Selection) {
+		linked += len(collapseSpace(a.Text()))
+	})
+
+	return float64(linked) / float64(total)
+}
+
+// blockTags separate the text of a block into lines
+var blockTags = map[string]bool{
+	"address": true, "article": true, "blockquote": true, "br": true, "dd": true, "div": true,
+	"dl": true, "dt": true, "figcaption": true, "figure": true, "h1": true, "h2": true, "h3": true,
+	"h4": true, "h5": true, "h6": true, "hr": true, "li": true, "main": true, "ol": true, "p": true,
+	"pre": true, "section": true, "table": true, "td": true, "th": true, "tr": true, "ul": true,
+}
+
+// blockText returns the text of the block with one line per paragraph, heading or list item
+func blockText(s *goquery.Selection) string {
+	var (
+		lines []string
+		line  strings.Builder
+	)
+	endLine := func() {
+		if text := collapseSpace(line.String()); text != "" {
+			lines = append(lines, text)
+		}
+		line.Reset()
+	}
+
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		switch n.Type {
+		case html.TextNode:
+			line.WriteString(n.Data)
+			return
+		case html.ElementNode:
+			if blockTags[n.Data] {
+				endLine()
+				defer endLine()
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	for _, n := range s.Nodes {
+		walk(n)
+	}
+	endLine()
+
+	return strings.Join(lines, "\n")
+}
+
+// summarize returns the leading sentences of the text up to MaxSummaryLength characters. A first
+// sentence longer than that is cut at a word boundary and ends with an ellipsis.
+func summarize(text string) string {
+	text = collapseSpace(text)
+	if len([]rune(text)) <= MaxSummaryLength {
+		return text
+	}
+
+	summary := ""
+	for _, loc := range sentenceEnd.FindAllStringIndex(text+" ", -1) {
+		end := loc[1] - 1
+		if len([]rune(text[:end])) > MaxSummaryLength {
+			break
+		}
+		summary = text[:end]
+	}
+	if summary != "" {
+		return strings.TrimSpace(summary)
+	}
+
+	cut := []rune(text)[:MaxSummaryLength-1]
+	if i := strings.LastIndexFunc(string(cut), unicode.IsSpace); i > 0 {
+		return strings.TrimSpace(string(cut)[:i]) + "…"
+	}
+	return string(cut) + "…"
+}
+
+// collapseSpace trims the text and replaces every run of whitespace in it with one space
+func collapseSpace(text string) string {
+	return strings.Join(strings.Fields(text), " ")
+}
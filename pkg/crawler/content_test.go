@@ -0,0 +1,129 @@
+package crawler
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/google/go-cmp/cmp"
+	"github.com/sirupsen/logrus"
+)
+
+const articlePage = `<html><head><title>Release notes</title></head><body>
+<nav><ul><li><a href="/">Home</a></li><li><a href="/docs">Documentation and guides for every release</a></li></ul></nav>
+<div class="cookie-banner"><p>We use cookies to improve your experience, by continuing you agree to our policy.</p></div>
+<div id="main-content">
+  <article class="post">
+    <h1>Version 2.0 is out</h1>
+    <p>Version 2.0 brings incremental crawls, which only fetch the pages that changed since the last crawl.</p>
+    <p>It also adds extraction schemas, letting every team shape the documents of their site, without code changes.</p>
+    <ul><li>Faster, smaller recrawls</li></ul>
+  </article>
+</div>
+<footer><p>Copyright 2020 Example Inc, all rights reserved, see our terms and conditions.</p></footer>
+</body></html>`
+
+func TestMainContent(t *testing.T) {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(articlePage))
+	if err != nil {
+		t.Fatalf("Unexpected error parsing the page: %s", err)
+	}
+	body := doc.Find("body")
+
+	main := mainContent(body)
+	if main == nil {
+		t.Fatalf("the main content should be found")
+	}
+
+	want := strings.Join([]string{
+		"Version 2.0 is out",
+		"Version 2.0 brings incremental crawls, which only fetch the pages that changed since the last crawl.",
+		"It also adds extraction schemas, letting every team shape the documents of their site, without code changes.",
+		"Faster, smaller recrawls",
+	}, "\n")
+	if diff := cmp.Diff(want, blockText(main)); diff != "" {
+		t.Fatalf(diff)
+	}
+
+	if body.Find("nav, footer, .cookie-banner").Length() != 3 {
+		t.Fatalf("finding the main content shouldn't remove elements from the page")
+	}
+}
+
+func TestMainContentWithoutParagraphs(t *testing.T) {
+	doc, _ := goquery.NewDocumentFromReader(strings.NewReader(`<html><body><p>Short</p></body></html>`))
+	if main := mainContent(doc.Find("body")); main != nil {
+		t.Fatalf("a page without any long paragraph has no main content: %s", blockText(main))
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	long := strings.Repeat("word ", 100)
+	sentence := "This sentence has exactly enough words to be meaningful. "
+
+	tests := map[string]struct {
+		text string
+		want string
+	}{
+		"short":     {text: "  A short\npage. ", want: "A short page."},
+		"sentences": {text: strings.Repeat(sentence, 6), want: strings.TrimSpace(strings.Repeat(sentence, 5))},
+		"no-end":    {text: long, want: strings.TrimSpace(strings.Repeat("word ", 59)) + "…"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := summarize(tc.text)
+			if got != tc.want {
+				t.Fatalf("summary - expected : %q, received : %q", tc.want, got)
+			}
+			if len([]rune(got)) > MaxSummaryLength {
+				t.Fatalf("the summary is longer than %d characters: %d", MaxSummaryLength, len([]rune(got)))
+			}
+		})
+	}
+}
+
+func TestCrawlMainContentOnly(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, articlePage)
+	}))
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL)
+
+	for _, mainOnly := range []bool{false, true} {
+		t.Run(fmt.Sprintf("main-content-only-%t", mainOnly), func(t *testing.T) {
+			job, err := NewRegistry().Create(CrawlRequest{URL: srv.URL + "/", Domain: u.Host, MaxDepth: 1, MainContentOnly: mainOnly})
+			if err != nil {
+				t.Fatalf("Unexpected error creating job: %s", err)
+			}
+
+			sink := &documentSink{docs: make(map[string]RenderedPage)}
+			if err := Crawl(job.ctx, job, sink, nil, nil, logrus.New()); err != nil {
+				t.Fatalf("Unexpected error crawling: %s", err)
+			}
+
+			for _, page := range sink.docs {
+				if !strings.HasPrefix(page.BodyText, "Version 2.0 is out\n") || strings.Contains(page.BodyText, "cookies") {
+					t.Fatalf("the body text should only hold the main content: %q", page.BodyText)
+				}
+				if page.Summary == "" || strings.Contains(page.Summary, "\n") {
+					t.Fatalf("the summary should be the leading text of the main content: %q", page.Summary)
+				}
+
+				paragraphs := 4
+				if mainOnly {
+					paragraphs = 2
+				}
+				if len(page.Source["p"]) != paragraphs {
+					t.Fatalf("paragraphs - expected : %d, received : %d %v", paragraphs, len(page.Source["p"]), page.Source["p"])
+				}
+			}
+		})
+	}
+}
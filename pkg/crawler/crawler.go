@@ -1,18 +1,16 @@
 package crawler
 
 import (
-	"bytes"
-	"crypto/md5"
-	"encoding/hex"
-	"encoding/json"
+	"context"
+	"fmt"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/PuerkitoBio/goquery"
-	"github.com/elastic/go-elasticsearch/v8"
 	"github.com/gocolly/colly"
 	"github.com/sirupsen/logrus"
 	"github.com/wambozi/elastic-webcrawler/m/pkg/clients"
@@ -24,21 +22,31 @@ type Retries struct {
 	Number  int  `json:"number,omitempty"`
 }
 
-// Meta represents the data scraped from the metdata of the HTML head on the page
-type Meta struct {
-	OgImage  string `json:"ogimage"`
-	Title    string `json:"title"`
-	Desc     string `json:"description"`
-	Keywords string `json:"keywords"`
+// Policy returns the backoff policy for retrying page fetches and sink writes, which never retries
+// when retries are disabled
+func (r *Retries) Policy() clients.RetryPolicy {
+	if r == nil || !r.Enabled {
+		return clients.RetryPolicy{}
+	}
+	return clients.NewRetryPolicy(r.Number)
 }
 
-// RenderedPage represents the structred data scraped from the page
-type RenderedPage struct {
-	ID     string              `json:"id,omitempty"`
-	URI    string              `json:"uri"`
-	Source map[string][]string `json:"source"`
-	Meta   Meta                `json:"meta"`
-}
+// Meta represents the data scraped from the metdata of the HTML head on the page
+type Meta = clients.Meta
+
+// RenderedPage represents the structred data scraped from the page, as written to every sink
+type RenderedPage = clients.RenderedPage
+
+const (
+	// ModeUpdate writes crawled pages over the existing ones in the target index
+	ModeUpdate = "update"
+	// ModeRebuild crawls into a new generation of the target index and swaps the index alias to it
+	// once the crawl completes
+	ModeRebuild = "rebuild"
+)
+
+// discardTimeout bounds how long removing the pages of a failed or cancelled crawl may take
+const discardTimeout = 30 * time.Second
 
 // CrawlRequest represents the request to the /crawl route
 type CrawlRequest struct {
@@ -48,154 +56,418 @@ type CrawlRequest struct {
 	Engine   string `json:"engine"`
 	Type     string `json:"type"`
 	Domain   string `json:"domain,omitempty"`
+
+	// MaxDepth limits how many links away from URL the crawl follows, 0 means unlimited
+	MaxDepth int `json:"max_depth,omitempty"`
+	// MaxPages limits how many pages the crawl visits, 0 means unlimited
+	MaxPages int `json:"max_pages,omitempty"`
+	// MaxDuration limits how long the crawl runs, as a Go duration string such as "30m"
+	MaxDuration string `json:"max_duration,omitempty"`
+
+	// SlowPage is how long fetching a page may take before the crawl's report lists it as slow, as a
+	// Go duration string, defaulting to DefaultSlowPage
+	SlowPage string `json:"slow_page,omitempty"`
+
+	// Robots is either RobotsRespect or RobotsIgnore, defaulting to the server configuration
+	Robots string `json:"robots,omitempty"`
+
+	// Sitemaps are the URLs of sitemaps or sitemap indexes whose pages seed the crawl
+	Sitemaps []string `json:"sitemaps,omitempty"`
+	// DiscoverSitemaps also seeds the crawl from the sitemaps listed in the site's robots.txt
+	DiscoverSitemaps bool `json:"discover_sitemaps,omitempty"`
+
+	// Retries sets how many times transient failures fetching pages or writing documents are retried,
+	// defaulting to the server configuration
+	Retries *Retries `json:"retries,omitempty"`
+
+	// Mapping names the file in the mappings directory an Elasticsearch index is created with when
+	// it doesn't exist, e.g. "english" for english_mapping.json
+	Mapping string `json:"mapping,omitempty"`
+
+	// LanguageIndices routes the pages of languages with a dedicated mapping to their own
+	// Elasticsearch index, e.g. "{index}-en" or "{index}-cjk"
+	LanguageIndices bool `json:"language_indices,omitempty"`
+
+	// Mode is ModeUpdate or ModeRebuild, defaulting to ModeUpdate
+	Mode string `json:"mode,omitempty"`
+
+	// Prune deletes the pages of the site the crawl didn't find once it completes
+	Prune *Prune `json:"prune,omitempty"`
+
+	// TrackingParams are the query parameters stripped from links, defaulting to the server
+	// configuration or DefaultTrackingParams. A trailing * matches any parameter with that prefix.
+	TrackingParams []string `json:"tracking_params,omitempty"`
+
+	// Extract maps the names of extra document fields to how they are extracted from every page,
+	// see CompileExtraction
+	Extract map[string]Field `json:"extract,omitempty"`
+
+	// MainContentOnly extracts the headings and paragraphs of the page's source from its main content
+	// only, leaving out navigation, banners and footers
+	MainContentOnly bool `json:"main_content_only,omitempty"`
+
+	// ImageIndex or ImageEngine is the Elasticsearch index or App Search engine every image of the
+	// crawled pages is also written to, one document per image
+	ImageIndex  string `json:"image_index,omitempty"`
+	ImageEngine string `json:"image_engine,omitempty"`
+
+	// Documents are the formats of linked documents whose text is extracted and indexed alongside
+	// the pages, e.g. DocumentPDF, defaulting to the server configuration
+	Documents []string `json:"documents,omitempty"`
+
+	// Incremental fetches the pages found by the previous crawl conditionally and doesn't rewrite
+	// the ones that haven't changed
+	Incremental bool `json:"incremental,omitempty"`
+
+	// IncludePatterns limits the links followed to those matching at least one pattern, see CompileURLRules
+	IncludePatterns []string `json:"include_patterns,omitempty"`
+	// ExcludePatterns stops links matching any pattern from being followed, see CompileURLRules
+	ExcludePatterns []string `json:"exclude_patterns,omitempty"`
 }
 
-// Init initializes a new crawl
-func Init(elasticClient *elasticsearch.Client, appsearchClient *clients.AppsearchClient, cr CrawlRequest, logger *logrus.Logger) (statusCode int) {
+// Init validates the crawl request, registers it as a job and starts the crawl in the background,
+// writing the crawled pages to the sink and their state to the store
+func Init(jobs *Registry, sink, images clients.Sink, store clients.StateStore, cr CrawlRequest, logger *logrus.Logger) (job *Job, statusCode int) {
 	validURL, err := url.ParseRequestURI(cr.URL)
 	if err != nil {
-		return 400
+		return nil, 400
 	}
 
 	cr.Domain = validURL.Hostname()
 	cr.URL = validURL.String()
 
-	go func(c CrawlRequest, e *elasticsearch.Client, a *clients.AppsearchClient, l *logrus.Logger) {
-		Crawl(c, e, a, l)
-	}(cr, elasticClient, appsearchClient, logger)
+	job, err = jobs.Create(cr)
+	if err != nil {
+		logger.Errorf("Failed to register crawl job: %v", err)
+		return nil, 500
+	}
+
+	go func(j *Job, s clients.Sink, l *logrus.Logger) {
+		defer func() {
+			if r := recover(); r != nil {
+				l.Errorf("Crawl %s panicked: %v", j.ID, r)
+				j.finish(StateFailed, fmt.Errorf("crawl panicked: %v", r))
+			}
+		}()
+
+		err := Crawl(j.ctx, j, s, images, store, l)
 
-	return 201
+		if j.ctx.Err() != nil {
+			l.Infof("Crawl %s cancelled", j.ID)
+			j.finish(StateCancelled, nil)
+			return
+		}
+		if err != nil {
+			l.Errorf("Crawl %s failed: %v", j.ID, err)
+			j.finish(StateFailed, err)
+			return
+		}
+		j.finish(StateCompleted, nil)
+	}(job, sink, logger)
+
+	return job, 201
 }
 
 func appendToSlice(sl *[]string, ml string) {
 	*sl = append(*sl, ml)
 }
 
-// Crawl does the crawling for Elasticsearch engines
-func Crawl(cr CrawlRequest, elasticClient *elasticsearch.Client, ac *clients.AppsearchClient, logger *logrus.Logger) {
+// contextTransport binds every request made by the collector to the crawl's context so
+// in-flight fetches are aborted when the crawl is cancelled
+type contextTransport struct {
+	ctx  context.Context
+	base http.RoundTripper
+}
+
+func (t *contextTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	return t.base.RoundTrip(r.WithContext(t.ctx))
+}
+
+// Crawl does the crawling, writing every page to the sink and recording its progress on the job.
+// A nil sink only follows links. The images of the pages are also written to the images sink, if
+// there is one, one document per image. The state of the pages is kept in the store, if there is one, for
+// incremental crawls. It stops visiting pages and indexing documents once ctx is done, and returns
+// an error if the crawl could not run at all.
+func Crawl(ctx context.Context, job *Job, sink, images clients.Sink, store clients.StateStore, logger *logrus.Logger) error {
+	cr := job.Request
+
+	rules, err := CompileURLRules(cr.IncludePatterns, cr.ExcludePatterns)
+	if err != nil {
+		return err
+	}
+
+	extraction, err := CompileExtraction(cr.Extract)
+	if err != nil {
+		return err
+	}
+
+	if p, ok := sink.(clients.Preparer); ok {
+		if err := p.Prepare(ctx); err != nil {
+			logger.Errorf("Error preparing the %s sink: %v", cr.Type, err)
+			return err
+		}
+	}
+	if p, ok := images.(clients.Preparer); ok {
+		if err := p.Prepare(ctx); err != nil {
+			logger.Errorf("Error preparing the %s image sink: %v", cr.Type, err)
+			return err
+		}
+	}
+
+	// The sink is closed with the job's context so pages still buffered when a limit stops the
+	// crawl are written
+	jobCtx := ctx
+
+	// Every page is stamped with the start of the crawl, so pages stamped earlier weren't found by it
+	seen := time.Now().UTC().Truncate(time.Millisecond)
+
+	var states *pageStates
+	if sink != nil {
+		states = loadPageStates(ctx, job, store, seen, logger)
+	}
+
+	// stop ends the crawl early when a scope limit is reached, without cancelling the job itself
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+
+	// fail stops the crawl after the sink reports an error no further write can recover from
+	var (
+		fatalMu sync.Mutex
+		fatal   error
+	)
+	fail := func(err error) {
+		if !clients.IsFatal(err) {
+			return
+		}
+		fatalMu.Lock()
+		if fatal == nil {
+			fatal = err
+		}
+		fatalMu.Unlock()
+		stop()
+	}
+
+	if d, err := time.ParseDuration(cr.MaxDuration); err == nil && d > 0 {
+		timer := time.AfterFunc(d, func() {
+			job.reachLimit(LimitMaxDuration)
+			stop()
+		})
+		defer timer.Stop()
+	}
+
 	c := colly.NewCollector(
 		colly.AllowedDomains(cr.Domain),
+		colly.MaxDepth(cr.MaxDepth),
 	)
+	c.WithTransport(&contextTransport{ctx: ctx, base: &timingTransport{base: http.DefaultTransport, fetched: job.report.fetched}})
+	c.RedirectHandler = func(req *http.Request, via []*http.Request) error {
+		job.report.redirect(req, via)
+		return followRedirect(req, via)
+	}
 
-	if cr.Type == "elasticsearch" {
-		// Callback for when a scraped page contains an article element
-		c.OnHTML("body", func(e *colly.HTMLElement) {
-			page := RenderedPage{
-				URI: e.Request.URL.String(),
-				Meta: Meta{
-					Title: e.DOM.Find("title").Text(),
-				},
-				Source: make(map[string][]string),
-			}
+	slow := DefaultSlowPage
+	if d, err := time.ParseDuration(cr.SlowPage); err == nil && d > 0 {
+		slow = d
+	}
 
-			metaTags := e.DOM.ParentsUntil("~").Find("meta")
-			metaTags.Each(func(_ int, s *goquery.Selection) {
-				name, _ := s.Attr("name")
-				property, _ := s.Attr("property")
-				if strings.EqualFold(name, "description") {
-					content, _ := s.Attr("content")
-					page.Meta.Desc = content
-				}
-				if strings.EqualFold(name, "keywords") {
-					content, _ := s.Attr("content")
-					page.Meta.Keywords = content
-				}
-				if strings.EqualFold(property, "og:image") {
-					content, _ := s.Attr("content")
-					page.Meta.OgImage = content
-				}
-			})
+	robots := newRobotsCache()
+	if cr.Robots == RobotsRespect {
+		c.IgnoreRobotsTxt = false
 
-			for _, el := range []string{"h1", "h2", "h3", "h4", "p"} {
-				e.DOM.Find(el).Each(func(_ int, s *goquery.Selection) {
-					page.Source[el] = append(page.Source[el], s.Text())
-				})
-			}
+		// Registered before every other HTML callback so the page directives are known when they run
+		c.OnHTML("html", robots.load)
+		c.OnScraped(func(r *colly.Response) {
+			robots.forget(r)
+		})
+	}
 
-			doc, err := CreateElasticDocument(cr.Index, page)
-			if err != nil {
-				logger.Error(err)
-			}
+	canon := newCanonicalizer(cr.URL, cr.TrackingParams)
+	dedupe := newDedupe()
 
-			response, errSlice := clients.IndexDocument(elasticClient, doc)
+	seeds, lastModified := sitemapSeeds(ctx, job, canon, logger)
 
-			if len(errSlice) > 0 {
-				for _, e := range errSlice {
-					logger.Error(e)
-				}
+	// reject counts each distinct link turned away by an include or exclude pattern
+	rejected := make(map[string]bool)
+	reject := func(link, rule string) {
+		job.record(func(s *Stats) {
+			if rejected[link] {
+				return
 			}
-
-			for _, r := range response {
-				logger.Info(r)
+			rejected[link] = true
+			if s.RejectedURLs == nil {
+				s.RejectedURLs = make(map[string]int)
 			}
+			s.RejectedURLs[rule]++
 		})
 	}
 
-	if cr.Type == "app-search" {
-		// Callback for when a scraped page contains an article element
-		c.OnHTML("body", func(e *colly.HTMLElement) {
-			idBytes := md5.Sum([]byte(e.Request.URL.String()))
-			idHash := hex.EncodeToString(idBytes[:])
-			page := clients.AppsearchDocument{
-				ID:     idHash,
-				URI:    e.Request.URL.String(),
-				Source: make(map[string][]string),
-				Title:  e.DOM.ParentsUntil("~").Find("title").Text(),
-			}
+	// visit records why a link was not followed, if it matters for the crawl statistics
+	visit := func(err error) {
+		switch err {
+		case colly.ErrMaxDepth:
+			job.reachLimit(LimitMaxDepth)
+		case colly.ErrRobotsTxtBlocked:
+			job.record(func(s *Stats) { s.PagesDisallowed++ })
+		}
+	}
+
+	// Pages that fail for reasons that may pass are left in the sink when it is pruned
+	failed := newUnreached()
 
-			metaTags := e.DOM.ParentsUntil("~").Find("meta")
-			metaTags.Each(func(_ int, s *goquery.Selection) {
-				name, _ := s.Attr("name")
-				property, _ := s.Attr("property")
-				if strings.EqualFold(name, "description") {
-					content, _ := s.Attr("content")
-					page.Description = content
-				}
-				if strings.EqualFold(name, "keywords") {
-					content, _ := s.Attr("content")
-					page.Keywords = content
-				}
-				if strings.EqualFold(property, "og:image") {
-					content, _ := s.Attr("content")
-					page.OgImage = content
-				}
+	// Batching sinks report the pages they index after Write returns
+	reporter, batched := sink.(clients.Reporter)
+	if batched {
+		reporter.SetReport(func(r clients.BatchResult) {
+			for _, err := range r.Errors {
+				logger.Error(err)
+				fail(err)
+			}
+			states.fail(r.FailedIDs)
+			failed.add(r.FailedIDs...)
+			job.record(func(s *Stats) {
+				s.PagesIndexed += r.Indexed
+				s.Errors += r.Failed
+				s.Retries += r.Retries
+				s.GaveUp += r.GaveUp
+				s.Warnings += r.Warnings
 			})
+		})
+	}
 
-			for _, el := range []string{"h1", "h2", "h3", "h4", "p"} {
-				e.DOM.Find(el).Each(func(_ int, s *goquery.Selection) {
-					page.Source[el] = append(page.Source[el], s.Text())
-				})
+	imageReporter, imagesBatched := images.(clients.Reporter)
+	if imagesBatched {
+		imageReporter.SetReport(func(r clients.BatchResult) {
+			for _, err := range r.Errors {
+				logger.Error(err)
+				fail(err)
 			}
+			job.record(func(s *Stats) {
+				s.ImagesIndexed += r.Indexed
+				s.Errors += r.Failed
+				s.Retries += r.Retries
+				s.GaveUp += r.GaveUp
+				s.Warnings += r.Warnings
+			})
+		})
+	}
 
-			var bearer = "Bearer " + ac.Token
-			var endpoint = ac.Endpoint + ac.API + "engines/" + cr.Engine + "/documents"
+	// writeImages writes the images of the page to the images sink, once per crawl
+	var (
+		imagesMu sync.Mutex
+		written  = make(map[string]bool)
+	)
+	writeImages := func(page RenderedPage) {
+		if images == nil {
+			return
+		}
+		for _, img := range page.Images {
+			imagesMu.Lock()
+			dup := written[img.Src]
+			written[img.Src] = true
+			imagesMu.Unlock()
+			if dup {
+				continue
+			}
 
-			bodyJSON, err := json.Marshal(page)
-			if err != nil {
+			if err := images.Write(ctx, imagePage(img, page)); err != nil {
 				logger.Error(err)
+				fail(err)
+				job.record(func(s *Stats) { s.Errors++ })
+				continue
+			}
+			if !imagesBatched {
+				job.record(func(s *Stats) { s.ImagesIndexed++ })
 			}
+		}
+	}
 
-			doc := bytes.NewReader(bodyJSON)
+	// graph collects the links between the documents of the crawl, so the links pointing at each of
+	// them are written to it once the crawl is over
+	graph := newLinkGraph()
 
-			req, err := http.NewRequest("POST", endpoint, doc)
-			req.Header.Add("Authorization", bearer)
-			req.Header.Add("Content-Type", "application/json")
+	// write stamps the page fetched by r and writes it to the sink
+	write := func(r *colly.Request, page RenderedPage) {
+		page.ID = clients.DocumentID(page.URI)
+		page.Site = r.URL.Hostname()
+		page.LastSeen = seen.Format(clients.LastSeenLayout)
+		page.LastModified = lastModified[r.URL.String()]
 
-			client := ac.Client
+		// A page with the same content as one already written rewrites that document with its alias
+		if dedupe.assign(&page, r.URL.String()) {
+			job.record(func(s *Stats) { s.PagesDuplicate++ })
+		}
+		states.document(r, page.ID)
+
+		if err := sink.Write(ctx, page); err != nil {
+			logger.Error(err)
+			fail(err)
+			states.fail([]string{page.ID})
+			failed.add(page.ID)
+			job.record(func(s *Stats) { s.Errors++ })
+			return
+		}
+		if !batched {
+			job.record(func(s *Stats) { s.PagesIndexed++ })
+		}
+		writeImages(page)
 
-			resp, err := client.Do(req)
-			if err != nil {
-				logger.Error(err)
+		uris := []string{page.URI, canon.canonical(r.URL.String())}
+		for _, alias := range page.Aliases {
+			uris = append(uris, canon.canonical(alias))
+		}
+		graph.add(page.ID, uris, page.Outlinks)
+	}
+
+	if sink != nil {
+		// Callback for when a scraped page contains an article element
+		c.OnHTML("body", func(e *colly.HTMLElement) {
+			if ctx.Err() != nil {
+				return
+			}
+			if robots.get(e.Response).noindex {
+				job.record(func(s *Stats) { s.PagesNoindex++ })
+				return
+			}
+			if states.unchanged(e.Response) {
+				// The document isn't rewritten, but its links still count towards the pages they point at
+				graph.add(states.documentID(e.Request), []string{canon.canonical(e.Request.URL.String())}, extractLinks(e, canon))
+				return
 			}
 
-			logger.Infof("App-Search Response: %v", resp)
+			page := extractPage(e, cr.MainContentOnly)
+			page.URI = canon.pageURI(e)
+			page.ContentType = "text/html"
+			page.Fields = extraction.extract(e)
+			page.Outlinks = extractLinks(e, canon)
+			write(e.Request, page)
 		})
 	}
 
+	// follow visits a link found on the page requested by r
+	follow := func(r *colly.Request, link string) {
+		link = canon.fetchURL(link)
+		job.report.link(r.URL.String(), link)
+		if u, err := url.Parse(link); err == nil && u.Host == cr.Domain {
+			if rule := rules.rejectedBy(u); rule != "" {
+				reject(link, rule)
+				return
+			}
+		}
+		// Visit through the request so the depth of the linked page is tracked
+		visit(r.Visit(link))
+	}
+
 	// Callback for links on scraped pages
 	c.OnHTML("a[href]", func(e *colly.HTMLElement) {
-		link := e.Attr("href")
-		c.Visit(e.Request.AbsoluteURL(link))
+		if ctx.Err() != nil || robots.get(e.Response).nofollow {
+			return
+		}
+		link := e.Request.AbsoluteURL(e.Attr("href"))
+		if link == "" {
+			return
+		}
+		states.link(e.Request, link)
+		follow(e.Request, link)
 	})
 
 	c.Limit(&colly.LimitRule{
@@ -203,11 +475,335 @@ func Crawl(cr CrawlRequest, elasticClient *elasticsearch.Client, ac *clients.App
 		RandomDelay: 1 * time.Second,
 	})
 
+	// visited counts the distinct pages requested towards max_pages once they are answered or fail
+	// for good, so retries and pages answering 304 don't use up more of it than pages fetched once
+	var (
+		visitedMu sync.Mutex
+		visited   = make(map[string]bool)
+	)
+	countPage := func(r *colly.Response) {
+		visitedMu.Lock()
+		defer visitedMu.Unlock()
+		visited[r.Request.URL.String()] = true
+	}
+	budgetSpent := func() bool {
+		visitedMu.Lock()
+		defer visitedMu.Unlock()
+		return len(visited) >= cr.MaxPages
+	}
+
 	c.OnRequest(func(r *colly.Request) {
+		if ctx.Err() != nil {
+			r.Abort()
+			return
+		}
+		if cr.MaxPages > 0 && budgetSpent() {
+			job.reachLimit(LimitMaxPages)
+			stop()
+			r.Abort()
+			return
+		}
+		states.request(r)
+		job.report.request(r.URL.String())
 		logger.Infof("Visiting: %s", r.URL.String())
 	})
 
-	c.Visit(cr.URL)
+	// A page that hasn't changed since the previous crawl has no body, so its links are followed
+	// from its previous state
+	c.OnError(func(r *colly.Response, err error) {
+		links, ok := states.notModified(job, r)
+		if !ok || ctx.Err() != nil {
+			return
+		}
+		countPage(r)
+		graph.add(states.documentID(r.Request), []string{canon.canonical(r.Request.URL.String())}, previousLinks(links, canon))
+		for _, link := range links {
+			follow(r.Request, link)
+		}
+	})
+
+	// Links that fail are reported along with the page they were found on
+	c.OnError(func(r *colly.Response, err error) {
+		if ctx.Err() != nil {
+			return
+		}
+		job.report.fail(r, err)
+		if clients.RetryableStatus(r.StatusCode) || r.StatusCode == 0 && failureKind(0, err) != "" {
+			failed.add(clients.DocumentID(canon.canonical(r.Request.URL.String())))
+		}
+	})
+
+	// Retry pages that failed with a timeout, dropped connection, 5xx or 429 response. Pages that
+	// aren't retried count towards max_pages as they are.
+	policy := cr.Retries.Policy()
+	var (
+		retriesMu sync.Mutex
+		retries   = make(map[string]int)
+	)
+	c.OnError(func(r *colly.Response, err error) {
+		if ctx.Err() != nil {
+			return
+		}
+		if policy.Attempts == 0 || r.StatusCode != 0 && !clients.RetryableStatus(r.StatusCode) || r.StatusCode == 0 && !clients.IsRetryable(err) {
+			countPage(r)
+			return
+		}
+
+		link := r.Request.URL.String()
+		retriesMu.Lock()
+		retries[link]++
+		retry := retries[link]
+		retriesMu.Unlock()
+
+		if retry > policy.Attempts {
+			logger.Errorf("Giving up on %s after %d retries: %v", link, policy.Attempts, err)
+			job.record(func(s *Stats) { s.GaveUp++ })
+			countPage(r)
+			return
+		}
+
+		wait := policy.Backoff(retry)
+		logger.Warnf("Retrying %s in %s (retry %d of %d): %v", link, wait, retry, policy.Attempts, err)
+		job.record(func(s *Stats) { s.Retries++ })
+		if clients.Sleep(ctx, wait) != nil {
+			return
+		}
+		r.Request.Retry()
+	})
+
+	c.OnResponse(func(r *colly.Response) {
+		countPage(r)
+		job.record(func(s *Stats) { s.PagesVisited++ })
+		job.report.response(r, slow)
+		states.response(job, r)
+	})
+
+	// Linked documents such as PDFs have no HTML to scrape, so their text is extracted from the body
+	if sink != nil && len(cr.Documents) > 0 {
+		c.OnResponse(func(r *colly.Response) {
+			format, ok := documentFormatOf(r.Headers.Get("Content-Type"), r.Request.URL.Path, cr.Documents)
+			if !ok || ctx.Err() != nil || states.unchanged(r) {
+				return
+			}
+			// Documents have no robots meta tags, so their header is the only way to keep them out
+			if cr.Robots == RobotsRespect && parseRobotsDirectives(r.Headers.Values("X-Robots-Tag")...).noindex {
+				job.record(func(s *Stats) { s.PagesNoindex++ })
+				return
+			}
+
+			page, err := extractDocument(r, format)
+			if err != nil {
+				logger.Errorf("Failed to extract the text of %s: %v", r.Request.URL, err)
+				job.record(func(s *Stats) { s.Errors++ })
+				return
+			}
+			page.URI = canon.canonical(r.Request.URL.String())
+			job.record(func(s *Stats) { s.DocumentsExtracted++ })
+			write(r.Request, page)
+		})
+	}
+
+	visit(c.Visit(cr.URL))
+
+	// Sitemap pages are held to the same include and exclude patterns as links
+	for _, seed := range seeds {
+		if ctx.Err() != nil {
+			break
+		}
+		if u, err := url.Parse(seed); err == nil && u.Host == cr.Domain {
+			if rule := rules.rejectedBy(u); rule != "" {
+				reject(seed, rule)
+				continue
+			}
+		}
+		visit(c.Visit(seed))
+	}
+
+	if sink != nil {
+		err = sink.Close(jobCtx)
+	}
+	if images != nil {
+		if closeErr := images.Close(jobCtx); err == nil {
+			err = closeErr
+		}
+	}
+
+	fatalMu.Lock()
+	if fatal != nil {
+		err = fatal
+	}
+	fatalMu.Unlock()
+
+	// Failing to write the links doesn't fail the crawl, as the pages themselves are indexed
+	if u, ok := sink.(clients.Updater); ok && err == nil && jobCtx.Err() == nil {
+		result, updateErr := u.Update(jobCtx, graph.updates())
+		if updateErr != nil {
+			logger.Errorf("Failed to write the links of crawl %s: %v", job.ID, updateErr)
+			job.record(func(s *Stats) { s.Errors++ })
+		}
+		for _, err := range result.Errors {
+			logger.Error(err)
+		}
+		job.record(func(s *Stats) {
+			s.PagesLinked += result.Indexed
+			s.Errors += result.Failed
+			s.Retries += result.Retries
+			s.GaveUp += result.GaveUp
+		})
+	}
+
+	// A rebuild cut short by a scope limit didn't reach every page, so it is discarded rather than
+	// replacing the previous generation
+	limit := job.Status().Limit
+	if err == nil && limit != "" && cr.Mode == ModeRebuild {
+		err = fmt.Errorf("Rebuild stopped at its %s limit, keeping the previous index", limit)
+	}
+
+	// The images are only committed once the pages are
+	for _, s := range []clients.Sink{sink, images} {
+		c, ok := s.(clients.Committer)
+		if !ok {
+			continue
+		}
+		if err == nil && jobCtx.Err() == nil {
+			err = c.Commit(jobCtx)
+		} else {
+			// The job's context is done when it was cancelled, so the pages are discarded without it
+			discardCtx, cancel := context.WithTimeout(context.Background(), discardTimeout)
+			defer cancel()
+			if err := c.Discard(discardCtx); err != nil {
+				logger.Errorf("Failed to discard the pages of crawl %s: %v", job.ID, err)
+			}
+		}
+	}
+
+	if err != nil || jobCtx.Err() != nil {
+		return err
+	}
+
+	states.save(jobCtx, job, logger)
+	if cr.Mode == ModeRebuild {
+		// The new generation only holds the pages the rebuild found
+		states.forget(jobCtx, job, seen, logger)
+	}
+
+	return prune(jobCtx, job, sink, states, failed, seen, logger)
+}
+
+// extractPage scrapes the structured data of the page from its body element, or only the headings,
+// paragraphs and images of its main content if mainOnly is set
+func extractPage(e *colly.HTMLElement, mainOnly bool) RenderedPage {
+	page := RenderedPage{
+		ID:  clients.DocumentID(e.Request.URL.String()),
+		URI: e.Request.URL.String(),
+		Meta: Meta{
+			Title: e.DOM.ParentsUntil("~").Find("title").Text(),
+		},
+		Source: make(map[string][]string),
+	}
+
+	metaTags := e.DOM.ParentsUntil("~").Find("meta")
+	metaTags.Each(func(_ int, s *goquery.Selection) {
+		name, _ := s.Attr("name")
+		property, _ := s.Attr("property")
+		if strings.EqualFold(name, "description") {
+			content, _ := s.Attr("content")
+			page.Meta.Desc = content
+		}
+		if strings.EqualFold(name, "keywords") {
+			content, _ := s.Attr("content")
+			page.Meta.Keywords = content
+		}
+		if strings.EqualFold(property, "og:image") {
+			content, _ := s.Attr("content")
+			page.Meta.OgImage = content
+		}
+	})
+
+	source := e.DOM
+	if main := mainContent(e.DOM); main != nil {
+		page.BodyText = blockText(main)
+		page.Summary = summarize(page.BodyText)
+		if mainOnly {
+			source = main
+		}
+	}
+
+	page.Images = extractImages(e, source)
+
+	for _, el := range []string{"h1", "h2", "h3", "h4", "p"} {
+		source.Find(el).Each(func(_ int, s *goquery.Selection) {
+			page.Source[el] = append(page.Source[el], s.Text())
+		})
+	}
+
+	var text strings.Builder
+	for _, el := range []string{"h1", "h2", "h3", "h4", "p"} {
+		for _, t := range page.Source[el] {
+			text.WriteString(t)
+			text.WriteByte('\n')
+		}
+	}
+	htmlLang, _ := e.DOM.Closest("html").Attr("lang")
+	page.Language = detectLanguage(htmlLang, e.Response.Headers.Get("Content-Language"), text.String())
+
+	// Structured data is published in the head as well as the body
+	if len(e.DOM.Nodes) > 0 {
+		root := e.DOM.Nodes[0]
+		for root.Parent != nil {
+			root = root.Parent
+		}
+		page.Structured = extractStructured(goquery.NewDocumentFromNode(root).Selection)
+	}
+
+	return page
+}
+
+// sitemapSeeds reads the sitemaps of the crawl request and returns the pages they list along with
+// their <lastmod> dates keyed by the URL they are fetched with
+func sitemapSeeds(ctx context.Context, job *Job, canon *canonicalizer, logger *logrus.Logger) (seeds []string, lastModified map[string]string) {
+	cr := job.Request
+	lastModified = make(map[string]string)
+	sitemaps := cr.Sitemaps
+	client := &http.Client{Timeout: 30 * time.Second}
+
+	if cr.DiscoverSitemaps {
+		site, err := url.Parse(cr.URL)
+		if err == nil {
+			var discovered []string
+			discovered, err = discoverSitemaps(ctx, client, site)
+			sitemaps = append(sitemaps, discovered...)
+		}
+		if err != nil {
+			logger.Errorf("Failed to discover sitemaps: %v", err)
+			job.record(func(s *Stats) { s.Errors++ })
+		}
+	}
+
+	if len(sitemaps) == 0 {
+		return nil, lastModified
+	}
+
+	pages, errs := readSitemaps(ctx, client, sitemaps)
+	for _, err := range errs {
+		logger.Error(err)
+	}
+	job.record(func(s *Stats) { s.Errors += len(errs) })
+
+	for _, p := range pages {
+		u, err := url.Parse(strings.TrimSpace(p.Loc))
+		if err != nil {
+			continue
+		}
+		seed := canon.fetchURL(u.String())
+		seeds = append(seeds, seed)
+		if p.LastMod != "" {
+			lastModified[seed] = strings.TrimSpace(p.LastMod)
+		}
+	}
+	logger.Infof("Seeding crawl with %d pages from %d sitemaps", len(seeds), len(sitemaps))
+
+	return seeds, lastModified
 }
 
 func fixURL(href, base string) (URL string, err error) {
@@ -224,21 +820,11 @@ func fixURL(href, base string) (URL string, err error) {
 }
 
 // CreateElasticDocument returns the document to be indexed in Elasticsearch or an error
+//
+// Deprecated: crawls write pages to the sink passed to Crawl. Use clients.NewElasticDocument to
+// index a page on its own.
 func CreateElasticDocument(i string, p RenderedPage) (doc clients.ElasticDocument, err error) {
-	idBytes := md5.Sum([]byte(p.URI))
-	idHash := hex.EncodeToString(idBytes[:])
-	bodyJSON, err := json.Marshal(p)
-	if err != nil {
-		return doc, err
-	}
-	r := bytes.NewReader(bodyJSON)
-	doc = clients.ElasticDocument{
-		Index:      i,
-		DocumentID: idHash,
-		Body:       r,
-	}
-
-	return doc, nil
+	return clients.NewElasticDocument(i, p)
 }
 
 // trimHash slices a hash # from the link
@@ -0,0 +1,275 @@
+package crawler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wambozi/elastic-webcrawler/m/pkg/clients"
+)
+
+// newChainServer serves pages /0 through /n-1 where every page links to the next one
+func newChainServer(n int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		i, err := strconv.Atoi(r.URL.Path[1:])
+		if err != nil || i >= n {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprintf(w, `<html><body><p>page %d</p><a href="/%d">next</a></body></html>`, i, i+1)
+	}))
+}
+
+func TestCrawlLimits(t *testing.T) {
+	srv := newChainServer(4)
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL)
+
+	tests := map[string]struct {
+		request CrawlRequest
+		visited int
+		limit   Limit
+	}{
+		"max-depth": {request: CrawlRequest{MaxDepth: 2}, visited: 2, limit: LimitMaxDepth},
+		"max-pages": {request: CrawlRequest{MaxPages: 3}, visited: 3, limit: LimitMaxPages},
+		"unlimited": {request: CrawlRequest{}, visited: 4},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			cr := tc.request
+			cr.URL = srv.URL + "/0"
+			cr.Domain = u.Host
+
+			job, err := NewRegistry().Create(cr)
+			if err != nil {
+				t.Fatalf("Unexpected error creating job: %s", err)
+			}
+
+			Crawl(job.ctx, job, nil, nil, nil, logrus.New())
+
+			status := job.Status()
+			if status.Stats.PagesVisited != tc.visited {
+				t.Fatalf("pages visited - expected : %d, received : %d", tc.visited, status.Stats.PagesVisited)
+			}
+			if status.Limit != tc.limit {
+				t.Fatalf("limit reached - expected : %q, received : %q", tc.limit, status.Limit)
+			}
+		})
+	}
+}
+
+func TestCrawlMaxPagesRetried(t *testing.T) {
+	chain := newChainServer(4)
+	defer chain.Close()
+
+	// The first page is only served once it has been retried
+	var mu sync.Mutex
+	failed := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		first := r.URL.Path == "/0" && !failed
+		failed = failed || first
+		mu.Unlock()
+		if first {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		chain.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL)
+	job, err := NewRegistry().Create(CrawlRequest{URL: srv.URL + "/0", Domain: u.Host, MaxPages: 2, Retries: &Retries{Enabled: true, Number: 1}})
+	if err != nil {
+		t.Fatalf("Unexpected error creating job: %s", err)
+	}
+
+	Crawl(job.ctx, job, nil, nil, nil, logrus.New())
+
+	// The retry fetches the same page, so it doesn't count towards max_pages
+	status := job.Status()
+	if status.Stats.Retries != 1 || status.Stats.PagesVisited != 2 {
+		t.Fatalf("two distinct pages should be visited after one retry: %+v", status.Stats)
+	}
+	if status.Limit != LimitMaxPages {
+		t.Fatalf("limit reached - expected : %q, received : %q", LimitMaxPages, status.Limit)
+	}
+}
+
+func TestCrawlMaxPagesBroken(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<html><body><p>home</p><a href="/a">a</a><a href="/b">b</a><a href="/c">c</a></body></html>`)
+	}))
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL)
+	job, err := NewRegistry().Create(CrawlRequest{URL: srv.URL + "/", Domain: u.Host, MaxPages: 2})
+	if err != nil {
+		t.Fatalf("Unexpected error creating job: %s", err)
+	}
+
+	Crawl(job.ctx, job, nil, nil, nil, logrus.New())
+
+	// Broken links use up the budget like the pages that load
+	status := job.Status()
+	if status.Limit != LimitMaxPages {
+		t.Fatalf("limit reached - expected : %q, received : %q", LimitMaxPages, status.Limit)
+	}
+	if broken := len(job.Report().BrokenLinks); broken != 1 {
+		t.Fatalf("only one broken link should be fetched within the budget: %+v", job.Report().BrokenLinks)
+	}
+}
+
+func TestCrawlFatalSinkError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"errors":["Could not find engine."]}`)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, "<html><body><p>page</p></body></html>")
+	}))
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL)
+	sink, err := clients.NewSink("app-search", clients.SinkConfig{Engine: "missing", AppsearchClient: clients.CreateAppsearchClient(srv.URL, "token", "/api/as/v1/")})
+	if err != nil {
+		t.Fatalf("Unexpected error creating sink: %s", err)
+	}
+
+	job, err := NewRegistry().Create(CrawlRequest{URL: srv.URL + "/", Domain: u.Host, Engine: "missing", Type: "app-search"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating job: %s", err)
+	}
+
+	err = Crawl(job.ctx, job, sink, nil, nil, logrus.New())
+	if !errors.Is(err, clients.ErrAppsearchEngineNotFound) {
+		t.Fatalf("crawl error - expected : %v, received : %v", clients.ErrAppsearchEngineNotFound, err)
+	}
+	if status := job.Status(); status.Stats.Errors != 1 || status.Stats.PagesIndexed != 0 {
+		t.Fatalf("the rejected page should be counted as an error: %+v", status.Stats)
+	}
+}
+
+func TestCrawlRetries(t *testing.T) {
+	tests := map[string]struct {
+		failures int
+		visited  int
+		retries  int
+		gaveUp   int
+	}{
+		"recovered": {failures: 1, visited: 1, retries: 1},
+		"gave-up":   {failures: 3, retries: 2, gaveUp: 1},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var requests int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if int(atomic.AddInt32(&requests, 1)) <= tc.failures {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				w.Header().Set("Content-Type", "text/html")
+				fmt.Fprint(w, "<html><body><p>page</p></body></html>")
+			}))
+			defer srv.Close()
+
+			u, _ := url.Parse(srv.URL)
+			job, err := NewRegistry().Create(CrawlRequest{URL: srv.URL + "/", Domain: u.Host, Retries: &Retries{Enabled: true, Number: 2}})
+			if err != nil {
+				t.Fatalf("Unexpected error creating job: %s", err)
+			}
+
+			Crawl(job.ctx, job, nil, nil, nil, logrus.New())
+
+			stats := job.Status().Stats
+			if stats.PagesVisited != tc.visited || stats.Retries != tc.retries || stats.GaveUp != tc.gaveUp {
+				t.Fatalf("stats - expected : %d visited, %d retries, %d gave up, received : %+v", tc.visited, tc.retries, tc.gaveUp, stats)
+			}
+		})
+	}
+}
+
+// committingSink records the pages written to it and whether the crawl was committed or discarded
+type committingSink struct {
+	pages     int32
+	committed bool
+	discarded bool
+}
+
+func (s *committingSink) Write(ctx context.Context, page RenderedPage) error {
+	atomic.AddInt32(&s.pages, 1)
+	return nil
+}
+
+func (s *committingSink) Flush(ctx context.Context) error { return nil }
+func (s *committingSink) Close(ctx context.Context) error { return nil }
+
+func (s *committingSink) Commit(ctx context.Context) error {
+	s.committed = true
+	return nil
+}
+
+func (s *committingSink) Discard(ctx context.Context) error {
+	s.discarded = true
+	return nil
+}
+
+func TestCrawlCommit(t *testing.T) {
+	srv := newChainServer(3)
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL)
+
+	tests := map[string]struct {
+		cancel    bool
+		maxPages  int
+		committed bool
+	}{
+		"completed": {committed: true},
+		"cancelled": {cancel: true},
+		// The alias isn't swapped to a generation missing the pages past the limit
+		"limit-hit": {maxPages: 1},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			job, err := NewRegistry().Create(CrawlRequest{URL: srv.URL + "/0", Domain: u.Host, Mode: ModeRebuild, MaxPages: tc.maxPages})
+			if err != nil {
+				t.Fatalf("Unexpected error creating job: %s", err)
+			}
+			if tc.cancel {
+				job.Cancel()
+			}
+
+			sink := &committingSink{}
+			err = Crawl(job.ctx, job, sink, nil, nil, logrus.New())
+			if tc.maxPages > 0 && err == nil {
+				t.Fatal("a rebuild stopped by a limit should fail")
+			}
+
+			if sink.committed != tc.committed || sink.discarded == tc.committed {
+				t.Fatalf("committed - expected : %t, received : %t (discarded %t)", tc.committed, sink.committed, sink.discarded)
+			}
+		})
+	}
+}
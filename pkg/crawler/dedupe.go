@@ -0,0 +1,83 @@
+package crawler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"sync"
+)
+
+// dedupe collapses the pages of a crawl with the same content into one document, listing the URLs
+// of the others as its aliases
+type dedupe struct {
+	mu     sync.Mutex
+	byHash map[string]string
+	docs   map[string]*dedupedDocument
+}
+
+// dedupedDocument represents a document written by the crawl and the other URLs of its page
+type dedupedDocument struct {
+	uri     string
+	aliases []string
+}
+
+func newDedupe() *dedupe {
+	return &dedupe{byHash: make(map[string]string), docs: make(map[string]*dedupedDocument)}
+}
+
+// contentHash hashes the title and text of the page with case and whitespace normalised, so pages
+// differing only in markup or spacing match. Pages without any text have no hash.
+func contentHash(page RenderedPage) string {
+	var text strings.Builder
+	text.WriteString(page.Meta.Title)
+	for _, el := range []string{"h1", "h2", "h3", "h4", "p"} {
+		for _, t := range page.Source[el] {
+			text.WriteByte('\n')
+			text.WriteString(t)
+		}
+	}
+
+	normalised := strings.ToLower(strings.Join(strings.Fields(text.String()), " "))
+	if normalised == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(normalised))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// assign points the page at the document already holding its content, if any, and lists the URLs
+// the page was found under other than the document's as aliases. It reports whether the crawl has
+// already written the document.
+func (d *dedupe) assign(page *RenderedPage, fetched string) (duplicate bool) {
+	hash := contentHash(*page)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	id := page.ID
+	if primary, ok := d.byHash[hash]; ok && hash != "" {
+		id = primary
+	}
+
+	doc, duplicate := d.docs[id]
+	if !duplicate {
+		doc = &dedupedDocument{uri: page.URI}
+		d.docs[id] = doc
+	}
+	if _, ok := d.byHash[hash]; !ok && hash != "" {
+		d.byHash[hash] = id
+	}
+
+	for _, alias := range []string{page.URI, fetched} {
+		if alias != doc.uri {
+			doc.aliases = addAlias(doc.aliases, alias)
+		}
+	}
+
+	page.ID = id
+	page.URI = doc.uri
+	page.Aliases = append([]string(nil), doc.aliases...)
+
+	return duplicate
+}
@@ -0,0 +1,416 @@
+package crawler
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gocolly/colly"
+	"github.com/ledongthuc/pdf"
+	"github.com/wambozi/elastic-webcrawler/m/pkg/clients"
+)
+
+const (
+	// DocumentPDF extracts the text of PDFs
+	DocumentPDF = "pdf"
+	// DocumentDOCX extracts the text of Word documents
+	DocumentDOCX = "docx"
+	// DocumentODT extracts the text of OpenDocument text documents
+	DocumentODT = "odt"
+	// DocumentText indexes plain text files as they are
+	DocumentText = "text"
+)
+
+// MaxZipEntrySize is the most bytes a file of a DOCX or ODT archive may decompress to, so a small
+// archive can't expand to exhaust the crawler's memory
+const MaxZipEntrySize = 32 << 20
+
+// documentFormat represents a kind of document the crawl can extract the text of
+type documentFormat struct {
+	contentTypes []string
+	extensions   []string
+	extract      func(body []byte) (document, error)
+}
+
+var documentFormats = map[string]documentFormat{
+	DocumentPDF: {
+		contentTypes: []string{"application/pdf", "application/x-pdf"},
+		extensions:   []string{".pdf"},
+		extract:      extractPDF,
+	},
+	DocumentDOCX: {
+		contentTypes: []string{"application/vnd.openxmlformats-officedocument.wordprocessingml.document"},
+		extensions:   []string{".docx"},
+		extract:      extractDOCX,
+	},
+	DocumentODT: {
+		contentTypes: []string{"application/vnd.oasis.opendocument.text"},
+		extensions:   []string{".odt"},
+		extract:      extractODT,
+	},
+	DocumentText: {
+		contentTypes: []string{"text/plain"},
+		extensions:   []string{".txt"},
+		extract:      extractText,
+	},
+}
+
+// document represents the text and metadata extracted from a document
+type document struct {
+	title      string
+	author     string
+	pages      int
+	paragraphs []string
+}
+
+// CheckDocuments returns an error if any of the document formats of a crawl request isn't supported
+func CheckDocuments(formats []string) error {
+	for _, f := range formats {
+		if _, ok := documentFormats[f]; !ok {
+			return fmt.Errorf("'documents' of: %s is not supported. Must be one of %s", f, documentFormatNames())
+		}
+	}
+	return nil
+}
+
+// documentFormatNames lists the supported document formats, quoted and sorted
+func documentFormatNames() string {
+	names := make([]string, 0, len(documentFormats))
+	for name := range documentFormats {
+		names = append(names, "'"+name+"'")
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// documentFormatOf returns the format of a response among the enabled ones, from its Content-Type
+// or, when servers send a generic one, the extension of its URL
+func documentFormatOf(contentType, uri string, enabled []string) (string, bool) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	generic := mediaType == "" || mediaType == "application/octet-stream" || mediaType == "binary/octet-stream"
+	ext := strings.ToLower(path.Ext(uri))
+	if i := strings.IndexAny(ext, "?#"); i >= 0 {
+		ext = ext[:i]
+	}
+
+	for _, name := range enabled {
+		f := documentFormats[name]
+		for _, t := range f.contentTypes {
+			if mediaType == t {
+				return name, true
+			}
+		}
+		if !generic {
+			continue
+		}
+		for _, e := range f.extensions {
+			if ext == e {
+				return name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// extractDocument extracts the text and metadata of the document in the response, which is in the
+// given format, into a page. Its paragraphs are its source, and the document's title defaults to
+// its file name.
+func extractDocument(r *colly.Response, format string) (RenderedPage, error) {
+	f := documentFormats[format]
+	doc, err := f.extract(r.Body)
+	if err != nil {
+		return RenderedPage{}, err
+	}
+
+	name := path.Base(r.Request.URL.Path)
+	if name == "/" || name == "." {
+		name = ""
+	}
+	if unescaped, err := url.PathUnescape(name); err == nil {
+		name = unescaped
+	}
+
+	page := RenderedPage{
+		ID:          clients.DocumentID(r.Request.URL.String()),
+		URI:         r.Request.URL.String(),
+		Meta:        Meta{Title: doc.title},
+		Source:      map[string][]string{"p": doc.paragraphs},
+		ContentType: f.contentTypes[0],
+		File:        &clients.FileInfo{Name: name, Author: doc.author, PageCount: doc.pages, Size: len(r.Body)},
+	}
+	if page.Meta.Title == "" {
+		page.Meta.Title = name
+	}
+
+	page.BodyText = strings.Join(doc.paragraphs, "\n")
+	page.Summary = summarize(page.BodyText)
+	page.Language = detectLanguage("", r.Headers.Get("Content-Language"), page.BodyText)
+
+	return page, nil
+}
+
+// extractPDF extracts the text of every page of a PDF and its title and author
+func extractPDF(body []byte) (doc document, err error) {
+	// The PDF reader panics on some malformed files
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Error reading PDF: %v", r)
+		}
+	}()
+
+	r, err := pdf.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		return doc, fmt.Errorf("Error reading PDF: %w", err)
+	}
+
+	info := r.Trailer().Key("Info")
+	doc.title = strings.TrimSpace(info.Key("Title").Text())
+	doc.author = strings.TrimSpace(info.Key("Author").Text())
+	doc.pages = r.NumPage()
+
+	fonts := make(map[string]*pdf.Font)
+	for i := 1; i <= doc.pages; i++ {
+		p := r.Page(i)
+		if p.V.IsNull() {
+			continue
+		}
+		// Fonts are cached so their character maps are only parsed once
+		for _, name := range p.Fonts() {
+			if _, ok := fonts[name]; !ok {
+				f := p.Font(name)
+				fonts[name] = &f
+			}
+		}
+		text, err := p.GetPlainText(fonts)
+		if err != nil {
+			return doc, fmt.Errorf("Error reading page %d of PDF: %w", i, err)
+		}
+		doc.paragraphs = append(doc.paragraphs, textParagraphs(text)...)
+	}
+
+	return doc, nil
+}
+
+// extractDOCX extracts the paragraphs of a Word document and its title, author and page count
+func extractDOCX(body []byte) (doc document, err error) {
+	files, err := zipFiles(body, "word/document.xml", "docProps/core.xml", "docProps/app.xml")
+	if err != nil {
+		return doc, fmt.Errorf("Error reading DOCX: %w", err)
+	}
+	if files["word/document.xml"] == nil {
+		return doc, fmt.Errorf("Error reading DOCX: word/document.xml is missing")
+	}
+
+	doc.paragraphs, err = xmlParagraphs(files["word/document.xml"], map[string]bool{"p": true}, map[string]string{"tab": "\t", "br": "\n", "cr": "\n"}, "t")
+	if err != nil {
+		return doc, fmt.Errorf("Error reading DOCX: %w", err)
+	}
+
+	core := xmlValues(files["docProps/core.xml"], "title", "creator")
+	doc.title, doc.author = core["title"], core["creator"]
+	doc.pages, _ = strconv.Atoi(xmlValues(files["docProps/app.xml"], "Pages")["Pages"])
+
+	return doc, nil
+}
+
+// extractODT extracts the paragraphs and headings of an OpenDocument text and its title, author and
+// page count
+func extractODT(body []byte) (doc document, err error) {
+	files, err := zipFiles(body, "content.xml", "meta.xml")
+	if err != nil {
+		return doc, fmt.Errorf("Error reading ODT: %w", err)
+	}
+	if files["content.xml"] == nil {
+		return doc, fmt.Errorf("Error reading ODT: content.xml is missing")
+	}
+
+	doc.paragraphs, err = xmlParagraphs(files["content.xml"], map[string]bool{"p": true, "h": true}, map[string]string{"s": " ", "tab": "\t", "line-break": "\n"}, "")
+	if err != nil {
+		return doc, fmt.Errorf("Error reading ODT: %w", err)
+	}
+
+	meta := xmlValues(files["meta.xml"], "title", "creator", "initial-creator")
+	doc.title, doc.author = meta["title"], meta["creator"]
+	if doc.author == "" {
+		doc.author = meta["initial-creator"]
+	}
+	doc.pages, _ = strconv.Atoi(xmlAttr(files["meta.xml"], "document-statistic", "page-count"))
+
+	return doc, nil
+}
+
+// extractText splits a plain text file into paragraphs at blank lines
+func extractText(body []byte) (doc document, err error) {
+	if !utf8.Valid(body) {
+		return doc, fmt.Errorf("Error reading text: it isn't valid UTF-8")
+	}
+	doc.paragraphs = textParagraphs(string(body))
+	return doc, nil
+}
+
+// textParagraphs splits text into paragraphs at blank lines, joining the lines of each paragraph
+func textParagraphs(text string) (paragraphs []string) {
+	text = strings.Replace(text, "\r\n", "\n", -1)
+	for _, p := range strings.Split(text, "\n\n") {
+		if p = collapseSpace(p); p != "" {
+			paragraphs = append(paragraphs, p)
+		}
+	}
+	return paragraphs
+}
+
+// zipFiles reads the named files of a zip archive, leaving out those it doesn't have. Files larger
+// than MaxZipEntrySize are rejected, whatever size the archive declares for them.
+func zipFiles(body []byte, names ...string) (map[string][]byte, error) {
+	r, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		return nil, err
+	}
+
+	wanted := make(map[string]bool)
+	for _, name := range names {
+		wanted[name] = true
+	}
+
+	files := make(map[string][]byte)
+	for _, f := range r.File {
+		if !wanted[f.Name] {
+			continue
+		}
+		if f.UncompressedSize64 > MaxZipEntrySize {
+			return nil, fmt.Errorf("%s decompresses to %d bytes, more than the limit of %d", f.Name, f.UncompressedSize64, MaxZipEntrySize)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		files[f.Name], err = ioutil.ReadAll(io.LimitReader(rc, MaxZipEntrySize+1))
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		if len(files[f.Name]) > MaxZipEntrySize {
+			return nil, fmt.Errorf("%s decompresses to more than the limit of %d bytes", f.Name, MaxZipEntrySize)
+		}
+	}
+
+	return files, nil
+}
+
+// xmlParagraphs returns the text of the paragraph elements of an XML document. Elements in breaks are
+// replaced by their text, and if text is set only the character data of elements with that name counts.
+// Element names are matched without their namespace.
+func xmlParagraphs(body []byte, paragraph map[string]bool, breaks map[string]string, text string) (paragraphs []string, err error) {
+	d := xml.NewDecoder(bytes.NewReader(body))
+
+	var (
+		depth  int // depth of nested paragraph elements, e.g. in table cells
+		inText bool
+		b      strings.Builder
+	)
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := t.(type) {
+		case xml.StartElement:
+			switch {
+			case paragraph[t.Name.Local]:
+				depth++
+			case depth > 0 && breaks[t.Name.Local] != "":
+				b.WriteString(breaks[t.Name.Local])
+			case t.Name.Local == text:
+				inText = true
+			}
+		case xml.EndElement:
+			switch {
+			case paragraph[t.Name.Local]:
+				depth--
+				if p := collapseSpace(b.String()); p != "" {
+					paragraphs = append(paragraphs, p)
+				}
+				b.Reset()
+			case t.Name.Local == text:
+				inText = false
+			}
+		case xml.CharData:
+			if depth > 0 && (text == "" || inText) {
+				b.Write(t)
+			}
+		}
+	}
+
+	return paragraphs, nil
+}
+
+// xmlValues returns the trimmed character data of the first elements with the names, matched
+// without their namespace
+func xmlValues(body []byte, names ...string) map[string]string {
+	values := make(map[string]string)
+	if body == nil {
+		return values
+	}
+
+	wanted := make(map[string]bool)
+	for _, name := range names {
+		wanted[name] = true
+	}
+
+	d := xml.NewDecoder(bytes.NewReader(body))
+	var current string
+	for {
+		t, err := d.Token()
+		if err != nil {
+			return values
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			if wanted[t.Name.Local] && values[t.Name.Local] == "" {
+				current = t.Name.Local
+			}
+		case xml.EndElement:
+			current = ""
+		case xml.CharData:
+			if current != "" {
+				values[current] += strings.TrimSpace(string(t))
+			}
+		}
+	}
+}
+
+// xmlAttr returns the attribute of the first element with the name, matched without their namespaces
+func xmlAttr(body []byte, element, attr string) string {
+	if body == nil {
+		return ""
+	}
+
+	d := xml.NewDecoder(bytes.NewReader(body))
+	for {
+		t, err := d.Token()
+		if err != nil {
+			return ""
+		}
+		if start, ok := t.(xml.StartElement); ok && start.Name.Local == element {
+			for _, a := range start.Attr {
+				if a.Name.Local == attr {
+					return a.Value
+				}
+			}
+		}
+	}
+}
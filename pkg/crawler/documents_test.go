@@ -0,0 +1,303 @@
+package crawler
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/sirupsen/logrus"
+	"github.com/wambozi/elastic-webcrawler/m/pkg/clients"
+)
+
+// testPDF builds a PDF with one page per text, using the standard Helvetica font
+func testPDF(title, author string, pages ...string) []byte {
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"", // the page tree, once the page objects are numbered
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica >>",
+		fmt.Sprintf("<< /Title (%s) /Author (%s) >>", title, author),
+	}
+
+	var kids []string
+	for _, text := range pages {
+		content := fmt.Sprintf("BT /F1 12 Tf 72 712 Td (%s) Tj ET", text)
+		objects = append(objects, fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(content), content))
+		objects = append(objects, fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 612 792] /Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>", len(objects)))
+		kids = append(kids, fmt.Sprintf("%d 0 R", len(objects)))
+	}
+	objects[1] = fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages))
+
+	var b bytes.Buffer
+	b.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, o := range objects {
+		offsets[i] = b.Len()
+		fmt.Fprintf(&b, "%d 0 obj\n%s\nendobj\n", i+1, o)
+	}
+	xref := b.Len()
+	fmt.Fprintf(&b, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&b, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&b, "trailer\n<< /Size %d /Root 1 0 R /Info 4 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+
+	return b.Bytes()
+}
+
+// testZip builds a zip archive holding the files
+func testZip(files map[string]string) []byte {
+	var b bytes.Buffer
+	w := zip.NewWriter(&b)
+	for name, content := range files {
+		f, _ := w.Create(name)
+		f.Write([]byte(content))
+	}
+	w.Close()
+	return b.Bytes()
+}
+
+var (
+	testDOCX = testZip(map[string]string{
+		"word/document.xml": `<?xml version="1.0" encoding="UTF-8"?>
+<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main"><w:body>
+<w:p><w:pPr><w:pStyle w:val="Title"/></w:pPr><w:r><w:t>Install</w:t></w:r><w:r><w:t xml:space="preserve">ation guide</w:t></w:r></w:p>
+<w:p><w:r><w:t>Run the</w:t></w:r><w:r><w:tab/><w:t>installer.</w:t></w:r></w:p>
+<w:p></w:p>
+</w:body></w:document>`,
+		"docProps/core.xml": `<?xml version="1.0" encoding="UTF-8"?>
+<cp:coreProperties xmlns:cp="http://schemas.openxmlformats.org/package/2006/metadata/core-properties" xmlns:dc="http://purl.org/dc/elements/1.1/">
+<dc:title>Installation</dc:title><dc:creator>Ada</dc:creator></cp:coreProperties>`,
+		"docProps/app.xml": `<?xml version="1.0" encoding="UTF-8"?><Properties><Pages>3</Pages></Properties>`,
+	})
+
+	testODT = testZip(map[string]string{
+		"content.xml": `<?xml version="1.0" encoding="UTF-8"?>
+<office:document-content xmlns:office="urn:oasis:names:tc:opendocument:xmlns:office:1.0" xmlns:text="urn:oasis:names:tc:opendocument:xmlns:text:1.0">
+<office:body><office:text><text:h>Release notes</text:h><text:p>Faster<text:s/>recrawls<text:line-break/>and more.</text:p></office:text></office:body>
+</office:document-content>`,
+		"meta.xml": `<?xml version="1.0" encoding="UTF-8"?>
+<office:document-meta xmlns:office="urn:oasis:names:tc:opendocument:xmlns:office:1.0" xmlns:meta="urn:oasis:names:tc:opendocument:xmlns:meta:1.0" xmlns:dc="http://purl.org/dc/elements/1.1/">
+<office:meta><meta:initial-creator>Grace</meta:initial-creator><meta:document-statistic meta:page-count="2"/></office:meta></office:document-meta>`,
+	})
+)
+
+// documentFields holds the fields of a document exported, so they are compared without reflecting
+// on unexported fields, which the race detector's pointer checks reject
+type documentFields struct {
+	Title      string
+	Author     string
+	Pages      int
+	Paragraphs []string
+}
+
+func fieldsOf(d document) documentFields {
+	return documentFields{Title: d.title, Author: d.author, Pages: d.pages, Paragraphs: d.paragraphs}
+}
+
+func TestExtractDocuments(t *testing.T) {
+	tests := map[string]struct {
+		body   []byte
+		want   document
+		errMsg string
+	}{
+		DocumentPDF: {
+			body: testPDF("User guide", "Ada", "Chapter one", "Chapter two"),
+			want: document{title: "User guide", author: "Ada", pages: 2, paragraphs: []string{"Chapter one", "Chapter two"}},
+		},
+		DocumentDOCX: {
+			body: testDOCX,
+			want: document{title: "Installation", author: "Ada", pages: 3, paragraphs: []string{"Installation guide", "Run the installer."}},
+		},
+		DocumentODT: {
+			body: testODT,
+			want: document{author: "Grace", pages: 2, paragraphs: []string{"Release notes", "Faster recrawls and more."}},
+		},
+		DocumentText: {
+			body: []byte("First line\nof a paragraph.\r\n\r\nSecond paragraph.\n"),
+			want: document{paragraphs: []string{"First line of a paragraph.", "Second paragraph."}},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := documentFormats[name].extract(tc.body)
+			if err != nil {
+				t.Fatalf("Unexpected error extracting the document: %s", err)
+			}
+			if diff := cmp.Diff(fieldsOf(tc.want), fieldsOf(got)); diff != "" {
+				t.Fatalf(diff)
+			}
+		})
+	}
+
+	for _, name := range []string{DocumentPDF, DocumentDOCX, DocumentODT} {
+		if _, err := documentFormats[name].extract([]byte("not a document")); err == nil {
+			t.Fatalf("a malformed %s should fail to extract", name)
+		}
+	}
+}
+
+func TestExtractDocumentsZipBomb(t *testing.T) {
+	// Zeros compress well, so the archive is far smaller than the file it holds
+	bomb := testZip(map[string]string{"word/document.xml": strings.Repeat("\x00", MaxZipEntrySize+1)})
+	if len(bomb) > MaxZipEntrySize/100 {
+		t.Fatalf("the archive should be small: %d bytes", len(bomb))
+	}
+
+	if _, err := documentFormats[DocumentDOCX].extract(bomb); err == nil {
+		t.Fatalf("a DOCX decompressing past the limit should fail to extract")
+	}
+	if _, err := zipFiles(bomb, "word/document.xml"); err == nil || !strings.Contains(err.Error(), "limit") {
+		t.Fatalf("reading a file decompressing past the limit should fail: %v", err)
+	}
+}
+
+func TestDocumentFormatOf(t *testing.T) {
+	enabled := []string{DocumentPDF, DocumentDOCX}
+
+	tests := map[string]struct {
+		contentType string
+		uri         string
+		want        string
+	}{
+		"content-type":    {contentType: "application/pdf", uri: "/download?id=1", want: DocumentPDF},
+		"octet-stream":    {contentType: "application/octet-stream", uri: "/notes.DOCX", want: DocumentDOCX},
+		"no-content-type": {uri: "/guide.pdf", want: DocumentPDF},
+		"html":            {contentType: "text/html; charset=utf-8", uri: "/guide.pdf"},
+		"disabled":        {contentType: "application/vnd.oasis.opendocument.text", uri: "/notes.odt"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, ok := documentFormatOf(tc.contentType, tc.uri, enabled)
+			if got != tc.want || ok != (tc.want != "") {
+				t.Fatalf("format - expected : %q, received : %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestCheckDocuments(t *testing.T) {
+	if err := CheckDocuments([]string{DocumentPDF, DocumentText}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	want := "'documents' of: xlsx is not supported. Must be one of 'docx', 'odt', 'pdf', 'text'"
+	if err := CheckDocuments([]string{"xlsx"}); err == nil || err.Error() != want {
+		t.Fatalf("error - expected : %s, received : %v", want, err)
+	}
+}
+
+func TestCrawlDocuments(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, `<html><body><p>docs</p><a href="/guide.pdf">guide</a><a href="/files/install%20notes.docx">notes</a><a href="/notes.odt">odt</a></body></html>`)
+		case "/guide.pdf":
+			w.Header().Set("Content-Type", "application/pdf")
+			w.Write(testPDF("", "Ada", "Chapter one"))
+		case "/files/install notes.docx":
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write(testDOCX)
+		case "/notes.odt":
+			w.Header().Set("Content-Type", "application/vnd.oasis.opendocument.text")
+			w.Write(testODT)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL)
+	job, err := NewRegistry().Create(CrawlRequest{URL: srv.URL + "/", Domain: u.Host, Documents: []string{DocumentPDF, DocumentDOCX}})
+	if err != nil {
+		t.Fatalf("Unexpected error creating job: %s", err)
+	}
+
+	sink := &documentSink{docs: make(map[string]RenderedPage)}
+	if err := Crawl(job.ctx, job, sink, nil, nil, logrus.New()); err != nil {
+		t.Fatalf("Unexpected error crawling: %s", err)
+	}
+
+	type summary struct {
+		Title       string
+		ContentType string
+		File        *clients.FileInfo
+		BodyText    string
+	}
+	got := make(map[string]summary)
+	for _, doc := range sink.docs {
+		got[doc.URI] = summary{Title: doc.Meta.Title, ContentType: doc.ContentType, File: doc.File, BodyText: doc.BodyText}
+	}
+
+	want := map[string]summary{
+		srv.URL + "/": {ContentType: "text/html"},
+		srv.URL + "/guide.pdf": {
+			Title:       "guide.pdf",
+			ContentType: "application/pdf",
+			File:        &clients.FileInfo{Name: "guide.pdf", Author: "Ada", PageCount: 1, Size: len(testPDF("", "Ada", "Chapter one"))},
+			BodyText:    "Chapter one",
+		},
+		srv.URL + "/files/install%20notes.docx": {
+			Title:       "Installation",
+			ContentType: "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+			File:        &clients.FileInfo{Name: "install notes.docx", Author: "Ada", PageCount: 3, Size: len(testDOCX)},
+			BodyText:    "Installation guide\nRun the installer.",
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf(diff)
+	}
+
+	if stats := job.Status().Stats; stats.DocumentsExtracted != 2 || stats.PagesIndexed != 3 {
+		t.Fatalf("the PDF and DOCX should be indexed alongside the page: %+v", stats)
+	}
+}
+
+func TestCrawlDocumentsNoindex(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, `<html><body><p>docs</p><a href="/guide.pdf">guide</a><a href="/private.pdf">private</a></body></html>`)
+		case "/guide.pdf":
+			w.Header().Set("Content-Type", "application/pdf")
+			w.Write(testPDF("Guide", "Ada", "Chapter one"))
+		case "/private.pdf":
+			w.Header().Set("Content-Type", "application/pdf")
+			w.Header().Set("X-Robots-Tag", "noindex, nofollow")
+			w.Write(testPDF("Private", "Ada", "Secret"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL)
+	job, err := NewRegistry().Create(CrawlRequest{URL: srv.URL + "/", Domain: u.Host, Robots: RobotsRespect, Documents: []string{DocumentPDF}})
+	if err != nil {
+		t.Fatalf("Unexpected error creating job: %s", err)
+	}
+
+	sink := &documentSink{docs: make(map[string]RenderedPage)}
+	if err := Crawl(job.ctx, job, sink, nil, nil, logrus.New()); err != nil {
+		t.Fatalf("Unexpected error crawling: %s", err)
+	}
+
+	if _, ok := sink.docs[clients.DocumentID(srv.URL+"/private.pdf")]; ok {
+		t.Fatalf("the noindex PDF shouldn't be indexed")
+	}
+	if _, ok := sink.docs[clients.DocumentID(srv.URL+"/guide.pdf")]; !ok {
+		t.Fatalf("the PDF without robots rules should be indexed")
+	}
+	if stats := job.Status().Stats; stats.DocumentsExtracted != 1 || stats.PagesNoindex != 1 {
+		t.Fatalf("the noindex PDF should be counted as noindex: %+v", stats)
+	}
+}
@@ -0,0 +1,192 @@
+package crawler
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/cascadia"
+	"github.com/antchfx/htmlquery"
+	"github.com/antchfx/xpath"
+	"github.com/gocolly/colly"
+	"github.com/wambozi/elastic-webcrawler/m/pkg/clients"
+	"golang.org/x/net/html"
+)
+
+// Field represents a value extracted from every crawled page into a field of its document
+type Field struct {
+	// Selector is a CSS selector and XPath an XPath expression, only one of which may be set
+	Selector string `json:"selector,omitempty"`
+	XPath    string `json:"xpath,omitempty"`
+	// Attr extracts the attribute of the matched elements instead of their text
+	Attr string `json:"attr,omitempty"`
+	// Multi extracts every match as a list instead of only the first one
+	Multi bool `json:"multi,omitempty"`
+	// Regex is applied to every value, keeping its first capture group or the whole match if it
+	// has none. Values it doesn't match are dropped.
+	Regex string `json:"regex,omitempty"`
+}
+
+// fieldName is the form of extracted field names, which App Search also requires
+var fieldName = regexp.MustCompile(`^[a-z][a-z0-9_]{0,63}$`)
+
+// extractedField represents a compiled field of an extraction spec
+type extractedField struct {
+	name     string
+	attr     string
+	multi    bool
+	selector cascadia.Selector
+	xpath    *xpath.Expr
+	regex    *regexp.Regexp
+}
+
+// Extraction extracts the fields of a crawl request's extraction spec from its pages
+type Extraction struct {
+	fields []extractedField
+}
+
+// CompileExtraction compiles the fields of a crawl request, keyed by the name of the document field
+// they are extracted into
+func CompileExtraction(fields map[string]Field) (*Extraction, error) {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	x := &Extraction{}
+	for _, name := range names {
+		f := fields[name]
+		if !fieldName.MatchString(name) {
+			return nil, fmt.Errorf("Field: %s must be lowercase letters, digits and underscores, starting with a letter", name)
+		}
+		if clients.IsReservedField(name) {
+			return nil, fmt.Errorf("Field: %s is already a field of every document", name)
+		}
+		if (f.Selector == "") == (f.XPath == "") {
+			return nil, fmt.Errorf("Field: %s must have either a 'selector' or an 'xpath'", name)
+		}
+
+		field := extractedField{name: name, attr: f.Attr, multi: f.Multi}
+		var err error
+		if f.Selector != "" {
+			if field.selector, err = cascadia.Compile(f.Selector); err != nil {
+				return nil, fmt.Errorf("Field: %s selector %s is not a valid CSS selector: %w", name, f.Selector, err)
+			}
+		} else if field.xpath, err = xpath.Compile(f.XPath); err != nil {
+			return nil, fmt.Errorf("Field: %s xpath %s is not a valid XPath expression: %w", name, f.XPath, err)
+		}
+		if f.Regex != "" {
+			if field.regex, err = regexp.Compile(f.Regex); err != nil {
+				return nil, fmt.Errorf("Field: %s regex %s is not a valid regular expression: %w", name, f.Regex, err)
+			}
+		}
+
+		x.fields = append(x.fields, field)
+	}
+
+	return x, nil
+}
+
+// extract returns the fields found on the page, a string for single valued fields and a list of
+// strings for multi valued ones. Fields without a value are left out.
+func (x *Extraction) extract(e *colly.HTMLElement) map[string]interface{} {
+	if x == nil || len(x.fields) == 0 || len(e.DOM.Nodes) == 0 {
+		return nil
+	}
+
+	// Fields are extracted from the whole document, not only the element the callback matched
+	root := e.DOM.Nodes[0]
+	for root.Parent != nil {
+		root = root.Parent
+	}
+
+	fields := make(map[string]interface{})
+	for _, f := range x.fields {
+		var values []string
+		for _, v := range f.values(root) {
+			if v = f.process(v); v != "" {
+				values = append(values, v)
+			}
+			if len(values) > 0 && !f.multi {
+				break
+			}
+		}
+
+		switch {
+		case len(values) == 0:
+		case f.multi:
+			fields[f.name] = values
+		default:
+			fields[f.name] = values[0]
+		}
+	}
+
+	if len(fields) == 0 {
+		return nil
+	}
+	return fields
+}
+
+// values returns the raw values the field matches in the document
+func (f extractedField) values(root *html.Node) (values []string) {
+	if f.selector != nil {
+		for _, n := range f.selector.MatchAll(root) {
+			values = append(values, f.nodeValue(n, htmlquery.InnerText(n)))
+		}
+		return values
+	}
+
+	// XPath expressions may select nodes or evaluate to a single value, e.g. "string(//title)"
+	switch v := f.xpath.Evaluate(htmlquery.CreateXPathNavigator(root)).(type) {
+	case *xpath.NodeIterator:
+		for v.MoveNext() {
+			nav := v.Current().(*htmlquery.NodeNavigator)
+			values = append(values, f.nodeValue(nav.Current(), nav.Value()))
+		}
+	case string:
+		values = append(values, v)
+	case float64:
+		values = append(values, strconv.FormatFloat(v, 'f', -1, 64))
+	case bool:
+		values = append(values, strconv.FormatBool(v))
+	}
+
+	return values
+}
+
+// nodeValue returns the attribute of the node if the field extracts one, otherwise its text
+func (f extractedField) nodeValue(n *html.Node, text string) string {
+	if f.attr == "" {
+		return text
+	}
+	if n.Type != html.ElementNode {
+		return ""
+	}
+	for _, a := range n.Attr {
+		if strings.EqualFold(a.Key, f.attr) {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// process trims the value and applies the field's regular expression to it
+func (f extractedField) process(v string) string {
+	v = strings.TrimSpace(v)
+	if f.regex == nil || v == "" {
+		return v
+	}
+
+	m := f.regex.FindStringSubmatch(v)
+	switch {
+	case m == nil:
+		return ""
+	case len(m) > 1:
+		return strings.TrimSpace(m[1])
+	default:
+		return strings.TrimSpace(m[0])
+	}
+}
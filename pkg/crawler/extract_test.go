@@ -0,0 +1,86 @@
+package crawler
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/sirupsen/logrus"
+)
+
+func TestCompileExtraction(t *testing.T) {
+	tests := map[string]struct {
+		fields map[string]Field
+		valid  bool
+	}{
+		"css":            {fields: map[string]Field{"price": {Selector: ".price", Regex: `\d+`}}, valid: true},
+		"xpath":          {fields: map[string]Field{"author": {XPath: "//meta[@name='author']/@content"}}, valid: true},
+		"none":           {valid: true},
+		"both":           {fields: map[string]Field{"price": {Selector: ".price", XPath: "//span"}}},
+		"neither":        {fields: map[string]Field{"price": {Attr: "content"}}},
+		"bad-selector":   {fields: map[string]Field{"price": {Selector: "div[["}}},
+		"bad-xpath":      {fields: map[string]Field{"price": {XPath: "//span[@"}}},
+		"bad-regex":      {fields: map[string]Field{"price": {Selector: ".price", Regex: "("}}},
+		"bad-name":       {fields: map[string]Field{"Price-Tag": {Selector: ".price"}}},
+		"reserved-name":  {fields: map[string]Field{"title": {Selector: "h1"}}},
+		"underscore-ok":  {fields: map[string]Field{"sale_price": {Selector: ".sale"}}, valid: true},
+		"leading-number": {fields: map[string]Field{"1price": {Selector: ".price"}}},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := CompileExtraction(tc.fields)
+			if (err == nil) != tc.valid {
+				t.Fatalf("valid - expected : %t, received error : %v", tc.valid, err)
+			}
+		})
+	}
+}
+
+func TestCrawlExtraction(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<html><head><meta name="author" content="Jane Doe"></head><body>
+			<span class="price">Price: $42 </span>
+			<ul><li><a class="tag" href="/tags/go">Go</a></li><li><a class="tag" href="/tags/search">Search</a></li></ul>
+		</body></html>`)
+	}))
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL)
+	job, err := NewRegistry().Create(CrawlRequest{URL: srv.URL + "/", Domain: u.Host, MaxDepth: 1, Extract: map[string]Field{
+		"price":     {Selector: ".price", Regex: `\$(\d+)`},
+		"tags":      {Selector: "a.tag", Multi: true},
+		"tag_links": {Selector: "a.tag", Attr: "href", Multi: true},
+		"author":    {XPath: "//meta[@name='author']/@content"},
+		"items":     {XPath: "count(//li)"},
+		"missing":   {Selector: ".discount"},
+	}})
+	if err != nil {
+		t.Fatalf("Unexpected error creating job: %s", err)
+	}
+
+	sink := &documentSink{docs: make(map[string]RenderedPage)}
+	if err := Crawl(job.ctx, job, sink, nil, nil, logrus.New()); err != nil {
+		t.Fatalf("Unexpected error crawling: %s", err)
+	}
+	if len(sink.docs) != 1 {
+		t.Fatalf("expected 1 document, received %d", len(sink.docs))
+	}
+
+	want := map[string]interface{}{
+		"price":     "42",
+		"tags":      []string{"Go", "Search"},
+		"tag_links": []string{"/tags/go", "/tags/search"},
+		"author":    "Jane Doe",
+		"items":     "2",
+	}
+	for _, doc := range sink.docs {
+		if diff := cmp.Diff(want, doc.Fields); diff != "" {
+			t.Fatalf(diff)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package crawler
+
+import (
+	"mime"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/gocolly/colly"
+	"github.com/wambozi/elastic-webcrawler/m/pkg/clients"
+)
+
+// MaxPageImages is the most images kept per page
+const MaxPageImages = 100
+
+// Image represents an image of a page, as written to every sink
+type Image = clients.Image
+
+// extractImages returns the images of the page with their alt text, title, caption and declared
+// dimensions, resolving their URLs against the page. Inline images and tracking pixels are left out.
+func extractImages(e *colly.HTMLElement, doc *goquery.Selection) (images []Image) {
+	found := make(map[string]bool)
+	doc.Find("img").EachWithBreak(func(_ int, s *goquery.Selection) bool {
+		src := imageSource(s)
+		if src == "" || strings.HasPrefix(strings.ToLower(src), "data:") {
+			return true
+		}
+		src = e.Request.AbsoluteURL(src)
+		if src == "" || found[src] {
+			return true
+		}
+
+		img := Image{
+			Src:     src,
+			Alt:     collapseSpace(s.AttrOr("alt", "")),
+			Title:   collapseSpace(s.AttrOr("title", "")),
+			Caption: imageCaption(s),
+			Width:   imageDimension(s.AttrOr("width", "")),
+			Height:  imageDimension(s.AttrOr("height", "")),
+		}
+		if img.Width == 1 && img.Height == 1 {
+			return true
+		}
+
+		found[src] = true
+		images = append(images, img)
+		return len(images) < MaxPageImages
+	})
+
+	return images
+}
+
+// imageSource returns the URL of the image, falling back to the attributes lazy loading scripts
+// read it from and to the first candidate of its srcset
+func imageSource(s *goquery.Selection) string {
+	for _, attr := range []string{"src", "data-src", "data-lazy-src", "data-original"} {
+		if src := strings.TrimSpace(s.AttrOr(attr, "")); src != "" && !strings.HasPrefix(src, "data:") {
+			return src
+		}
+	}
+	if fields := strings.Fields(s.AttrOr("srcset", "")); len(fields) > 0 {
+		return strings.TrimSuffix(fields[0], ",")
+	}
+	return strings.TrimSpace(s.AttrOr("src", ""))
+}
+
+// imageCaption returns the caption of the figure holding the image, if any
+func imageCaption(s *goquery.Selection) string {
+	figure := s.Closest("figure")
+	if figure.Length() == 0 {
+		return ""
+	}
+	return collapseSpace(figure.Find("figcaption").First().Text())
+}
+
+// imageDimension parses a width or height attribute such as "640" or "640px", returning 0 for
+// relative ones such as "50%"
+func imageDimension(v string) int {
+	n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSpace(v), "px"))
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// imagePage returns the document an image of the page is written to in the crawl's image index.
+// Images found on several pages are written once, with the first page they were found on.
+func imagePage(img Image, page RenderedPage) RenderedPage {
+	img.Page = page.URI
+
+	title := img.Title
+	if title == "" {
+		title = img.Alt
+	}
+
+	return RenderedPage{
+		ID:          clients.DocumentID(img.Src),
+		URI:         img.Src,
+		Meta:        Meta{Title: title, Desc: img.Alt},
+		BodyText:    img.Caption,
+		Language:    page.Language,
+		Site:        page.Site,
+		LastSeen:    page.LastSeen,
+		ContentType: imageContentType(img.Src),
+		Images:      []Image{img},
+	}
+}
+
+// imageContentType returns the media type of the image from the extension of its URL, or "image"
+// when it has none
+func imageContentType(src string) string {
+	u, err := url.Parse(src)
+	if err != nil {
+		return "image"
+	}
+	if t := mime.TypeByExtension(strings.ToLower(path.Ext(u.Path))); strings.HasPrefix(t, "image/") {
+		return t
+	}
+	return "image"
+}
@@ -0,0 +1,75 @@
+package crawler
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/sirupsen/logrus"
+	"github.com/wambozi/elastic-webcrawler/m/pkg/clients"
+)
+
+func TestCrawlImages(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		switch r.URL.Path {
+		case "/":
+			fmt.Fprint(w, `<html><body><p>home</p>
+<figure><a href="/big.png"><img src="/img/logo.png" alt=" The  logo " title="Logo" width="120px" height="40"></a><figcaption>Our <b>new</b> logo</figcaption></figure>
+<img data-src="lazy.jpg" src="data:image/gif;base64,R0lGODlhAQABAAAAACw=" alt="Lazy" width="50%">
+<img srcset="/img/photo-1x.webp 1x, /img/photo-2x.webp 2x" alt="">
+<img src="/pixel.gif" width="1" height="1">
+<img src="/img/logo.png" alt="Logo again">
+<a href="/about">about</a>
+</body></html>`)
+		case "/about":
+			fmt.Fprint(w, `<html><body><p>about</p><img src="/img/logo.png" alt="Logo on about"></body></html>`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL)
+	job, err := NewRegistry().Create(CrawlRequest{URL: srv.URL + "/", Domain: u.Host, MaxDepth: 2})
+	if err != nil {
+		t.Fatalf("Unexpected error creating job: %s", err)
+	}
+
+	sink := &documentSink{docs: make(map[string]RenderedPage)}
+	images := &documentSink{docs: make(map[string]RenderedPage)}
+	if err := Crawl(job.ctx, job, sink, images, nil, logrus.New()); err != nil {
+		t.Fatalf("Unexpected error crawling: %s", err)
+	}
+
+	logo := Image{Src: srv.URL + "/img/logo.png", Alt: "The logo", Title: "Logo", Caption: "Our new logo", Width: 120, Height: 40}
+	want := []Image{
+		logo,
+		{Src: srv.URL + "/lazy.jpg", Alt: "Lazy"},
+		{Src: srv.URL + "/img/photo-1x.webp"},
+	}
+	home := sink.docs[clients.DocumentID(srv.URL+"/")]
+	if diff := cmp.Diff(want, home.Images); diff != "" {
+		t.Fatalf(diff)
+	}
+
+	// Every image is written once, with the first page it was found on
+	logo.Page = srv.URL + "/"
+	doc, ok := images.docs[clients.DocumentID(logo.Src)]
+	if !ok {
+		t.Fatalf("the logo should be written to the image sink: %v", images.docs)
+	}
+	if diff := cmp.Diff([]Image{logo}, doc.Images); diff != "" {
+		t.Fatalf(diff)
+	}
+	if doc.URI != logo.Src || doc.ContentType != "image/png" || doc.Meta.Title != "Logo" || doc.BodyText != "Our new logo" {
+		t.Fatalf("the image document should describe the image: %+v", doc)
+	}
+
+	if len(images.docs) != 3 || job.Status().Stats.ImagesIndexed != 3 {
+		t.Fatalf("every distinct image should be indexed once: %d documents, %+v", len(images.docs), job.Status().Stats)
+	}
+}
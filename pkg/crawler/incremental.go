@@ -0,0 +1,309 @@
+package crawler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gocolly/colly"
+	"github.com/sirupsen/logrus"
+	"github.com/wambozi/elastic-webcrawler/m/pkg/clients"
+)
+
+// pageStates tracks the state of the crawled pages against the ones recorded by the previous crawl
+// of the same site and target, so incremental crawls can fetch them conditionally
+type pageStates struct {
+	store       clients.StateStore
+	target      string
+	site        string
+	incremental bool
+	seen        string
+
+	previous map[string]clients.PageState
+
+	mu      sync.Mutex
+	current map[string]clients.PageState
+	kept    map[string]bool
+	failed  map[string]bool
+}
+
+// stateTarget names the sink and index or engine the pages of the crawl are written to
+func stateTarget(cr CrawlRequest) string {
+	if cr.Type == "app-search" {
+		return cr.Type + "/" + cr.Engine
+	}
+	return cr.Type + "/" + cr.Index
+}
+
+// loadPageStates loads the states recorded by the previous crawl of the site when the crawl is
+// incremental. It returns nil when there is no store, and an empty set of states when the crawl
+// isn't incremental or they can't be loaded, so every page is fetched. Crawls that aren't
+// incremental only use it to forget the states of the pages they delete.
+func loadPageStates(ctx context.Context, job *Job, store clients.StateStore, seen time.Time, logger *logrus.Logger) *pageStates {
+	if store == nil {
+		return nil
+	}
+	u, err := url.Parse(job.Request.URL)
+	if err != nil {
+		return nil
+	}
+	site := u.Hostname()
+
+	ps := &pageStates{
+		store:       store,
+		target:      stateTarget(job.Request),
+		site:        site,
+		incremental: job.Request.Incremental,
+		seen:        seen.Format(clients.LastSeenLayout),
+		current:     make(map[string]clients.PageState),
+		kept:        make(map[string]bool),
+		failed:      make(map[string]bool),
+	}
+
+	if !ps.incremental {
+		return ps
+	}
+
+	previous, err := store.Load(ctx, ps.target, site)
+	if err != nil {
+		logger.Errorf("Failed to load the crawl state of %s, fetching every page: %v", site, err)
+		job.record(func(s *Stats) { s.Errors++ })
+		previous = nil
+	}
+	ps.previous = previous
+
+	return ps
+}
+
+// request makes the request conditional on the page having changed since the previous crawl
+func (ps *pageStates) request(r *colly.Request) {
+	if ps == nil || !ps.incremental {
+		return
+	}
+
+	prev, ok := ps.previous[r.URL.String()]
+	if !ok {
+		return
+	}
+	if prev.ETag != "" {
+		r.Headers.Set("If-None-Match", prev.ETag)
+	}
+	if prev.LastModified != "" {
+		r.Headers.Set("If-Modified-Since", prev.LastModified)
+	}
+}
+
+// response records the state of a fetched page, comparing its content with the previous crawl's
+func (ps *pageStates) response(job *Job, r *colly.Response) {
+	if ps == nil || !ps.incremental {
+		return
+	}
+
+	uri := r.Request.URL.String()
+	sum := sha256.Sum256(r.Body)
+	state := clients.PageState{
+		Target:       ps.target,
+		Site:         ps.site,
+		URI:          uri,
+		ETag:         r.Headers.Get("ETag"),
+		LastModified: r.Headers.Get("Last-Modified"),
+		ContentHash:  hex.EncodeToString(sum[:]),
+		Updated:      ps.seen,
+	}
+
+	prev, existed := ps.previous[uri]
+	unchanged := existed && prev.ContentHash == state.ContentHash
+	if unchanged {
+		state.DocumentID = prev.DocumentID
+	}
+
+	ps.mu.Lock()
+	ps.current[uri] = state
+	ps.mu.Unlock()
+
+	switch {
+	case !existed:
+		job.record(func(s *Stats) { s.PagesNew++ })
+	case unchanged:
+		job.record(func(s *Stats) { s.PagesUnchanged++ })
+	default:
+		job.record(func(s *Stats) { s.PagesChanged++ })
+	}
+
+	if unchanged {
+		ps.keep(uri)
+	}
+}
+
+// notModified handles a 304 response to a conditional request, keeping the page's previous state.
+// It returns the links the page had, which are followed again as the response has no body.
+func (ps *pageStates) notModified(job *Job, r *colly.Response) (links []string, ok bool) {
+	if ps == nil || r.StatusCode != http.StatusNotModified {
+		return nil, false
+	}
+
+	uri := r.Request.URL.String()
+	prev, existed := ps.previous[uri]
+	if !existed {
+		return nil, false
+	}
+
+	// Servers may only send the validators that changed
+	if etag := r.Headers.Get("ETag"); etag != "" {
+		prev.ETag = etag
+	}
+	if modified := r.Headers.Get("Last-Modified"); modified != "" {
+		prev.LastModified = modified
+	}
+	prev.Updated = ps.seen
+
+	ps.mu.Lock()
+	ps.current[uri] = prev
+	ps.mu.Unlock()
+	ps.keep(uri)
+
+	job.record(func(s *Stats) {
+		s.PagesVisited++
+		s.PagesUnchanged++
+	})
+
+	return prev.Links, true
+}
+
+// unchanged reports whether the sink already holds the page of the response, so it isn't rewritten.
+// The response context is shared with the pages it links to, so this is tracked by URI instead.
+func (ps *pageStates) unchanged(r *colly.Response) bool {
+	if ps == nil {
+		return false
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.kept[r.Request.URL.String()]
+}
+
+// keep marks the page as left as it is in the sink
+func (ps *pageStates) keep(uri string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.kept[uri] = true
+}
+
+// document records the ID of the document the page was written to
+func (ps *pageStates) document(r *colly.Request, id string) {
+	if ps == nil {
+		return
+	}
+
+	uri := r.URL.String()
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if state, ok := ps.current[uri]; ok {
+		state.DocumentID = id
+		ps.current[uri] = state
+	}
+}
+
+// documentID returns the ID of the document holding the page of the request
+func (ps *pageStates) documentID(r *colly.Request) string {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return stateDocumentID(ps.current[r.URL.String()])
+}
+
+// link records a link found on the page
+func (ps *pageStates) link(r *colly.Request, link string) {
+	if ps == nil {
+		return
+	}
+
+	uri := r.URL.String()
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if state, ok := ps.current[uri]; ok {
+		state.Links = append(state.Links, link)
+		ps.current[uri] = state
+	}
+}
+
+// fail forgets the pages with the document IDs, which the sink failed to write
+func (ps *pageStates) fail(ids []string) {
+	if ps == nil || len(ids) == 0 {
+		return
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for _, id := range ids {
+		ps.failed[id] = true
+	}
+}
+
+// keptIDs returns the document IDs of the pages left as they are in the sink
+func (ps *pageStates) keptIDs() []string {
+	if ps == nil {
+		return nil
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	ids := make([]string, 0, len(ps.kept))
+	for uri := range ps.kept {
+		ids = append(ids, stateDocumentID(ps.current[uri]))
+	}
+
+	return ids
+}
+
+// save stores the states of the pages the sink holds. Pages it failed to write keep their previous
+// state, so they are fetched again by the next incremental crawl. Crawls that aren't incremental
+// save nothing.
+func (ps *pageStates) save(ctx context.Context, job *Job, logger *logrus.Logger) {
+	if ps == nil || !ps.incremental {
+		return
+	}
+
+	ps.mu.Lock()
+	states := make([]clients.PageState, 0, len(ps.current))
+	for _, state := range ps.current {
+		if !ps.failed[stateDocumentID(state)] {
+			states = append(states, state)
+		}
+	}
+	ps.mu.Unlock()
+
+	if err := ps.store.Save(ctx, states); err != nil {
+		logger.Errorf("Failed to save the crawl state of %s: %v", ps.site, err)
+		job.record(func(s *Stats) { s.Errors++ })
+		return
+	}
+	logger.Infof("Saved the crawl state of %d pages of %s", len(states), ps.site)
+}
+
+// forget deletes the states of the pages the crawl didn't find, once the sink no longer holds them
+func (ps *pageStates) forget(ctx context.Context, job *Job, before time.Time, logger *logrus.Logger) {
+	if ps == nil {
+		return
+	}
+
+	if err := ps.store.Delete(ctx, ps.target, ps.site, before); err != nil {
+		logger.Errorf("Failed to delete the stale crawl state of %s: %v", ps.site, err)
+		job.record(func(s *Stats) { s.Errors++ })
+	}
+}
+
+// stateDocumentID returns the ID of the document the page of the state was written to. States saved
+// before document IDs were recorded use the ID of the page's URI.
+func stateDocumentID(state clients.PageState) string {
+	if state.DocumentID != "" {
+		return state.DocumentID
+	}
+	return clients.DocumentID(state.URI)
+}
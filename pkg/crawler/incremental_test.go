@@ -0,0 +1,168 @@
+package crawler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/sirupsen/logrus"
+	"github.com/wambozi/elastic-webcrawler/m/pkg/clients"
+)
+
+// memoryStateStore keeps page states in memory, keyed by target and URI
+type memoryStateStore struct {
+	states map[string]clients.PageState
+}
+
+func (s *memoryStateStore) Load(ctx context.Context, target, site string) (map[string]clients.PageState, error) {
+	states := make(map[string]clients.PageState)
+	for _, state := range s.states {
+		if state.Target == target && state.Site == site {
+			states[state.URI] = state
+		}
+	}
+	return states, nil
+}
+
+func (s *memoryStateStore) Save(ctx context.Context, states []clients.PageState) error {
+	for _, state := range states {
+		s.states[state.Target+" "+state.URI] = state
+	}
+	return nil
+}
+
+func (s *memoryStateStore) Delete(ctx context.Context, target, site string, before time.Time) error {
+	for key, state := range s.states {
+		if updated, _ := time.Parse(clients.LastSeenLayout, state.Updated); state.Target == target && state.Site == site && updated.Before(before) {
+			delete(s.states, key)
+		}
+	}
+	return nil
+}
+
+// writingSink records the URIs of the pages written to it
+type writingSink struct {
+	mu      sync.Mutex
+	written []string
+}
+
+func (s *writingSink) Write(ctx context.Context, page RenderedPage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.written = append(s.written, page.URI)
+	return nil
+}
+
+func (s *writingSink) Flush(ctx context.Context) error { return nil }
+func (s *writingSink) Close(ctx context.Context) error { return nil }
+
+func TestCrawlIncremental(t *testing.T) {
+	// The first page answers conditional requests, the second has no validators but doesn't change,
+	// the third changes between crawls and then links to a new fourth page
+	var (
+		version     int
+		notModified int
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		switch r.URL.Path {
+		case "/0":
+			if r.Header.Get("If-None-Match") == `"v0"` {
+				notModified++
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", `"v0"`)
+			fmt.Fprint(w, `<html><body><p>page 0</p><a href="/1">next</a></body></html>`)
+		case "/1":
+			fmt.Fprint(w, `<html><body><p>page 1</p><a href="/2">next</a></body></html>`)
+		case "/2":
+			if version == 0 {
+				fmt.Fprint(w, `<html><body><p>page 2</p></body></html>`)
+				return
+			}
+			fmt.Fprint(w, `<html><body><p>page 2, updated</p><a href="/3">next</a></body></html>`)
+		case "/3":
+			fmt.Fprint(w, `<html><body><p>page 3</p></body></html>`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL)
+	store := &memoryStateStore{states: make(map[string]clients.PageState)}
+
+	crawl := func(t *testing.T) (*writingSink, Stats) {
+		job, err := NewRegistry().Create(CrawlRequest{URL: srv.URL + "/0", Domain: u.Host, Type: "elasticsearch", Index: "test", Incremental: true})
+		if err != nil {
+			t.Fatalf("Unexpected error creating job: %s", err)
+		}
+
+		sink := &writingSink{}
+		if err := Crawl(job.ctx, job, sink, nil, store, logrus.New()); err != nil {
+			t.Fatalf("Unexpected error crawling: %s", err)
+		}
+		sort.Strings(sink.written)
+
+		return sink, job.Status().Stats
+	}
+
+	sink, stats := crawl(t)
+	if len(sink.written) != 3 || stats.PagesNew != 3 || stats.PagesChanged != 0 || stats.PagesUnchanged != 0 {
+		t.Fatalf("the first crawl should write every page as new: %v, %+v", sink.written, stats)
+	}
+	if len(store.states) != 3 || store.states["elasticsearch/test "+srv.URL+"/0"].ETag != `"v0"` {
+		t.Fatalf("the first crawl should save the state of every page: %+v", store.states)
+	}
+
+	version = 1
+	sink, stats = crawl(t)
+
+	if notModified != 1 {
+		t.Fatalf("the first page should be fetched conditionally: %d", notModified)
+	}
+	if diff := cmp.Diff([]string{srv.URL + "/2", srv.URL + "/3"}, sink.written); diff != "" {
+		t.Fatalf("only the changed and new pages should be written: %s", diff)
+	}
+	if stats.PagesVisited != 4 || stats.PagesNew != 1 || stats.PagesChanged != 1 || stats.PagesUnchanged != 2 {
+		t.Fatalf("unexpected incremental crawl stats: %+v", stats)
+	}
+	if len(store.states) != 4 {
+		t.Fatalf("the second crawl should add the state of the new page: %+v", store.states)
+	}
+}
+
+func TestCrawlNotIncremental(t *testing.T) {
+	srv := newChainServer(2)
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL)
+	job, err := NewRegistry().Create(CrawlRequest{URL: srv.URL + "/0", Domain: u.Host, Type: "elasticsearch", Index: "test"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating job: %s", err)
+	}
+
+	// A state left by an earlier incremental crawl isn't used to skip the page
+	store := &memoryStateStore{states: map[string]clients.PageState{
+		"elasticsearch/test " + srv.URL + "/0": {Target: "elasticsearch/test", Site: u.Hostname(), URI: srv.URL + "/0", ETag: `"v0"`},
+	}}
+	sink := &writingSink{}
+	if err := Crawl(job.ctx, job, sink, nil, store, logrus.New()); err != nil {
+		t.Fatalf("Unexpected error crawling: %s", err)
+	}
+
+	if len(sink.written) != 2 {
+		t.Fatalf("every page should be written: %v", sink.written)
+	}
+	if len(store.states) != 1 || store.states["elasticsearch/test "+srv.URL+"/0"].ContentHash != "" {
+		t.Fatalf("the crawl shouldn't save any state: %+v", store.states)
+	}
+}
@@ -0,0 +1,304 @@
+package crawler
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
+	"sync"
+	"time"
+)
+
+// State represents the lifecycle state of a crawl job
+type State string
+
+const (
+	// StateRunning is the state of a crawl that has been accepted and is still visiting pages
+	StateRunning State = "running"
+	// StateCompleted is the state of a crawl that visited every reachable page
+	StateCompleted State = "completed"
+	// StateFailed is the state of a crawl that stopped because of an unrecoverable error
+	StateFailed State = "failed"
+	// StateCancelling is the state of a crawl asked to stop through DELETE /crawls/{id} that
+	// hasn't stopped yet
+	StateCancelling State = "cancelling"
+	// StateCancelled is the state of a crawl that was stopped through DELETE /crawls/{id}
+	StateCancelled State = "cancelled"
+)
+
+// Limit names the crawl scope limit that stopped a crawl early
+type Limit string
+
+const (
+	// LimitMaxDepth is reported when links were skipped because they were deeper than max_depth
+	LimitMaxDepth Limit = "max_depth"
+	// LimitMaxPages is reported when the crawl stopped after visiting max_pages pages
+	LimitMaxPages Limit = "max_pages"
+	// LimitMaxDuration is reported when the crawl stopped after running for max_duration
+	LimitMaxDuration Limit = "max_duration"
+)
+
+// Stats represents the counters collected while a crawl runs
+type Stats struct {
+	PagesVisited    int `json:"pages_visited"`
+	PagesIndexed    int `json:"pages_indexed"`
+	PagesNoindex    int `json:"pages_noindex,omitempty"`
+	PagesDisallowed int `json:"pages_disallowed,omitempty"`
+	Errors          int `json:"errors"`
+	Retries         int `json:"retries,omitempty"`
+	GaveUp          int `json:"gave_up,omitempty"`
+	Warnings        int `json:"warnings,omitempty"`
+	PagesStale      int `json:"pages_stale,omitempty"`
+	PagesPruned     int `json:"pages_pruned,omitempty"`
+	PagesNew        int `json:"pages_new,omitempty"`
+	PagesChanged    int `json:"pages_changed,omitempty"`
+	PagesUnchanged  int `json:"pages_unchanged,omitempty"`
+	PagesDuplicate  int `json:"pages_duplicate,omitempty"`
+
+	// DocumentsExtracted counts the linked documents, such as PDFs, whose text was extracted
+	DocumentsExtracted int `json:"documents_extracted,omitempty"`
+
+	// ImagesIndexed counts the images written to the crawl's image index
+	ImagesIndexed int `json:"images_indexed,omitempty"`
+
+	// PagesLinked counts the documents whose inlinks and anchor text were written once the crawl was over
+	PagesLinked int `json:"pages_linked,omitempty"`
+
+	// RejectedURLs counts the distinct links not followed because of each include or exclude pattern
+	RejectedURLs map[string]int `json:"rejected_urls,omitempty"`
+
+	// StaleURLs lists some of the pages pruning deleted, or would delete in a dry run
+	StaleURLs []string `json:"stale_urls,omitempty"`
+}
+
+// JobStatus represents the point in time status of a crawl job returned by the /crawls routes
+type JobStatus struct {
+	ID        string     `json:"id"`
+	State     State      `json:"state"`
+	URL       string     `json:"url"`
+	Type      string     `json:"type"`
+	Index     string     `json:"index,omitempty"`
+	Engine    string     `json:"engine,omitempty"`
+	StartTime time.Time  `json:"start_time"`
+	EndTime   *time.Time `json:"end_time,omitempty"`
+	Stats     Stats      `json:"stats"`
+	Limit     Limit      `json:"limit_reached,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// Job represents a single crawl tracked by the Registry
+type Job struct {
+	ID      string
+	Request CrawlRequest
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu        sync.RWMutex
+	state     State
+	startTime time.Time
+	endTime   time.Time
+	stats     Stats
+	limit     Limit
+	err       string
+
+	report *crawlReport
+}
+
+// Status returns a snapshot of the job that is safe to serialize
+func (j *Job) Status() JobStatus {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+
+	status := JobStatus{
+		ID:        j.ID,
+		State:     j.state,
+		URL:       j.Request.URL,
+		Type:      j.Request.Type,
+		Index:     j.Request.Index,
+		Engine:    j.Request.Engine,
+		StartTime: j.startTime,
+		Stats:     j.stats,
+		Limit:     j.limit,
+		Error:     j.err,
+	}
+
+	if j.stats.RejectedURLs != nil {
+		status.Stats.RejectedURLs = make(map[string]int, len(j.stats.RejectedURLs))
+		for rule, n := range j.stats.RejectedURLs {
+			status.Stats.RejectedURLs[rule] = n
+		}
+	}
+
+	if j.stats.StaleURLs != nil {
+		status.Stats.StaleURLs = append([]string(nil), j.stats.StaleURLs...)
+	}
+
+	if !j.endTime.IsZero() {
+		end := j.endTime
+		status.EndTime = &end
+	}
+
+	return status
+}
+
+// Report returns a snapshot of the links of the job that failed, were redirected or were slow
+func (j *Job) Report() Report {
+	return j.report.snapshot()
+}
+
+// Cancel asks a running job to stop, moving it to the cancelling state until it has. It returns
+// false if the job has already finished or is being cancelled.
+func (j *Job) Cancel() bool {
+	j.mu.Lock()
+	running := j.state == StateRunning
+	if running {
+		j.state = StateCancelling
+	}
+	j.mu.Unlock()
+
+	if running {
+		j.cancel()
+	}
+
+	return running
+}
+
+// record applies f to the job's stats while holding the job lock
+func (j *Job) record(f func(s *Stats)) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	f(&j.stats)
+}
+
+// reachLimit records the first scope limit that cut the crawl short
+func (j *Job) reachLimit(l Limit) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.limit == "" {
+		j.limit = l
+	}
+}
+
+// finish moves the job into a final state and stamps its end time
+func (j *Job) finish(s State, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	// Release the context so anything still watching it stops
+	defer j.cancel()
+
+	j.state = s
+	j.endTime = time.Now().UTC()
+	if err != nil {
+		j.err = err.Error()
+	}
+}
+
+// ended returns the time the job finished, and false while it is still running
+func (j *Job) ended() (time.Time, bool) {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	return j.endTime, !j.endTime.IsZero()
+}
+
+// FinishedJobs is the number of finished jobs the Registry keeps. Older finished jobs are
+// forgotten as new ones are created, so their status and report are no longer available.
+const FinishedJobs = 100
+
+// Registry keeps track of the running crawl jobs and the most recently finished ones
+type Registry struct {
+	mu   sync.RWMutex
+	jobs map[string]*Job
+	keep int
+}
+
+// NewRegistry returns an empty job registry keeping FinishedJobs finished jobs
+func NewRegistry() *Registry {
+	return &Registry{jobs: make(map[string]*Job), keep: FinishedJobs}
+}
+
+// Create registers a new running job for the crawl request and returns it
+func (r *Registry) Create(cr CrawlRequest) (*Job, error) {
+	id, err := newJobID()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &Job{
+		ID:        id,
+		Request:   cr,
+		ctx:       ctx,
+		cancel:    cancel,
+		state:     StateRunning,
+		startTime: time.Now().UTC(),
+		report:    newCrawlReport(),
+	}
+
+	r.mu.Lock()
+	r.jobs[id] = job
+	r.forget()
+	r.mu.Unlock()
+
+	return job, nil
+}
+
+// forget removes the jobs that finished first until at most keep finished jobs are left. It must
+// be called with the lock held.
+func (r *Registry) forget() {
+	type finished struct {
+		id  string
+		end time.Time
+	}
+
+	var jobs []finished
+	for id, job := range r.jobs {
+		if end, ok := job.ended(); ok {
+			jobs = append(jobs, finished{id: id, end: end})
+		}
+	}
+	if len(jobs) <= r.keep {
+		return
+	}
+
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].end.Before(jobs[j].end)
+	})
+	for _, job := range jobs[:len(jobs)-r.keep] {
+		delete(r.jobs, job.id)
+	}
+}
+
+// Get returns the job with the given ID, if it exists
+func (r *Registry) Get(id string) (*Job, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	job, ok := r.jobs[id]
+	return job, ok
+}
+
+// List returns the status of every job, oldest first
+func (r *Registry) List() []JobStatus {
+	r.mu.RLock()
+	statuses := make([]JobStatus, 0, len(r.jobs))
+	for _, job := range r.jobs {
+		statuses = append(statuses, job.Status())
+	}
+	r.mu.RUnlock()
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].StartTime.Before(statuses[j].StartTime)
+	})
+
+	return statuses
+}
+
+// newJobID returns a random hex encoded identifier for a crawl job
+func newJobID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,162 @@
+package crawler
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRegistry(t *testing.T) {
+	jobs := NewRegistry()
+	cr := CrawlRequest{Index: "test", URL: "https://www.example.com", Type: "elasticsearch"}
+
+	first, err := jobs.Create(cr)
+	if err != nil {
+		t.Fatalf("Unexpected error creating job: %s", err)
+	}
+	second, err := jobs.Create(cr)
+	if err != nil {
+		t.Fatalf("Unexpected error creating job: %s", err)
+	}
+
+	if first.ID == second.ID {
+		t.Fatalf("job ids should be unique, both were %s", first.ID)
+	}
+
+	got, ok := jobs.Get(first.ID)
+	if !ok || got != first {
+		t.Fatalf("expected to find job %s", first.ID)
+	}
+
+	if _, ok := jobs.Get("missing"); ok {
+		t.Fatal("expected no job for an unknown id")
+	}
+
+	var ids []string
+	for _, s := range jobs.List() {
+		ids = append(ids, s.ID)
+	}
+	if diff := cmp.Diff([]string{first.ID, second.ID}, ids); diff != "" {
+		t.Fatalf(diff)
+	}
+}
+
+func TestRegistryForgetsFinishedJobs(t *testing.T) {
+	jobs := NewRegistry()
+	jobs.keep = 2
+	cr := CrawlRequest{Index: "test", URL: "https://www.example.com", Type: "elasticsearch"}
+
+	running, err := jobs.Create(cr)
+	if err != nil {
+		t.Fatalf("Unexpected error creating job: %s", err)
+	}
+
+	var finished []*Job
+	for i := 0; i < 3; i++ {
+		job, err := jobs.Create(cr)
+		if err != nil {
+			t.Fatalf("Unexpected error creating job: %s", err)
+		}
+		job.finish(StateCompleted, nil)
+		job.endTime = job.endTime.Add(time.Duration(i) * time.Second)
+		finished = append(finished, job)
+	}
+
+	// The jobs are only forgotten when the next one is created
+	last, err := jobs.Create(cr)
+	if err != nil {
+		t.Fatalf("Unexpected error creating job: %s", err)
+	}
+
+	var ids []string
+	for _, s := range jobs.List() {
+		ids = append(ids, s.ID)
+	}
+	if diff := cmp.Diff([]string{running.ID, finished[1].ID, finished[2].ID, last.ID}, ids); diff != "" {
+		t.Fatalf("the running jobs and the last finished ones should be kept: %s", diff)
+	}
+	if _, ok := jobs.Get(finished[0].ID); ok {
+		t.Fatalf("expected job %s to be forgotten", finished[0].ID)
+	}
+}
+
+func TestJobStatus(t *testing.T) {
+	jobs := NewRegistry()
+	job, err := jobs.Create(CrawlRequest{Engine: "test", URL: "https://www.example.com", Type: "app-search"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating job: %s", err)
+	}
+
+	job.record(func(s *Stats) {
+		s.PagesVisited += 3
+		s.PagesIndexed += 2
+		s.Errors++
+	})
+
+	status := job.Status()
+	if status.State != StateRunning || status.EndTime != nil {
+		t.Fatalf("new job should be running without an end time: %+v", status)
+	}
+
+	job.finish(StateFailed, errors.New("boom"))
+
+	status = job.Status()
+	want := JobStatus{
+		ID:        job.ID,
+		State:     StateFailed,
+		URL:       "https://www.example.com",
+		Type:      "app-search",
+		Engine:    "test",
+		StartTime: status.StartTime,
+		EndTime:   status.EndTime,
+		Stats:     Stats{PagesVisited: 3, PagesIndexed: 2, Errors: 1},
+		Error:     "boom",
+	}
+
+	if diff := cmp.Diff(want, status); diff != "" {
+		t.Fatalf(diff)
+	}
+
+	if status.EndTime == nil || status.EndTime.Before(status.StartTime) {
+		t.Fatalf("finished job should have an end time after its start time: %+v", status)
+	}
+}
+
+func TestJobCancel(t *testing.T) {
+	jobs := NewRegistry()
+	job, err := jobs.Create(CrawlRequest{Index: "test", URL: "https://www.example.com", Type: "elasticsearch"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating job: %s", err)
+	}
+
+	if job.ctx.Err() != nil {
+		t.Fatal("new job context should not be done")
+	}
+
+	if !job.Cancel() {
+		t.Fatal("running job should accept cancellation")
+	}
+
+	if job.ctx.Err() != context.Canceled {
+		t.Fatalf("cancelled job context error - expected : %v, received : %v", context.Canceled, job.ctx.Err())
+	}
+	if status := job.Status(); status.State != StateCancelling || status.EndTime != nil {
+		t.Fatalf("job should be cancelling until it has stopped: %+v", status)
+	}
+	if job.Cancel() {
+		t.Fatal("cancelling job should not accept cancellation again")
+	}
+
+	job.finish(StateCancelled, nil)
+
+	if job.Cancel() {
+		t.Fatal("finished job should not accept cancellation")
+	}
+
+	if status := job.Status(); status.State != StateCancelled || status.EndTime == nil {
+		t.Fatalf("cancelled job should be cancelled with an end time: %+v", status)
+	}
+}
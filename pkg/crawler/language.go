@@ -0,0 +1,122 @@
+package crawler
+
+import (
+	"strings"
+	"unicode"
+)
+
+// minDetectLetters is the fewest letters the text fallback needs before guessing a language
+const minDetectLetters = 20
+
+// stopwords are frequent words used to tell apart languages written in the Latin script
+var stopwords = map[string][]string{
+	"en": {"the", "and", "of", "to", "is", "in", "that", "for", "with", "it", "on", "are", "this", "you", "be"},
+	"fr": {"le", "la", "les", "et", "des", "est", "une", "du", "que", "pour", "dans", "qui", "sur", "pas", "au"},
+	"de": {"der", "die", "und", "das", "ist", "nicht", "mit", "den", "ein", "eine", "zu", "auf", "sich", "dem", "für"},
+	"es": {"el", "los", "las", "y", "que", "es", "por", "una", "del", "con", "para", "se", "como", "su", "al"},
+}
+
+// detectLanguage returns the primary language subtag of a page, e.g. "en" or "ja", from the lang
+// attribute of its <html> element, then its Content-Language header, then the text itself.
+// It returns "" if the language can't be told.
+func detectLanguage(htmlLang, contentLanguage, text string) string {
+	if lang := primaryLanguage(htmlLang); lang != "" {
+		return lang
+	}
+
+	// Content-Language may list several languages, the first is taken as the main one
+	if lang := primaryLanguage(strings.Split(contentLanguage, ",")[0]); lang != "" {
+		return lang
+	}
+
+	return detectTextLanguage(text)
+}
+
+// primaryLanguage returns the lowercased primary subtag of a language tag such as "en-US" or "zh_Hant"
+func primaryLanguage(tag string) string {
+	tag = strings.TrimSpace(tag)
+	if i := strings.IndexAny(tag, "-_"); i >= 0 {
+		tag = tag[:i]
+	}
+	tag = strings.ToLower(tag)
+
+	if len(tag) < 2 || len(tag) > 3 {
+		return ""
+	}
+	for _, r := range tag {
+		if r < 'a' || r > 'z' {
+			return ""
+		}
+	}
+
+	return tag
+}
+
+// detectTextLanguage guesses the language of text from the scripts its letters are written in and,
+// for the Latin script, from how often it uses the stopwords of each language
+func detectTextLanguage(text string) string {
+	var letters, han, kana, hangul, latin int
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		letters++
+		switch {
+		case unicode.Is(unicode.Hiragana, r) || unicode.Is(unicode.Katakana, r):
+			kana++
+		case unicode.Is(unicode.Hangul, r):
+			hangul++
+		case unicode.Is(unicode.Han, r):
+			han++
+		case unicode.Is(unicode.Latin, r):
+			latin++
+		}
+	}
+
+	if letters < minDetectLetters {
+		return ""
+	}
+
+	// Japanese mixes kana with Han characters, so any noticeable amount of kana makes text Japanese
+	if cjk := han + kana + hangul; cjk*2 >= letters {
+		switch {
+		case kana*10 >= cjk:
+			return "ja"
+		case hangul >= han:
+			return "ko"
+		default:
+			return "zh"
+		}
+	}
+
+	if latin*2 < letters {
+		return ""
+	}
+
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+	counts := make(map[string]int, len(words))
+	for _, w := range words {
+		counts[w]++
+	}
+
+	var best string
+	var bestHits int
+	for _, lang := range []string{"en", "fr", "de", "es"} {
+		var hits int
+		for _, w := range stopwords[lang] {
+			hits += counts[w]
+		}
+		if hits > bestHits {
+			best, bestHits = lang, hits
+		}
+	}
+
+	// A couple of stopwords in a long text is as likely to be a borrowed word as the page's language
+	if bestHits*20 < len(words) {
+		return ""
+	}
+
+	return best
+}
@@ -0,0 +1,31 @@
+package crawler
+
+import "testing"
+
+func TestDetectLanguage(t *testing.T) {
+	tests := map[string]struct {
+		htmlLang        string
+		contentLanguage string
+		text            string
+		lang            string
+	}{
+		"html-lang":        {htmlLang: "en-US", contentLanguage: "fr", lang: "en"},
+		"html-lang-script": {htmlLang: "zh_Hant", lang: "zh"},
+		"content-language": {htmlLang: "not a tag", contentLanguage: "de-DE, en", lang: "de"},
+		"english":          {text: "The crawler follows the links on this page and indexes the text that it finds.", lang: "en"},
+		"french":           {text: "Le robot suit les liens de la page et indexe le texte qui est dans les pages.", lang: "fr"},
+		"japanese":         {text: "このページのリンクをたどって、見つけたテキストを索引に登録します。", lang: "ja"},
+		"chinese":          {text: "爬虫会跟踪此页面上的链接并为找到的文本建立索引。", lang: "zh"},
+		"korean":           {text: "크롤러는 이 페이지의 링크를 따라가서 찾은 텍스트를 색인합니다.", lang: "ko"},
+		"too-short":        {text: "The end", lang: ""},
+		"no-stopwords":     {text: "Lorem ipsum dolor sit amet consectetur adipiscing elit", lang: ""},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if lang := detectLanguage(tc.htmlLang, tc.contentLanguage, tc.text); lang != tc.lang {
+				t.Fatalf("language - expected : %q, received : %q", tc.lang, lang)
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+package crawler
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/gocolly/colly"
+	"github.com/wambozi/elastic-webcrawler/m/pkg/clients"
+)
+
+const (
+	// MaxPageOutlinks is the most outlinks kept per page
+	MaxPageOutlinks = 200
+	// MaxAnchorTexts is the most distinct anchor texts kept per page, the most used first
+	MaxAnchorTexts = 50
+)
+
+// Link represents a link from a page to another, as written to every sink
+type Link = clients.Link
+
+// extractLinks returns the distinct http and https links of the page under their canonical URL,
+// with the text they are shown with. Links around an image use its alt text, and links without any
+// text their title.
+func extractLinks(e *colly.HTMLElement, canon *canonicalizer) (links []Link) {
+	found := make(map[string]bool)
+	e.DOM.Find("a[href]").EachWithBreak(func(_ int, s *goquery.Selection) bool {
+		link := e.Request.AbsoluteURL(s.AttrOr("href", ""))
+		if u, err := url.Parse(link); err != nil || u.Scheme != "http" && u.Scheme != "https" {
+			return true
+		}
+		link = canon.canonical(link)
+		if found[link] {
+			return true
+		}
+
+		found[link] = true
+		links = append(links, Link{URL: link, Text: anchorText(s)})
+		return len(links) < MaxPageOutlinks
+	})
+
+	return links
+}
+
+// anchorText returns the text the link is shown with
+func anchorText(s *goquery.Selection) string {
+	if text := collapseSpace(s.Text()); text != "" {
+		return text
+	}
+	if alt := collapseSpace(s.Find("img[alt]").First().AttrOr("alt", "")); alt != "" {
+		return alt
+	}
+	return collapseSpace(s.AttrOr("title", ""))
+}
+
+// linkGraph collects the links between the documents of a crawl, so the links pointing at every
+// document are known once it is over
+type linkGraph struct {
+	mu    sync.Mutex
+	docs  map[string]string
+	links map[string][]Link
+}
+
+func newLinkGraph() *linkGraph {
+	return &linkGraph{docs: make(map[string]string), links: make(map[string][]Link)}
+}
+
+// add records the document with the ID, found under the URLs, and the links on its page. The links
+// of a document found under several URLs are only recorded once.
+func (g *linkGraph) add(id string, uris []string, links []Link) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for _, uri := range uris {
+		if _, ok := g.docs[uri]; !ok {
+			g.docs[uri] = id
+		}
+	}
+	if _, ok := g.links[id]; !ok {
+		g.links[id] = links
+	}
+}
+
+// anchorCount counts the links using an anchor text, case insensitively
+type anchorCount struct {
+	text  string
+	count int
+}
+
+// updates returns the number of other documents linking to every document of the crawl, the anchor
+// texts of those links, the most used first, and the document's score, see pageScores
+func (g *linkGraph) updates() map[string]map[string]interface{} {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	// The sources are walked in order so the spelling kept for every anchor text is reproducible
+	ids := make([]string, 0, len(g.links))
+	for id := range g.links {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	sources := make(map[string]map[string]bool)
+	anchors := make(map[string]map[string]*anchorCount)
+	for _, source := range ids {
+		for _, link := range g.links[source] {
+			target, ok := g.docs[link.URL]
+			if !ok || target == source {
+				continue
+			}
+
+			if sources[target] == nil {
+				sources[target] = make(map[string]bool)
+				anchors[target] = make(map[string]*anchorCount)
+			}
+			sources[target][source] = true
+
+			if link.Text == "" {
+				continue
+			}
+			key := strings.ToLower(link.Text)
+			if a, ok := anchors[target][key]; ok {
+				a.count++
+			} else {
+				anchors[target][key] = &anchorCount{text: link.Text, count: 1}
+			}
+		}
+	}
+
+	scores := pageScores(ids, sources)
+
+	updates := make(map[string]map[string]interface{}, len(ids))
+	for _, id := range ids {
+		counts := make([]*anchorCount, 0, len(anchors[id]))
+		for _, a := range anchors[id] {
+			counts = append(counts, a)
+		}
+		sort.Slice(counts, func(i, j int) bool {
+			if counts[i].count != counts[j].count {
+				return counts[i].count > counts[j].count
+			}
+			return strings.ToLower(counts[i].text) < strings.ToLower(counts[j].text)
+		})
+		if len(counts) > MaxAnchorTexts {
+			counts = counts[:MaxAnchorTexts]
+		}
+
+		texts := make([]string, 0, len(counts))
+		for _, a := range counts {
+			texts = append(texts, a.text)
+		}
+		updates[id] = map[string]interface{}{"inlinks": len(sources[id]), "anchor_text": texts, "page_score": scores[id]}
+	}
+
+	return updates
+}
+
+// previousLinks returns the http and https links a page had in the previous crawl under their
+// canonical URL. Their text isn't recorded, so they don't add to the anchor text of their targets.
+func previousLinks(links []string, canon *canonicalizer) []Link {
+	found := make(map[string]bool)
+	var previous []Link
+	for _, link := range links {
+		if u, err := url.Parse(link); err != nil || u.Scheme != "http" && u.Scheme != "https" {
+			continue
+		}
+		link = canon.canonical(link)
+		if found[link] {
+			continue
+		}
+		found[link] = true
+		previous = append(previous, Link{URL: link})
+		if len(previous) == MaxPageOutlinks {
+			break
+		}
+	}
+	return previous
+}
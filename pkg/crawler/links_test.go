@@ -0,0 +1,123 @@
+package crawler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/sirupsen/logrus"
+	"github.com/wambozi/elastic-webcrawler/m/pkg/clients"
+)
+
+// updateSink records the pages written to it and the updates made once the crawl is over
+type updateSink struct {
+	documentSink
+	updates map[string]map[string]interface{}
+}
+
+func (s *updateSink) Update(ctx context.Context, updates map[string]map[string]interface{}) (clients.BatchResult, error) {
+	s.updates = updates
+	return clients.BatchResult{Indexed: len(updates)}, nil
+}
+
+func TestLinkGraphUpdates(t *testing.T) {
+	g := newLinkGraph()
+	g.add("home", []string{"https://www.example.com/"}, []Link{
+		{URL: "https://www.example.com/a", Text: "Docs"},
+		{URL: "https://www.example.com/b", Text: "Blog"},
+		{URL: "https://www.example.com/", Text: "Home"},
+		{URL: "https://www.elsewhere.com/", Text: "Elsewhere"},
+	})
+	g.add("a", []string{"https://www.example.com/a", "https://www.example.com/a-alias"}, []Link{
+		{URL: "https://www.example.com/", Text: "Home"},
+		{URL: "https://www.example.com/b", Text: "blog"},
+	})
+	g.add("b", []string{"https://www.example.com/b"}, []Link{
+		{URL: "https://www.example.com/a-alias", Text: "docs"},
+		{URL: "https://www.example.com/"},
+	})
+	// Links of a document found again under another URL are only counted once
+	g.add("b", []string{"https://www.example.com/b/"}, []Link{{URL: "https://www.example.com/a", Text: "Again"}})
+
+	// Every document links to both others, so they score the same
+	want := map[string]map[string]interface{}{
+		"home": {"inlinks": 2, "anchor_text": []string{"Home"}, "page_score": 1.0},
+		"a":    {"inlinks": 2, "anchor_text": []string{"docs"}, "page_score": 1.0},
+		"b":    {"inlinks": 2, "anchor_text": []string{"blog"}, "page_score": 1.0},
+	}
+	if diff := cmp.Diff(want, g.updates(), approx); diff != "" {
+		t.Fatalf(diff)
+	}
+}
+
+func TestCrawlLinks(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		switch r.URL.Path {
+		case "/":
+			fmt.Fprint(w, `<html><body><p>home</p>
+<a href="/about?utm_source=home"> About  us </a>
+<a href="/about">About</a>
+<a href="/docs/"><img src="/docs.png" alt="Documentation"></a>
+<a href="/contact" title="Contact"></a>
+<a href="mailto:team@example.com">Mail</a>
+<a href="#top">Top</a>
+</body></html>`)
+		case "/about":
+			fmt.Fprint(w, `<html><body><p>about</p><a href="/">Home</a><a href="/docs">Read the docs</a></body></html>`)
+		case "/docs":
+			fmt.Fprint(w, `<html><body><p>docs</p><a href="/">Home</a><a href="/docs">Docs</a></body></html>`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL)
+	job, err := NewRegistry().Create(CrawlRequest{URL: srv.URL + "/", Domain: u.Host})
+	if err != nil {
+		t.Fatalf("Unexpected error creating job: %s", err)
+	}
+
+	sink := &updateSink{documentSink: documentSink{docs: make(map[string]RenderedPage)}}
+	if err := Crawl(job.ctx, job, sink, nil, nil, logrus.New()); err != nil {
+		t.Fatalf("Unexpected error crawling: %s", err)
+	}
+
+	page := sink.docs[clients.DocumentID(srv.URL+"/")]
+	want := []Link{
+		{URL: srv.URL + "/about", Text: "About us"},
+		{URL: srv.URL + "/docs", Text: "Documentation"},
+		{URL: srv.URL + "/contact", Text: "Contact"},
+	}
+	if diff := cmp.Diff(want, page.Outlinks); diff != "" {
+		t.Fatalf(diff)
+	}
+
+	// The contact page wasn't found, so it isn't a document, and self links don't count
+	wantUpdates := map[string]map[string]interface{}{
+		clients.DocumentID(srv.URL + "/"):      {"inlinks": 2, "anchor_text": []string{"Home"}},
+		clients.DocumentID(srv.URL + "/about"): {"inlinks": 1, "anchor_text": []string{"About us"}},
+		clients.DocumentID(srv.URL + "/docs"):  {"inlinks": 2, "anchor_text": []string{"Documentation", "Read the docs"}},
+	}
+	// The home page is linked from both other pages, which only the docs page is as well
+	scores := make(map[string]float64)
+	for id, update := range sink.updates {
+		scores[id] = update["page_score"].(float64)
+		delete(update, "page_score")
+	}
+	if diff := cmp.Diff(wantUpdates, sink.updates); diff != "" {
+		t.Fatalf(diff)
+	}
+	home, about, docs := scores[clients.DocumentID(srv.URL+"/")], scores[clients.DocumentID(srv.URL+"/about")], scores[clients.DocumentID(srv.URL+"/docs")]
+	if !(home > docs && docs > about) {
+		t.Fatalf("the pages should be ranked by their links: home %f, docs %f, about %f", home, docs, about)
+	}
+	if stats := job.Status().Stats; stats.PagesLinked != 3 {
+		t.Fatalf("every page should have its links written: %+v", stats)
+	}
+}
@@ -0,0 +1,98 @@
+package crawler
+
+import (
+	"context"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wambozi/elastic-webcrawler/m/pkg/clients"
+)
+
+// Prune represents how a crawl removes the pages of the site it no longer finds
+type Prune struct {
+	Enabled bool `json:"enabled,omitempty"`
+	// DryRun reports the stale pages in the job's stats without deleting them
+	DryRun bool `json:"dry_run,omitempty"`
+}
+
+// prune deletes the pages of the crawled site last seen before the crawl started, other than the
+// unchanged pages an incremental crawl didn't rewrite and the pages it failed to fetch or write for
+// reasons that may pass. Crawls cut short by a scope limit don't prune, as the pages they didn't
+// reach may still exist.
+func prune(ctx context.Context, job *Job, sink clients.Sink, states *pageStates, failed *unreached, seen time.Time, logger *logrus.Logger) error {
+	cr := job.Request
+	if cr.Prune == nil || !cr.Prune.Enabled {
+		return nil
+	}
+
+	p, ok := sink.(clients.Pruner)
+	if !ok {
+		logger.Warnf("Not pruning crawl %s, its sink can't delete pages", job.ID)
+		return nil
+	}
+	if limit := job.Status().Limit; limit != "" {
+		logger.Warnf("Not pruning crawl %s, it stopped at its %s limit", job.ID, limit)
+		return nil
+	}
+
+	u, err := url.Parse(cr.URL)
+	if err != nil {
+		return err
+	}
+
+	result, err := p.Prune(ctx, u.Hostname(), seen, append(states.keptIDs(), failed.list()...), cr.Prune.DryRun)
+	job.record(func(s *Stats) {
+		s.PagesStale += result.Stale
+		s.PagesPruned += result.Deleted
+		s.StaleURLs = append(s.StaleURLs, result.URIs...)
+	})
+	if err != nil {
+		logger.Errorf("Failed to prune the stale pages of %s: %v", u.Hostname(), err)
+		return err
+	}
+
+	if cr.Prune.DryRun {
+		logger.Infof("Crawl %s found %d stale pages of %s, not deleted in a dry run", job.ID, result.Stale, u.Hostname())
+	} else {
+		logger.Infof("Crawl %s deleted %d of %d stale pages of %s", job.ID, result.Deleted, result.Stale, u.Hostname())
+		states.forget(ctx, job, seen, logger)
+	}
+
+	return nil
+}
+
+// unreached collects the document IDs of the pages a crawl failed to fetch or write, such as after
+// a 5xx response, a timeout or a failed bulk request, so pruning doesn't delete pages that still exist
+type unreached struct {
+	mu  sync.Mutex
+	ids map[string]bool
+}
+
+func newUnreached() *unreached {
+	return &unreached{ids: make(map[string]bool)}
+}
+
+func (u *unreached) add(ids ...string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, id := range ids {
+		u.ids[id] = true
+	}
+}
+
+// list returns the document IDs, sorted
+func (u *unreached) list() []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	ids := make([]string, 0, len(u.ids))
+	for id := range u.ids {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	return ids
+}
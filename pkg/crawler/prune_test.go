@@ -0,0 +1,127 @@
+package crawler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/sirupsen/logrus"
+	"github.com/wambozi/elastic-webcrawler/m/pkg/clients"
+)
+
+// pruningSink records the pages written to it and the prunes requested by the crawl
+type pruningSink struct {
+	lastSeen []string
+	site     string
+	before   time.Time
+	dryRun   bool
+	keep     []string
+	pruned   int
+}
+
+func (s *pruningSink) Write(ctx context.Context, page RenderedPage) error {
+	s.lastSeen = append(s.lastSeen, page.LastSeen)
+	return nil
+}
+
+func (s *pruningSink) Flush(ctx context.Context) error { return nil }
+func (s *pruningSink) Close(ctx context.Context) error { return nil }
+
+func (s *pruningSink) Prune(ctx context.Context, site string, before time.Time, keep []string, dryRun bool) (clients.PruneResult, error) {
+	s.site, s.before, s.dryRun, s.keep = site, before, dryRun, keep
+	s.pruned++
+	return clients.PruneResult{Stale: 1, URIs: []string{"http://" + site + "/gone"}}, nil
+}
+
+func TestCrawlPrune(t *testing.T) {
+	srv := newChainServer(2)
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL)
+
+	tests := map[string]struct {
+		request CrawlRequest
+		pruned  int
+	}{
+		"disabled":  {request: CrawlRequest{}},
+		"enabled":   {request: CrawlRequest{Prune: &Prune{Enabled: true}}, pruned: 1},
+		"dry-run":   {request: CrawlRequest{Prune: &Prune{Enabled: true, DryRun: true}}, pruned: 1},
+		"limit-hit": {request: CrawlRequest{Prune: &Prune{Enabled: true}, MaxPages: 1}},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			cr := tc.request
+			cr.URL = srv.URL + "/0"
+			cr.Domain = u.Host
+
+			job, err := NewRegistry().Create(cr)
+			if err != nil {
+				t.Fatalf("Unexpected error creating job: %s", err)
+			}
+
+			sink := &pruningSink{}
+			if err := Crawl(job.ctx, job, sink, nil, nil, logrus.New()); err != nil {
+				t.Fatalf("Unexpected error crawling: %s", err)
+			}
+
+			if sink.pruned != tc.pruned {
+				t.Fatalf("prunes - expected : %d, received : %d", tc.pruned, sink.pruned)
+			}
+			if sink.pruned == 0 {
+				return
+			}
+
+			if sink.site != u.Hostname() || sink.dryRun != cr.Prune.DryRun {
+				t.Fatalf("unexpected prune of site %s, dry run %t", sink.site, sink.dryRun)
+			}
+			for _, seen := range sink.lastSeen {
+				if seen != sink.before.Format(clients.LastSeenLayout) {
+					t.Fatalf("pages should be last seen when the crawl started, at %s: %s", sink.before, seen)
+				}
+			}
+			if stats := job.Status().Stats; stats.PagesStale != 1 || len(stats.StaleURLs) != 1 {
+				t.Fatalf("the stale pages should be reported: %+v", stats)
+			}
+		})
+	}
+}
+
+func TestCrawlPruneKeepsFailedPages(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, `<html><body><p>home</p><a href="/busy">busy</a><a href="/missing">missing</a></body></html>`)
+		case "/busy":
+			http.Error(w, "try again later", http.StatusServiceUnavailable)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL)
+	job, err := NewRegistry().Create(CrawlRequest{URL: srv.URL + "/", Domain: u.Host, Prune: &Prune{Enabled: true}})
+	if err != nil {
+		t.Fatalf("Unexpected error creating job: %s", err)
+	}
+
+	sink := &pruningSink{}
+	if err := Crawl(job.ctx, job, sink, nil, nil, logrus.New()); err != nil {
+		t.Fatalf("Unexpected error crawling: %s", err)
+	}
+
+	// The page that answered 503 may still exist, unlike the one that wasn't found
+	if sink.pruned != 1 {
+		t.Fatalf("prunes - expected : %d, received : %d", 1, sink.pruned)
+	}
+	if diff := cmp.Diff([]string{clients.DocumentID(srv.URL + "/busy")}, sink.keep); diff != "" {
+		t.Fatalf(diff)
+	}
+}
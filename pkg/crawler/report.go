@@ -0,0 +1,336 @@
+package crawler
+
+import (
+	"encoding/csv"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gocolly/colly"
+)
+
+// DefaultSlowPage is how long fetching a page may take before it is reported as slow
+const DefaultSlowPage = 2 * time.Second
+
+// MaxReportEntries is the most broken links, redirects and slow pages each kept in a crawl's report
+const MaxReportEntries = 1000
+
+// maxRedirects is the most redirects followed for one link, as by Go's HTTP client
+const maxRedirects = 10
+
+const (
+	// FailureHTTP is a link answered with an error status
+	FailureHTTP = "http"
+	// FailureDNS is a link whose host couldn't be resolved
+	FailureDNS = "dns"
+	// FailureTimeout is a link that didn't answer in time
+	FailureTimeout = "timeout"
+	// FailureConnection is a link that couldn't be fetched for any other reason, such as a refused
+	// connection or a TLS error
+	FailureConnection = "connection"
+)
+
+// Report represents the links of a crawl that failed, were redirected or were slow to fetch, as
+// returned by the /crawls/{id}/report route
+type Report struct {
+	BrokenLinks []BrokenLink `json:"broken_links"`
+	Redirects   []Redirect   `json:"redirects"`
+	SlowPages   []SlowPage   `json:"slow_pages"`
+}
+
+// BrokenLink represents a link that couldn't be fetched. Kind is one of the Failure constants and
+// Referrer the first page the link was found on, if any.
+type BrokenLink struct {
+	URL        string `json:"url"`
+	Referrer   string `json:"referrer,omitempty"`
+	Kind       string `json:"kind"`
+	StatusCode int    `json:"status_code,omitempty"`
+	Error      string `json:"error"`
+}
+
+// Redirect represents a link that was redirected. Chain lists the URLs redirecting, starting with
+// the link, with the status of their redirect, and Target is where the chain ended.
+type Redirect struct {
+	URL      string        `json:"url"`
+	Referrer string        `json:"referrer,omitempty"`
+	Chain    []RedirectHop `json:"chain"`
+	Target   string        `json:"target"`
+}
+
+// RedirectHop represents one URL of a redirect chain
+type RedirectHop struct {
+	URL        string `json:"url"`
+	StatusCode int    `json:"status_code"`
+}
+
+// SlowPage represents a page that took longer than the crawl's slow_page to fetch
+type SlowPage struct {
+	URL      string `json:"url"`
+	Referrer string `json:"referrer,omitempty"`
+	Millis   int64  `json:"duration_ms"`
+}
+
+// crawlReport collects the report of a crawl as its pages are fetched
+type crawlReport struct {
+	mu        sync.Mutex
+	referrers map[string]string
+	fetching  map[string]bool
+	durations map[string]time.Duration
+	broken    map[string]BrokenLink
+	redirects map[string]Redirect
+	slow      map[string]SlowPage
+}
+
+func newCrawlReport() *crawlReport {
+	return &crawlReport{
+		referrers: make(map[string]string),
+		fetching:  make(map[string]bool),
+		durations: make(map[string]time.Duration),
+		broken:    make(map[string]BrokenLink),
+		redirects: make(map[string]Redirect),
+		slow:      make(map[string]SlowPage),
+	}
+}
+
+// link records the page a link was first found on
+func (cr *crawlReport) link(from, to string) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if _, ok := cr.referrers[to]; !ok {
+		cr.referrers[to] = from
+	}
+}
+
+// request records that the URL is fetched as a page, so the time fetching it is kept until its
+// response or error
+func (cr *crawlReport) request(uri string) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cr.fetching[uri] = true
+}
+
+// fetched records how long fetching the URL took, until its body was read. Other fetches, such as
+// robots.txt, aren't recorded.
+func (cr *crawlReport) fetched(uri string, d time.Duration) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if cr.fetching[uri] {
+		cr.durations[uri] = d
+	}
+}
+
+// redirect records the redirect chain leading to req, the next request of a link
+func (cr *crawlReport) redirect(req *http.Request, via []*http.Request) {
+	chain := make([]RedirectHop, len(via))
+	for i, r := range via {
+		chain[i].URL = r.URL.String()
+		if i+1 < len(via) {
+			chain[i].StatusCode = via[i+1].Response.StatusCode
+		} else if req.Response != nil {
+			chain[i].StatusCode = req.Response.StatusCode
+		}
+	}
+	link := chain[0].URL
+
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	// Only the target of the chain is fetched as a page
+	for _, hop := range chain {
+		delete(cr.fetching, hop.URL)
+		delete(cr.durations, hop.URL)
+	}
+	cr.fetching[req.URL.String()] = true
+
+	// The target of the chain was found through the link, so it shares its referrer
+	referrer := cr.referrers[link]
+	if _, ok := cr.referrers[req.URL.String()]; !ok && referrer != "" {
+		cr.referrers[req.URL.String()] = referrer
+	}
+
+	if _, ok := cr.redirects[link]; ok || len(cr.redirects) < MaxReportEntries {
+		cr.redirects[link] = Redirect{URL: link, Referrer: referrer, Chain: chain, Target: req.URL.String()}
+	}
+}
+
+// response records the page of the response as slow if fetching it took longer than slow, and
+// forgets any earlier failure fetching it
+func (cr *crawlReport) response(r *colly.Response, slow time.Duration) {
+	uri := r.Request.URL.String()
+
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	delete(cr.broken, uri)
+	d, ok := cr.durations[uri]
+	delete(cr.fetching, uri)
+	delete(cr.durations, uri)
+	if ok && d >= slow && len(cr.slow) < MaxReportEntries {
+		cr.slow[uri] = SlowPage{URL: uri, Referrer: cr.referrers[uri], Millis: int64(d / time.Millisecond)}
+	}
+}
+
+// fail records the link of the response as broken, unless its error doesn't mean the link is broken
+func (cr *crawlReport) fail(r *colly.Response, err error) {
+	uri := r.Request.URL.String()
+
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	delete(cr.fetching, uri)
+	delete(cr.durations, uri)
+
+	kind := failureKind(r.StatusCode, err)
+	if kind == "" {
+		return
+	}
+	if _, ok := cr.broken[uri]; ok || len(cr.broken) < MaxReportEntries {
+		cr.broken[uri] = BrokenLink{URL: uri, Referrer: cr.referrers[uri], Kind: kind, StatusCode: r.StatusCode, Error: err.Error()}
+	}
+}
+
+// failureKind returns the kind of failure fetching a link answered with the status, or an empty
+// string if the error isn't one. Unchanged pages answer 304, pages that fail to parse are fetched
+// fine and redirects off the crawl's domain are refused by the collector itself.
+func failureKind(status int, err error) string {
+	switch {
+	case status == http.StatusNotModified || status >= 200 && status < 300:
+		return ""
+	case status != 0:
+		return FailureHTTP
+	case strings.Contains(err.Error(), "AllowedDomains"):
+		return ""
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return FailureDNS
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return FailureTimeout
+	}
+	return FailureConnection
+}
+
+// snapshot returns the report, each list sorted by URL
+func (cr *crawlReport) snapshot() Report {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	report := Report{
+		BrokenLinks: make([]BrokenLink, 0, len(cr.broken)),
+		Redirects:   make([]Redirect, 0, len(cr.redirects)),
+		SlowPages:   make([]SlowPage, 0, len(cr.slow)),
+	}
+	for _, b := range cr.broken {
+		report.BrokenLinks = append(report.BrokenLinks, b)
+	}
+	for _, r := range cr.redirects {
+		report.Redirects = append(report.Redirects, r)
+	}
+	for _, s := range cr.slow {
+		report.SlowPages = append(report.SlowPages, s)
+	}
+
+	sort.Slice(report.BrokenLinks, func(i, j int) bool { return report.BrokenLinks[i].URL < report.BrokenLinks[j].URL })
+	sort.Slice(report.Redirects, func(i, j int) bool { return report.Redirects[i].URL < report.Redirects[j].URL })
+	sort.Slice(report.SlowPages, func(i, j int) bool { return report.SlowPages[i].URL < report.SlowPages[j].URL })
+
+	return report
+}
+
+// reportCSVHeader names the columns of the CSV report
+var reportCSVHeader = []string{"type", "url", "referrer", "kind", "status_code", "error", "redirect_chain", "target", "duration_ms"}
+
+// WriteCSV writes the report as CSV, one row per broken link, redirect and slow page, with the
+// type column telling them apart. Redirect chains list their URLs separated by spaces.
+func (r Report) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write(reportCSVHeader)
+
+	for _, b := range r.BrokenLinks {
+		status := ""
+		if b.StatusCode != 0 {
+			status = strconv.Itoa(b.StatusCode)
+		}
+		cw.Write([]string{"broken_link", b.URL, b.Referrer, b.Kind, status, b.Error, "", "", ""})
+	}
+	for _, rd := range r.Redirects {
+		chain := make([]string, len(rd.Chain))
+		for i, hop := range rd.Chain {
+			chain[i] = hop.URL
+		}
+		status := ""
+		if len(rd.Chain) > 0 {
+			status = strconv.Itoa(rd.Chain[0].StatusCode)
+		}
+		cw.Write([]string{"redirect", rd.URL, rd.Referrer, "", status, "", strings.Join(chain, " "), rd.Target, ""})
+	}
+	for _, s := range r.SlowPages {
+		cw.Write([]string{"slow_page", s.URL, s.Referrer, "", "", "", "", "", strconv.FormatInt(s.Millis, 10)})
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// followRedirect applies the collector's default redirect policy, which a redirect handler replaces:
+// up to maxRedirects are followed with the headers of the previous request, except Authorization
+// when the host changes
+func followRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return http.ErrUseLastResponse
+	}
+
+	last := via[len(via)-1]
+	for name, values := range last.Header {
+		for _, value := range values {
+			req.Header.Set(name, value)
+		}
+	}
+	if req.URL.Host != last.URL.Host {
+		req.Header.Del("Authorization")
+	}
+
+	return nil
+}
+
+// timingTransport reports how long every fetch took, from sending the request until its body was
+// read, leaving out the delay the collector waits between requests. The report only keeps the
+// fetches of pages.
+type timingTransport struct {
+	base    http.RoundTripper
+	fetched func(uri string, d time.Duration)
+}
+
+func (t *timingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	start := time.Now()
+	res, err := t.base.RoundTrip(r)
+	if err != nil {
+		return res, err
+	}
+
+	uri := r.URL.String()
+	res.Body = &timedBody{ReadCloser: res.Body, done: func() { t.fetched(uri, time.Since(start)) }}
+	return res, nil
+}
+
+// timedBody calls done once the body is closed
+type timedBody struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (b *timedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.done)
+	return err
+}
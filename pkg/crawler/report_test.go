@@ -0,0 +1,138 @@
+package crawler
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/sirupsen/logrus"
+)
+
+func TestCrawlReport(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		switch r.URL.Path {
+		case "/":
+			fmt.Fprint(w, `<html><body><p>home</p><a href="/missing">missing</a><a href="/old">old</a><a href="/slow">slow</a><a href="/error">error</a></body></html>`)
+		case "/old":
+			http.Redirect(w, r, "/moved", http.StatusMovedPermanently)
+		case "/moved":
+			http.Redirect(w, r, "/new", http.StatusFound)
+		case "/new":
+			fmt.Fprint(w, `<html><body><p>new</p><a href="/gone">gone</a></body></html>`)
+		case "/slow":
+			time.Sleep(100 * time.Millisecond)
+			fmt.Fprint(w, `<html><body><p>slow</p></body></html>`)
+		case "/error":
+			http.Error(w, "oops", http.StatusInternalServerError)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL)
+	job, err := NewRegistry().Create(CrawlRequest{URL: srv.URL + "/", Domain: u.Host, SlowPage: "80ms"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating job: %s", err)
+	}
+	if err := Crawl(job.ctx, job, nil, nil, nil, logrus.New()); err != nil {
+		t.Fatalf("Unexpected error crawling: %s", err)
+	}
+
+	report := job.Report()
+	if len(report.SlowPages) != 1 || report.SlowPages[0].URL != srv.URL+"/slow" || report.SlowPages[0].Referrer != srv.URL+"/" || report.SlowPages[0].Millis < 80 {
+		t.Fatalf("only the slow page should be reported as slow: %+v", report.SlowPages)
+	}
+	report.SlowPages = nil
+
+	want := Report{
+		BrokenLinks: []BrokenLink{
+			{URL: srv.URL + "/error", Referrer: srv.URL + "/", Kind: FailureHTTP, StatusCode: 500, Error: "Internal Server Error"},
+			{URL: srv.URL + "/gone", Referrer: srv.URL + "/new", Kind: FailureHTTP, StatusCode: 404, Error: "Not Found"},
+			{URL: srv.URL + "/missing", Referrer: srv.URL + "/", Kind: FailureHTTP, StatusCode: 404, Error: "Not Found"},
+		},
+		Redirects: []Redirect{{
+			URL:      srv.URL + "/old",
+			Referrer: srv.URL + "/",
+			Chain:    []RedirectHop{{URL: srv.URL + "/old", StatusCode: 301}, {URL: srv.URL + "/moved", StatusCode: 302}},
+			Target:   srv.URL + "/new",
+		}},
+	}
+	if diff := cmp.Diff(want, report); diff != "" {
+		t.Fatalf(diff)
+	}
+
+	// Fetches that aren't pages, such as robots.txt and the hops of redirect chains, mustn't be kept
+	if len(job.report.durations) != 0 || len(job.report.fetching) != 0 {
+		t.Fatalf("every timing should be dropped once its page is reported, left %v", job.report.durations)
+	}
+}
+
+// timeoutError is a network error that timed out
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestFailureKind(t *testing.T) {
+	tests := map[string]struct {
+		status int
+		err    error
+		want   string
+	}{
+		"not-found":    {status: 404, err: errors.New("Not Found"), want: FailureHTTP},
+		"not-modified": {status: 304, err: errors.New("Not Modified")},
+		"parse-error":  {status: 200, err: errors.New("invalid XPath")},
+		"dns":          {err: &url.Error{Op: "Get", URL: "http://nowhere.invalid", Err: &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "nowhere.invalid"}}}, want: FailureDNS},
+		"timeout":      {err: &url.Error{Op: "Get", URL: "http://www.example.com", Err: timeoutError{}}, want: FailureTimeout},
+		"refused":      {err: &url.Error{Op: "Get", URL: "http://www.example.com", Err: errors.New("connection refused")}, want: FailureConnection},
+		"other-domain": {err: &url.Error{Op: "Get", URL: "http://www.example.com", Err: errors.New("Not following redirect to www.elsewhere.com because its not in AllowedDomains")}},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := failureKind(tc.status, tc.err); got != tc.want {
+				t.Fatalf("kind - expected : %q, received : %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestReportWriteCSV(t *testing.T) {
+	report := Report{
+		BrokenLinks: []BrokenLink{
+			{URL: "https://www.example.com/missing", Referrer: "https://www.example.com/", Kind: FailureHTTP, StatusCode: 404, Error: "Not Found"},
+			{URL: "https://down.example.com/", Kind: FailureDNS, Error: "no such host, really"},
+		},
+		Redirects: []Redirect{{
+			URL:    "https://www.example.com/old",
+			Chain:  []RedirectHop{{URL: "https://www.example.com/old", StatusCode: 301}, {URL: "https://www.example.com/moved", StatusCode: 302}},
+			Target: "https://www.example.com/new",
+		}},
+		SlowPages: []SlowPage{{URL: "https://www.example.com/slow", Millis: 2500}},
+	}
+
+	var b bytes.Buffer
+	if err := report.WriteCSV(&b); err != nil {
+		t.Fatalf("Unexpected error writing the report: %s", err)
+	}
+
+	want := `type,url,referrer,kind,status_code,error,redirect_chain,target,duration_ms
+broken_link,https://www.example.com/missing,https://www.example.com/,http,404,Not Found,,,
+broken_link,https://down.example.com/,,dns,,"no such host, really",,,
+redirect,https://www.example.com/old,,,301,,https://www.example.com/old https://www.example.com/moved,https://www.example.com/new,
+slow_page,https://www.example.com/slow,,,,,,,2500
+`
+	if diff := cmp.Diff(want, b.String()); diff != "" {
+		t.Fatalf(diff)
+	}
+}
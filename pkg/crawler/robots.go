@@ -0,0 +1,84 @@
+package crawler
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/gocolly/colly"
+)
+
+const (
+	// RobotsRespect obeys robots.txt, robots meta tags and X-Robots-Tag headers
+	RobotsRespect = "respect"
+	// RobotsIgnore crawls and indexes every page regardless of robots rules
+	RobotsIgnore = "ignore"
+)
+
+// robotsDirectives represents the page level robots rules of a crawled page
+type robotsDirectives struct {
+	noindex  bool
+	nofollow bool
+}
+
+// parseRobotsDirectives reads the comma separated rules of robots meta tags or X-Robots-Tag headers.
+// Rules scoped to a user agent, e.g. "otherbot: noindex", are applied as if they were global.
+func parseRobotsDirectives(values ...string) (d robotsDirectives) {
+	for _, v := range values {
+		for _, rule := range strings.Split(v, ",") {
+			if i := strings.LastIndex(rule, ":"); i >= 0 {
+				rule = rule[i+1:]
+			}
+
+			switch strings.ToLower(strings.TrimSpace(rule)) {
+			case "noindex":
+				d.noindex = true
+			case "nofollow":
+				d.nofollow = true
+			case "none":
+				d.noindex = true
+				d.nofollow = true
+			}
+		}
+	}
+
+	return
+}
+
+// robotsCache holds the directives of pages whose callbacks are still running
+type robotsCache struct {
+	mu    sync.Mutex
+	pages map[*colly.Response]robotsDirectives
+}
+
+func newRobotsCache() *robotsCache {
+	return &robotsCache{pages: make(map[*colly.Response]robotsDirectives)}
+}
+
+// load parses the directives of the page from its headers and robots meta tags
+func (rc *robotsCache) load(e *colly.HTMLElement) {
+	values := append([]string{}, (*e.Response.Headers)["X-Robots-Tag"]...)
+	e.DOM.Find("meta").Each(func(_ int, s *goquery.Selection) {
+		name, _ := s.Attr("name")
+		if strings.EqualFold(name, "robots") {
+			content, _ := s.Attr("content")
+			values = append(values, content)
+		}
+	})
+
+	rc.mu.Lock()
+	rc.pages[e.Response] = parseRobotsDirectives(values...)
+	rc.mu.Unlock()
+}
+
+func (rc *robotsCache) get(r *colly.Response) robotsDirectives {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.pages[r]
+}
+
+func (rc *robotsCache) forget(r *colly.Response) {
+	rc.mu.Lock()
+	delete(rc.pages, r)
+	rc.mu.Unlock()
+}
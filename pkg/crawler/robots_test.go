@@ -0,0 +1,140 @@
+package crawler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/sirupsen/logrus"
+	"github.com/wambozi/elastic-webcrawler/m/pkg/clients"
+)
+
+func TestParseRobotsDirectives(t *testing.T) {
+	tests := map[string]struct {
+		values []string
+		want   robotsDirectives
+	}{
+		"empty":      {values: nil, want: robotsDirectives{}},
+		"all":        {values: []string{"all"}, want: robotsDirectives{}},
+		"noindex":    {values: []string{"noindex"}, want: robotsDirectives{noindex: true}},
+		"both":       {values: []string{"NOINDEX, nofollow"}, want: robotsDirectives{noindex: true, nofollow: true}},
+		"none":       {values: []string{"none"}, want: robotsDirectives{noindex: true, nofollow: true}},
+		"user-agent": {values: []string{"otherbot: nofollow"}, want: robotsDirectives{nofollow: true}},
+		"combined":   {values: []string{"noarchive", "nofollow"}, want: robotsDirectives{nofollow: true}},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := parseRobotsDirectives(tc.values...)
+			if got != tc.want {
+				t.Fatalf("directives - expected : %+v, received : %+v", tc.want, got)
+			}
+		})
+	}
+}
+
+// newRobotsServer serves a small site with robots rules alongside a fake App Search documents API
+// that records the URI of every document it receives and accepts them all
+func newRobotsServer(indexed *[]string, mu *sync.Mutex) *httptest.Server {
+	pages := map[string]string{
+		"/":         `<a href="/private">private</a><a href="/noindex">noindex</a><a href="/nofollow">nofollow</a><a href="/header">header</a>`,
+		"/noindex":  `<meta name="robots" content="noindex"><a href="/linked">linked</a>`,
+		"/nofollow": `<meta name="ROBOTS" content="nofollow"><a href="/hidden">hidden</a>`,
+		"/header":   `<p>header</p>`,
+		"/linked":   `<p>linked</p>`,
+		"/hidden":   `<p>hidden</p>`,
+		"/private":  `<p>private</p>`,
+	}
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/robots.txt":
+			fmt.Fprint(w, "User-agent: *\nDisallow: /private\n")
+		case strings.HasPrefix(r.URL.Path, "/api/"):
+			var docs []clients.AppsearchDocument
+			json.NewDecoder(r.Body).Decode(&docs)
+			for _, doc := range docs {
+				// The inlinks written once the crawl is over update the documents already recorded
+				if r.Method == http.MethodPatch {
+					break
+				}
+				u, _ := url.Parse(doc.URI)
+				mu.Lock()
+				*indexed = append(*indexed, u.Path)
+				mu.Unlock()
+			}
+			json.NewEncoder(w).Encode(docs)
+		default:
+			body, ok := pages[r.URL.Path]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			if r.URL.Path == "/header" {
+				w.Header().Set("X-Robots-Tag", "noindex")
+			}
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprintf(w, "<html><head>%s</head><body></body></html>", body)
+		}
+	}))
+}
+
+func TestCrawlRobots(t *testing.T) {
+	tests := map[string]struct {
+		robots  string
+		indexed []string
+		stats   Stats
+	}{
+		"respect": {
+			robots:  RobotsRespect,
+			indexed: []string{"/", "/linked", "/nofollow"},
+			stats:   Stats{PagesVisited: 5, PagesIndexed: 3, PagesNoindex: 2, PagesDisallowed: 1, PagesLinked: 3},
+		},
+		"ignore": {
+			robots:  RobotsIgnore,
+			indexed: []string{"/", "/header", "/hidden", "/linked", "/nofollow", "/noindex", "/private"},
+			stats:   Stats{PagesVisited: 7, PagesIndexed: 7, PagesLinked: 7},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var (
+				indexed []string
+				mu      sync.Mutex
+			)
+			srv := newRobotsServer(&indexed, &mu)
+			defer srv.Close()
+
+			u, _ := url.Parse(srv.URL)
+			ac := clients.CreateAppsearchClient(srv.URL, "token", "/api/as/v1/")
+			sink, err := clients.NewSink("app-search", clients.SinkConfig{Engine: "test", AppsearchClient: ac})
+			if err != nil {
+				t.Fatalf("Unexpected error creating sink: %s", err)
+			}
+			cr := CrawlRequest{URL: srv.URL + "/", Domain: u.Host, Engine: "test", Type: "app-search", Robots: tc.robots}
+
+			job, err := NewRegistry().Create(cr)
+			if err != nil {
+				t.Fatalf("Unexpected error creating job: %s", err)
+			}
+
+			Crawl(job.ctx, job, sink, nil, nil, logrus.New())
+
+			sort.Strings(indexed)
+			if diff := cmp.Diff(tc.indexed, indexed); diff != "" {
+				t.Fatalf(diff)
+			}
+			if diff := cmp.Diff(tc.stats, job.Status().Stats); diff != "" {
+				t.Fatalf(diff)
+			}
+		})
+	}
+}
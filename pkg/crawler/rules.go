@@ -0,0 +1,92 @@
+package crawler
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/gobwas/glob"
+)
+
+// RegexPrefix marks an include or exclude pattern as a regular expression instead of a glob
+const RegexPrefix = "regex:"
+
+// NotIncluded is the rule reported for links that match none of the include patterns
+const NotIncluded = "not_included"
+
+// urlPattern represents a compiled include or exclude pattern
+type urlPattern struct {
+	source string
+	match  func(string) bool
+}
+
+// URLRules decides which links a crawl follows from its include and exclude patterns.
+// Patterns are matched against the path and query of a link, e.g. "/docs/page?lang=en".
+type URLRules struct {
+	include []urlPattern
+	exclude []urlPattern
+}
+
+// CompileURLRules compiles the include and exclude patterns of a crawl request. Patterns are globs
+// where "*" stays within a path segment and "**" spans segments, unless prefixed with RegexPrefix.
+func CompileURLRules(include, exclude []string) (*URLRules, error) {
+	rules := &URLRules{}
+
+	for _, p := range include {
+		pattern, err := compileURLPattern(p)
+		if err != nil {
+			return nil, err
+		}
+		rules.include = append(rules.include, pattern)
+	}
+
+	for _, p := range exclude {
+		pattern, err := compileURLPattern(p)
+		if err != nil {
+			return nil, err
+		}
+		rules.exclude = append(rules.exclude, pattern)
+	}
+
+	return rules, nil
+}
+
+func compileURLPattern(p string) (urlPattern, error) {
+	if strings.HasPrefix(p, RegexPrefix) {
+		re, err := regexp.Compile(strings.TrimPrefix(p, RegexPrefix))
+		if err != nil {
+			return urlPattern{}, fmt.Errorf("Pattern: %s is not a valid regular expression: %w", p, err)
+		}
+		return urlPattern{source: p, match: re.MatchString}, nil
+	}
+
+	g, err := glob.Compile(p, '/')
+	if err != nil {
+		return urlPattern{}, fmt.Errorf("Pattern: %s is not a valid glob: %w", p, err)
+	}
+	return urlPattern{source: p, match: g.Match}, nil
+}
+
+// rejectedBy returns the rule that stops the crawl following u, or "" if it may be followed.
+// Exclude patterns take precedence over include patterns.
+func (r *URLRules) rejectedBy(u *url.URL) string {
+	target := u.RequestURI()
+
+	for _, p := range r.exclude {
+		if p.match(target) {
+			return p.source
+		}
+	}
+
+	if len(r.include) == 0 {
+		return ""
+	}
+	for _, p := range r.include {
+		if p.match(target) {
+			return ""
+		}
+	}
+
+	return NotIncluded
+}
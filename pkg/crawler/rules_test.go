@@ -0,0 +1,142 @@
+package crawler
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/sirupsen/logrus"
+)
+
+func TestURLRules(t *testing.T) {
+	rules, err := CompileURLRules([]string{"/docs/**", "/blog/*"}, []string{"regex:^/search\\?", "/docs/**.pdf"})
+	if err != nil {
+		t.Fatalf("Unexpected error compiling rules: %s", err)
+	}
+
+	tests := map[string]string{
+		"https://www.example.com/docs/start":          "",
+		"https://www.example.com/docs/api/v1/index":   "",
+		"https://www.example.com/docs/guide.pdf":      "/docs/**.pdf",
+		"https://www.example.com/blog/post":           "",
+		"https://www.example.com/blog/2020/post":      NotIncluded,
+		"https://www.example.com/search?q=docs":       "regex:^/search\\?",
+		"https://www.example.com/about":               NotIncluded,
+		"https://www.example.com/docs/search?q=start": "",
+	}
+
+	for link, want := range tests {
+		t.Run(link, func(t *testing.T) {
+			u, _ := url.Parse(link)
+			if got := rules.rejectedBy(u); got != want {
+				t.Fatalf("rejected by - expected : %q, received : %q", want, got)
+			}
+		})
+	}
+}
+
+func TestURLRulesWithoutIncludes(t *testing.T) {
+	rules, err := CompileURLRules(nil, []string{"/private*"})
+	if err != nil {
+		t.Fatalf("Unexpected error compiling rules: %s", err)
+	}
+
+	u, _ := url.Parse("https://www.example.com/public")
+	if got := rules.rejectedBy(u); got != "" {
+		t.Fatalf("without include patterns every link should be included, rejected by %q", got)
+	}
+}
+
+func TestCompileURLRulesInvalid(t *testing.T) {
+	for _, p := range []string{"regex:(", "/docs/[a"} {
+		if _, err := CompileURLRules(nil, []string{p}); err == nil {
+			t.Fatalf("expected an error compiling pattern %s", p)
+		}
+	}
+}
+
+func TestCrawlURLRules(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		if r.URL.Path != "/" {
+			fmt.Fprint(w, "<html><body><p>page</p></body></html>")
+			return
+		}
+		fmt.Fprint(w, `<html><body>
+			<a href="/docs/a">a</a>
+			<a href="/docs/b/c">c</a>
+			<a href="/search?q=1">search</a>
+			<a href="/search?q=1">search again</a>
+			<a href="/blog">blog</a>
+		</body></html>`)
+	}))
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL)
+	cr := CrawlRequest{
+		URL:             srv.URL + "/",
+		Domain:          u.Host,
+		IncludePatterns: []string{"/docs/**"},
+		ExcludePatterns: []string{"regex:^/search"},
+	}
+
+	job, err := NewRegistry().Create(cr)
+	if err != nil {
+		t.Fatalf("Unexpected error creating job: %s", err)
+	}
+
+	if err := Crawl(job.ctx, job, nil, nil, nil, logrus.New()); err != nil {
+		t.Fatalf("Unexpected error crawling: %s", err)
+	}
+
+	want := Stats{PagesVisited: 3, RejectedURLs: map[string]int{"regex:^/search": 1, NotIncluded: 1}}
+	if diff := cmp.Diff(want, job.Status().Stats); diff != "" {
+		t.Fatalf(diff)
+	}
+}
+
+func TestCrawlURLRulesSitemap(t *testing.T) {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/sitemap.xml":
+			w.Header().Set("Content-Type", "application/xml")
+			fmt.Fprintf(w, `<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <url><loc>%[1]s/docs/a</loc></url>
+  <url><loc>%[1]s/search?q=1</loc></url>
+  <url><loc>%[1]s/blog</loc></url>
+</urlset>`, srv.URL)
+		default:
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, "<html><body><p>page</p></body></html>")
+		}
+	}))
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL)
+	cr := CrawlRequest{
+		URL:             srv.URL + "/",
+		Domain:          u.Host,
+		Sitemaps:        []string{srv.URL + "/sitemap.xml"},
+		IncludePatterns: []string{"/docs/**"},
+		ExcludePatterns: []string{"regex:^/search"},
+	}
+
+	job, err := NewRegistry().Create(cr)
+	if err != nil {
+		t.Fatalf("Unexpected error creating job: %s", err)
+	}
+
+	if err := Crawl(job.ctx, job, nil, nil, nil, logrus.New()); err != nil {
+		t.Fatalf("Unexpected error crawling: %s", err)
+	}
+
+	// Only the start page and the included sitemap page are fetched
+	want := Stats{PagesVisited: 2, RejectedURLs: map[string]int{"regex:^/search": 1, NotIncluded: 1}}
+	if diff := cmp.Diff(want, job.Status().Stats); diff != "" {
+		t.Fatalf(diff)
+	}
+}
@@ -0,0 +1,78 @@
+package crawler
+
+import (
+	"math"
+	"sort"
+)
+
+const (
+	// scoreDamping is the probability of following a link rather than jumping to any page
+	scoreDamping = 0.85
+	// scoreIterations bounds how many times the scores are refined
+	scoreIterations = 100
+	// scoreTolerance is the total change of the scores below which they are considered stable
+	scoreTolerance = 1e-6
+)
+
+// pageScores ranks the documents by the links between them, like PageRank: a document linked from
+// many documents, or from well ranked ones, ranks higher. sources maps every document to the other
+// documents linking to it. The scores are scaled so the average document scores 1, which keeps
+// them comparable between sites of different sizes.
+func pageScores(ids []string, sources map[string]map[string]bool) map[string]float64 {
+	n := float64(len(ids))
+	if n == 0 {
+		return nil
+	}
+
+	// The scores are summed in a fixed order, as the order of maps changes between runs and
+	// floating point sums depend on it
+	ids = append([]string(nil), ids...)
+	sort.Strings(ids)
+
+	linked := make(map[string][]string, len(ids))
+	outlinks := make(map[string]int, len(ids))
+	for _, target := range ids {
+		for source := range sources[target] {
+			linked[target] = append(linked[target], source)
+			outlinks[source]++
+		}
+		sort.Strings(linked[target])
+	}
+
+	scores := make(map[string]float64, len(ids))
+	for _, id := range ids {
+		scores[id] = 1 / n
+	}
+
+	for i := 0; i < scoreIterations; i++ {
+		// Documents without links spread their score over every document
+		var dangling float64
+		for _, id := range ids {
+			if outlinks[id] == 0 {
+				dangling += scores[id]
+			}
+		}
+
+		next := make(map[string]float64, len(ids))
+		var change float64
+		for _, id := range ids {
+			score := dangling / n
+			for _, source := range linked[id] {
+				score += scores[source] / float64(outlinks[source])
+			}
+			next[id] = (1-scoreDamping)/n + scoreDamping*score
+			change += math.Abs(next[id] - scores[id])
+		}
+
+		scores = next
+		if change < scoreTolerance {
+			break
+		}
+	}
+
+	for id := range scores {
+		scores[id] *= n
+	}
+
+	return scores
+}
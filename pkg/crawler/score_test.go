@@ -0,0 +1,80 @@
+package crawler
+
+import (
+	"math"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+// approx compares scores to the four decimals they are written with in the tests
+var approx = cmpopts.EquateApprox(0, 1e-4)
+
+func TestPageScores(t *testing.T) {
+	tests := map[string]struct {
+		ids     []string
+		sources map[string]map[string]bool
+		want    map[string]float64
+	}{
+		"empty": {},
+		"unlinked": {
+			ids:  []string{"a", "b"},
+			want: map[string]float64{"a": 1, "b": 1},
+		},
+		"cycle": {
+			ids:     []string{"a", "b", "c"},
+			sources: map[string]map[string]bool{"a": {"c": true}, "b": {"a": true}, "c": {"b": true}},
+			want:    map[string]float64{"a": 1, "b": 1, "c": 1},
+		},
+		// a and b only link to the hub, which shares its score between them
+		"hub": {
+			ids:     []string{"hub", "a", "b"},
+			sources: map[string]map[string]bool{"hub": {"a": true, "b": true}, "a": {"hub": true}, "b": {"hub": true}},
+			want:    map[string]float64{"hub": 1.4595, "a": 0.7703, "b": 0.7703},
+		},
+		// The dangling page spreads its score over every page
+		"dangling": {
+			ids:     []string{"a", "b"},
+			sources: map[string]map[string]bool{"b": {"a": true}},
+			want:    map[string]float64{"a": 0.7018, "b": 1.2982},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := pageScores(tc.ids, tc.sources)
+			if diff := cmp.Diff(tc.want, got, approx); diff != "" {
+				t.Fatalf(diff)
+			}
+
+			var total float64
+			for _, score := range got {
+				total += score
+			}
+			if math.Abs(total-float64(len(tc.ids))) > 1e-4 {
+				t.Fatalf("the scores should average 1: %v", got)
+			}
+		})
+	}
+}
+
+func TestPageScoresStable(t *testing.T) {
+	ids := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	sources := make(map[string]map[string]bool)
+	for i, target := range ids {
+		sources[target] = make(map[string]bool)
+		for j, source := range ids {
+			if j != i && (i+j)%3 != 0 {
+				sources[target][source] = true
+			}
+		}
+	}
+
+	want := pageScores(ids, sources)
+	for i := 0; i < 20; i++ {
+		if diff := cmp.Diff(want, pageScores(ids, sources)); diff != "" {
+			t.Fatalf("the scores should be the same on every run: %s", diff)
+		}
+	}
+}
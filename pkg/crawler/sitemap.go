@@ -0,0 +1,143 @@
+package crawler
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/temoto/robotstxt"
+)
+
+// maxSitemapDepth bounds how many levels of sitemap indexes are followed
+const maxSitemapDepth = 3
+
+// sitemapEntry represents a page or a child sitemap listed in a sitemap
+type sitemapEntry struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod"`
+}
+
+// sitemapDocument represents either a <urlset> sitemap or a <sitemapindex>
+type sitemapDocument struct {
+	URLs     []sitemapEntry `xml:"url"`
+	Sitemaps []sitemapEntry `xml:"sitemap"`
+}
+
+// discoverSitemaps returns the sitemaps listed in the Sitemap: lines of the site's robots.txt
+func discoverSitemaps(ctx context.Context, client *http.Client, site *url.URL) ([]string, error) {
+	robotsURL := url.URL{Scheme: site.Scheme, Host: site.Host, Path: "/robots.txt"}
+	req, err := http.NewRequestWithContext(ctx, "GET", robotsURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	robots, err := robotstxt.FromResponse(resp)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %w", robotsURL.String(), err)
+	}
+
+	return robots.Sitemaps, nil
+}
+
+// readSitemaps fetches every sitemap, following sitemap indexes, and returns the pages they list.
+// Sitemaps that fail to load are reported in errs without stopping the others.
+func readSitemaps(ctx context.Context, client *http.Client, sitemaps []string) (pages []sitemapEntry, errs []error) {
+	seen := make(map[string]bool)
+
+	var read func(locs []string, depth int)
+	read = func(locs []string, depth int) {
+		for _, loc := range locs {
+			if seen[loc] || ctx.Err() != nil {
+				continue
+			}
+			seen[loc] = true
+
+			doc, err := fetchSitemap(ctx, client, loc)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+
+			pages = append(pages, doc.URLs...)
+
+			if len(doc.Sitemaps) == 0 {
+				continue
+			}
+			if depth >= maxSitemapDepth {
+				errs = append(errs, fmt.Errorf("Sitemap index %s is nested more than %d levels deep", loc, maxSitemapDepth))
+				continue
+			}
+
+			var children []string
+			for _, s := range doc.Sitemaps {
+				children = append(children, strings.TrimSpace(s.Loc))
+			}
+			read(children, depth+1)
+		}
+	}
+	read(sitemaps, 1)
+
+	return pages, errs
+}
+
+// fetchSitemap downloads and decodes a single sitemap, which may be gzipped
+func fetchSitemap(ctx context.Context, client *http.Client, loc string) (*sitemapDocument, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", loc, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("[%s] Error fetching sitemap %s", resp.Status, loc)
+	}
+
+	doc, err := decodeSitemap(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding sitemap %s: %w", loc, err)
+	}
+
+	return doc, nil
+}
+
+// decodeSitemap parses sitemap XML, transparently decompressing gzipped sitemaps
+func decodeSitemap(r io.Reader) (*sitemapDocument, error) {
+	br := bufio.NewReader(r)
+
+	// Sniff the gzip magic number rather than trusting the file extension or Content-Type
+	if magic, err := br.Peek(2); err == nil && bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	} else {
+		r = br
+	}
+
+	var doc sitemapDocument
+	if err := xml.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	return &doc, nil
+}
@@ -0,0 +1,90 @@
+package crawler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func gzipped(s string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte(s))
+	gz.Close()
+	return buf.Bytes()
+}
+
+// newSitemapServer serves robots.txt pointing at a sitemap index of a plain and a gzipped sitemap
+func newSitemapServer() *httptest.Server {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/robots.txt":
+			fmt.Fprintf(w, "User-agent: *\nSitemap: %s/sitemap_index.xml\n", srv.URL)
+		case "/sitemap_index.xml":
+			fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<sitemapindex xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <sitemap><loc>%[1]s/pages.xml</loc></sitemap>
+  <sitemap><loc>%[1]s/posts.xml.gz</loc></sitemap>
+  <sitemap><loc>%[1]s/missing.xml</loc></sitemap>
+</sitemapindex>`, srv.URL)
+		case "/pages.xml":
+			fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <url><loc>%s/about</loc><lastmod>2020-01-02</lastmod></url>
+</urlset>`, srv.URL)
+		case "/posts.xml.gz":
+			w.Write(gzipped(fmt.Sprintf(`<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <url>
+    <loc> %s/posts/1 </loc>
+    <lastmod>2020-01-03T10:00:00+00:00</lastmod>
+  </url>
+</urlset>`, srv.URL)))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	return srv
+}
+
+func TestReadSitemaps(t *testing.T) {
+	srv := newSitemapServer()
+	defer srv.Close()
+
+	site, _ := url.Parse(srv.URL)
+	sitemaps, err := discoverSitemaps(context.Background(), srv.Client(), site)
+	if err != nil {
+		t.Fatalf("Unexpected error discovering sitemaps: %s", err)
+	}
+	if diff := cmp.Diff([]string{srv.URL + "/sitemap_index.xml"}, sitemaps); diff != "" {
+		t.Fatalf(diff)
+	}
+
+	pages, errs := readSitemaps(context.Background(), srv.Client(), sitemaps)
+
+	want := []sitemapEntry{
+		{Loc: srv.URL + "/about", LastMod: "2020-01-02"},
+		{Loc: " " + srv.URL + "/posts/1 ", LastMod: "2020-01-03T10:00:00+00:00"},
+	}
+	if diff := cmp.Diff(want, pages); diff != "" {
+		t.Fatalf(diff)
+	}
+
+	// The missing sitemap is reported without stopping the others
+	if len(errs) != 1 {
+		t.Fatalf("errors - expected : 1, received : %v", errs)
+	}
+}
+
+func TestDecodeSitemapInvalid(t *testing.T) {
+	if _, err := decodeSitemap(bytes.NewReader([]byte("not a sitemap"))); err == nil {
+		t.Fatal("expected an error decoding an invalid sitemap")
+	}
+}
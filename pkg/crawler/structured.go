@@ -0,0 +1,574 @@
+package crawler
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"golang.org/x/net/html"
+)
+
+// openGraphNamespaces maps the OpenGraph namespaces of meta properties to the document field they
+// are stored in, e.g. "article:published_time" to article.published_time
+var openGraphNamespaces = map[string]string{
+	"og":      "opengraph",
+	"article": "article",
+	"book":    "book",
+	"profile": "profile",
+	"music":   "music",
+	"video":   "video",
+	"twitter": "twitter",
+}
+
+// articleTypes are the schema.org types stored as the page's schema.article
+var articleTypes = map[string]bool{
+	"Article": true, "NewsArticle": true, "BlogPosting": true, "TechArticle": true,
+	"ScholarlyArticle": true, "Report": true, "SocialMediaPosting": true, "LiveBlogPosting": true,
+}
+
+// SchemaData represents the schema.org items a page publishes as JSON-LD, microdata or RDFa
+type SchemaData struct {
+	// Types lists the types of the top level items, e.g. "Article" or "Product"
+	Types       []string           `json:"type,omitempty"`
+	Article     *SchemaArticle     `json:"article,omitempty"`
+	Product     *SchemaProduct     `json:"product,omitempty"`
+	Breadcrumbs []SchemaBreadcrumb `json:"breadcrumbs,omitempty"`
+	FAQ         []SchemaQuestion   `json:"faq,omitempty"`
+}
+
+// SchemaArticle represents the first Article, or a subtype such as NewsArticle, on the page
+type SchemaArticle struct {
+	Type          string   `json:"type,omitempty"`
+	Headline      string   `json:"headline,omitempty"`
+	Authors       []string `json:"author,omitempty"`
+	Publisher     string   `json:"publisher,omitempty"`
+	Section       string   `json:"section,omitempty"`
+	DatePublished string   `json:"date_published,omitempty"`
+	DateModified  string   `json:"date_modified,omitempty"`
+}
+
+// SchemaProduct represents the first Product on the page and its first offer
+type SchemaProduct struct {
+	Name         string `json:"name,omitempty"`
+	Brand        string `json:"brand,omitempty"`
+	SKU          string `json:"sku,omitempty"`
+	Price        string `json:"price,omitempty"`
+	Currency     string `json:"currency,omitempty"`
+	Availability string `json:"availability,omitempty"`
+	Rating       string `json:"rating,omitempty"`
+	ReviewCount  string `json:"review_count,omitempty"`
+}
+
+// SchemaBreadcrumb represents an entry of the page's BreadcrumbList, in order
+type SchemaBreadcrumb struct {
+	Name string `json:"name,omitempty"`
+	URL  string `json:"url,omitempty"`
+}
+
+// SchemaQuestion represents a Question of the page's FAQPage and its accepted answer
+type SchemaQuestion struct {
+	Question string `json:"question"`
+	Answer   string `json:"answer,omitempty"`
+}
+
+// schemaItem represents a schema.org item, whatever syntax it was published in. Property values
+// are strings or nested items.
+type schemaItem struct {
+	types []string
+	props map[string][]interface{}
+}
+
+func newSchemaItem() *schemaItem {
+	return &schemaItem{props: make(map[string][]interface{})}
+}
+
+// first returns the first value of the property as a string, taking the name of nested items
+func (it *schemaItem) first(prop string) string {
+	for _, v := range it.props[prop] {
+		if s := itemString(v); s != "" {
+			return s
+		}
+	}
+	return ""
+}
+
+// item returns the first value of the property that is a nested item
+func (it *schemaItem) item(prop string) *schemaItem {
+	for _, v := range it.props[prop] {
+		if nested, ok := v.(*schemaItem); ok {
+			return nested
+		}
+	}
+	return nil
+}
+
+// is reports whether the item has any of the types
+func (it *schemaItem) is(types map[string]bool) string {
+	for _, t := range it.types {
+		if types[t] {
+			return t
+		}
+	}
+	return ""
+}
+
+// itemString returns a string value, or the name of a nested item
+func itemString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return strings.TrimSpace(v)
+	case *schemaItem:
+		return v.first("name")
+	}
+	return ""
+}
+
+// schemaType returns the type without its schema.org prefix, e.g. "Article" for "https://schema.org/Article"
+func schemaType(t string) string {
+	t = strings.TrimSpace(t)
+	if i := strings.LastIndexAny(t, "/#"); i >= 0 {
+		t = t[i+1:]
+	}
+	return strings.TrimPrefix(t, "schema:")
+}
+
+// extractStructured returns the OpenGraph and Twitter card properties of the page and the schema.org
+// items it publishes, keyed by the document field they are stored in
+func extractStructured(doc *goquery.Selection) map[string]interface{} {
+	structured := make(map[string]interface{})
+
+	doc.Find("meta[content]").Each(func(_ int, s *goquery.Selection) {
+		key, _ := s.Attr("property")
+		if key == "" {
+			key, _ = s.Attr("name")
+		}
+		i := strings.Index(key, ":")
+		if i < 0 {
+			return
+		}
+		field := openGraphNamespaces[strings.ToLower(key[:i])]
+		if field == "" {
+			return
+		}
+		content, _ := s.Attr("content")
+		if content = strings.TrimSpace(content); content == "" {
+			return
+		}
+
+		props, _ := structured[field].(map[string]interface{})
+		if props == nil {
+			props = make(map[string]interface{})
+			structured[field] = props
+		}
+		addProperty(props, propertyName(key[i+1:]), content)
+	})
+
+	var items []*schemaItem
+	doc.Find(`script[type="application/ld+json"]`).Each(func(_ int, s *goquery.Selection) {
+		items = append(items, parseJSONLD(s.Text())...)
+	})
+	for _, n := range doc.Nodes {
+		items = append(items, parseMicrodata(n)...)
+	}
+	if schema := newSchemaData(items); schema != nil {
+		structured["schema"] = schema
+	}
+
+	if len(structured) == 0 {
+		return nil
+	}
+	return structured
+}
+
+// propertyName turns a meta property such as "image:width" into a field name such as "image_width"
+func propertyName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		}
+		return '_'
+	}, name)
+}
+
+// addProperty sets the property, turning it into a list when the page repeats it
+func addProperty(props map[string]interface{}, name, value string) {
+	switch v := props[name].(type) {
+	case nil:
+		props[name] = value
+	case string:
+		props[name] = []string{v, value}
+	case []string:
+		props[name] = append(v, value)
+	}
+}
+
+// parseJSONLD returns the top level items of a JSON-LD block, including those of its @graph.
+// Blocks that aren't valid JSON are ignored.
+func parseJSONLD(text string) (items []*schemaItem) {
+	var v interface{}
+	if err := json.Unmarshal([]byte(strings.TrimSpace(text)), &v); err != nil {
+		return nil
+	}
+
+	var collect func(v interface{})
+	collect = func(v interface{}) {
+		switch v := v.(type) {
+		case []interface{}:
+			for _, e := range v {
+				collect(e)
+			}
+		case map[string]interface{}:
+			if graph, ok := v["@graph"]; ok {
+				collect(graph)
+				return
+			}
+			if item, ok := jsonLDValue(v).(*schemaItem); ok {
+				items = append(items, item)
+			}
+		}
+	}
+	collect(v)
+
+	return items
+}
+
+// jsonLDValue converts a JSON-LD value into a string or an item
+func jsonLDValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case map[string]interface{}:
+		// Values such as {"@value": "2020-01-20", "@type": "Date"} are plain values
+		if value, ok := v["@value"]; ok {
+			return jsonLDValue(value)
+		}
+
+		item := newSchemaItem()
+		for key, value := range v {
+			switch key {
+			case "@type":
+				for _, t := range jsonLDList(value) {
+					if s, ok := t.(string); ok {
+						item.types = append(item.types, schemaType(s))
+					}
+				}
+			case "@id":
+				item.props["id"] = append(item.props["id"], jsonLDValue(value))
+			default:
+				if strings.HasPrefix(key, "@") {
+					continue
+				}
+				key = schemaType(key)
+				for _, e := range jsonLDList(value) {
+					if converted := jsonLDValue(e); converted != nil {
+						item.props[key] = append(item.props[key], converted)
+					}
+				}
+			}
+		}
+		return item
+	}
+	return nil
+}
+
+// jsonLDList returns the values of a JSON-LD property, which may or may not be an array
+func jsonLDList(v interface{}) []interface{} {
+	if list, ok := v.([]interface{}); ok {
+		return list
+	}
+	return []interface{}{v}
+}
+
+// parseMicrodata returns the top level items published with microdata or RDFa under the node
+func parseMicrodata(root *html.Node) (items []*schemaItem) {
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			if scope, ok := microdataScope(n); ok && attr(n, scope.prop) == "" {
+				items = append(items, parseScope(n, scope))
+				return
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(root)
+
+	return items
+}
+
+// microdataSyntax names the attributes of microdata or RDFa Lite
+type microdataSyntax struct {
+	scope, typ, prop string
+}
+
+var (
+	microdata = microdataSyntax{scope: "itemscope", typ: "itemtype", prop: "itemprop"}
+	rdfa      = microdataSyntax{scope: "typeof", typ: "typeof", prop: "property"}
+)
+
+// microdataScope returns the syntax of the item the element starts, if it starts one
+func microdataScope(n *html.Node) (microdataSyntax, bool) {
+	for _, a := range n.Attr {
+		switch a.Key {
+		case microdata.scope:
+			return microdata, true
+		case rdfa.scope:
+			return rdfa, true
+		}
+	}
+	return microdataSyntax{}, false
+}
+
+// parseScope reads the item the element starts and the properties of its descendants, stopping
+// at the items nested in it
+func parseScope(n *html.Node, syntax microdataSyntax) *schemaItem {
+	item := newSchemaItem()
+	for _, t := range strings.Fields(attr(n, syntax.typ)) {
+		item.types = append(item.types, schemaType(t))
+	}
+
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type != html.ElementNode {
+				continue
+			}
+
+			props := strings.Fields(attr(c, syntax.prop))
+			nested, isScope := microdataScope(c)
+
+			var value interface{}
+			if isScope {
+				value = parseScope(c, nested)
+			} else if len(props) > 0 {
+				value = microdataValue(c)
+			}
+			for _, p := range props {
+				item.props[schemaType(p)] = append(item.props[schemaType(p)], value)
+			}
+
+			if !isScope {
+				walk(c)
+			}
+		}
+	}
+	walk(n)
+
+	return item
+}
+
+// microdataValue returns the value of a property element, from the attribute its tag keeps it in
+func microdataValue(n *html.Node) string {
+	if content := attr(n, "content"); content != "" {
+		return content
+	}
+	switch n.Data {
+	case "a", "link", "area":
+		return attr(n, "href")
+	case "img", "audio", "video", "source", "embed", "iframe":
+		return attr(n, "src")
+	case "time":
+		if datetime := attr(n, "datetime"); datetime != "" {
+			return datetime
+		}
+	case "data", "meter":
+		return attr(n, "value")
+	}
+	return collapseSpace(goquery.NewDocumentFromNode(n).Text())
+}
+
+// attr returns the value of the attribute of the element
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// newSchemaData summarizes the items of a page, returning nil if there are none
+func newSchemaData(items []*schemaItem) *SchemaData {
+	if len(items) == 0 {
+		return nil
+	}
+
+	schema := &SchemaData{}
+	types := make(map[string]bool)
+	for _, item := range items {
+		for _, t := range item.types {
+			if t != "" && !types[t] {
+				types[t] = true
+				schema.Types = append(schema.Types, t)
+			}
+		}
+	}
+	sort.Strings(schema.Types)
+
+	// Articles, products and FAQ questions are often nested, e.g. in a WebPage's mainEntity
+	walkItems(items, func(item *schemaItem) {
+		switch {
+		case schema.Article == nil && item.is(articleTypes) != "":
+			schema.Article = newSchemaArticle(item)
+		case schema.Product == nil && item.is(map[string]bool{"Product": true}) != "":
+			schema.Product = newSchemaProduct(item)
+		case schema.Breadcrumbs == nil && item.is(map[string]bool{"BreadcrumbList": true}) != "":
+			schema.Breadcrumbs = newSchemaBreadcrumbs(item)
+		case schema.FAQ == nil && item.is(map[string]bool{"FAQPage": true}) != "":
+			schema.FAQ = newSchemaFAQ(item)
+		}
+	})
+
+	return schema
+}
+
+// walkItems calls f with every item and the items nested in them, depth first
+func walkItems(items []*schemaItem, f func(*schemaItem)) {
+	for _, item := range items {
+		f(item)
+
+		// Properties are walked in order so the same page always gives the same items
+		props := make([]string, 0, len(item.props))
+		for p := range item.props {
+			props = append(props, p)
+		}
+		sort.Strings(props)
+		for _, p := range props {
+			for _, v := range item.props[p] {
+				if nested, ok := v.(*schemaItem); ok {
+					walkItems([]*schemaItem{nested}, f)
+				}
+			}
+		}
+	}
+}
+
+func newSchemaArticle(item *schemaItem) *SchemaArticle {
+	article := &SchemaArticle{
+		Type:          item.is(articleTypes),
+		Headline:      item.first("headline"),
+		Publisher:     item.first("publisher"),
+		Section:       item.first("articleSection"),
+		DatePublished: item.first("datePublished"),
+		DateModified:  item.first("dateModified"),
+	}
+	if article.Headline == "" {
+		article.Headline = item.first("name")
+	}
+	for _, v := range item.props["author"] {
+		if author := itemString(v); author != "" {
+			article.Authors = append(article.Authors, author)
+		}
+	}
+	return article
+}
+
+func newSchemaProduct(item *schemaItem) *SchemaProduct {
+	product := &SchemaProduct{
+		Name:  item.first("name"),
+		Brand: item.first("brand"),
+		SKU:   item.first("sku"),
+	}
+	if offer := item.item("offers"); offer != nil {
+		product.Price = offer.first("price")
+		if product.Price == "" {
+			product.Price = offer.first("lowPrice")
+		}
+		product.Currency = offer.first("priceCurrency")
+		product.Availability = schemaType(offer.first("availability"))
+	}
+	if rating := item.item("aggregateRating"); rating != nil {
+		product.Rating = rating.first("ratingValue")
+		product.ReviewCount = rating.first("reviewCount")
+		if product.ReviewCount == "" {
+			product.ReviewCount = rating.first("ratingCount")
+		}
+	}
+	return product
+}
+
+func newSchemaBreadcrumbs(item *schemaItem) (breadcrumbs []SchemaBreadcrumb) {
+	type entry struct {
+		position int
+		crumb    SchemaBreadcrumb
+	}
+	var entries []entry
+	for i, v := range item.props["itemListElement"] {
+		li, ok := v.(*schemaItem)
+		if !ok {
+			continue
+		}
+		e := entry{position: i, crumb: SchemaBreadcrumb{Name: li.first("name")}}
+		if p, err := strconv.Atoi(li.first("position")); err == nil {
+			e.position = p
+		}
+
+		// The linked page is either a URL or an item with an @id, url and name
+		switch target := firstValue(li.props["item"]).(type) {
+		case string:
+			e.crumb.URL = target
+		case *schemaItem:
+			if e.crumb.Name == "" {
+				e.crumb.Name = target.first("name")
+			}
+			if e.crumb.URL = target.first("id"); e.crumb.URL == "" {
+				e.crumb.URL = target.first("url")
+			}
+		}
+		if e.crumb.URL == "" {
+			e.crumb.URL = li.first("url")
+		}
+		entries = append(entries, e)
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].position < entries[j].position })
+	for _, e := range entries {
+		breadcrumbs = append(breadcrumbs, e.crumb)
+	}
+	return breadcrumbs
+}
+
+func newSchemaFAQ(item *schemaItem) (faq []SchemaQuestion) {
+	for _, v := range item.props["mainEntity"] {
+		q, ok := v.(*schemaItem)
+		if !ok {
+			continue
+		}
+		question := SchemaQuestion{Question: q.first("name")}
+		if answer := q.item("acceptedAnswer"); answer != nil {
+			question.Answer = htmlText(answer.first("text"))
+		}
+		if question.Question != "" {
+			faq = append(faq, question)
+		}
+	}
+	return faq
+}
+
+// firstValue returns the first of the values, if any
+func firstValue(values []interface{}) interface{} {
+	if len(values) == 0 {
+		return nil
+	}
+	return values[0]
+}
+
+// htmlText returns the text of an HTML fragment, as JSON-LD answers often hold markup
+func htmlText(fragment string) string {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(fragment))
+	if err != nil {
+		return collapseSpace(fragment)
+	}
+	return collapseSpace(doc.Text())
+}
@@ -0,0 +1,91 @@
+package crawler
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/google/go-cmp/cmp"
+)
+
+const structuredPage = `<html><head>
+<meta property="og:title" content="Version 2.0 is out">
+<meta property="og:type" content="article">
+<meta property="og:image" content="https://www.example.com/a.png">
+<meta property="og:image" content="https://www.example.com/b.png">
+<meta property="og:image:width" content="1200">
+<meta property="article:published_time" content="2020-01-20T10:00:00Z">
+<meta property="article:tag" content="release">
+<meta name="twitter:card" content="summary_large_image">
+<meta name="twitter:site" content="@example">
+<meta name="description" content="not structured">
+<script type="application/ld+json">
+{"@context": "https://schema.org", "@graph": [
+  {"@type": "NewsArticle", "headline": "Version 2.0 is out", "datePublished": "2020-01-20",
+   "author": [{"@type": "Person", "name": "Ada"}, "Grace"], "publisher": {"@type": "Organization", "name": "Example"}},
+  {"@type": "BreadcrumbList", "itemListElement": [
+    {"@type": "ListItem", "position": 2, "name": "Blog", "item": "https://www.example.com/blog"},
+    {"@type": "ListItem", "position": 1, "item": {"@id": "https://www.example.com/", "name": "Home"}}
+  ]}
+]}
+</script>
+<script type="application/ld+json">{"@type": "FAQPage", "mainEntity": [
+  {"@type": "Question", "name": "Is it free?", "acceptedAnswer": {"@type": "Answer", "text": "<p>Yes, <b>always</b>.</p>"}}
+]}</script>
+<script type="application/ld+json">{ not json</script>
+</head><body>
+<div itemscope itemtype="https://schema.org/Product">
+  <h1 itemprop="name">Crawler</h1>
+  <span itemprop="brand" itemscope itemtype="https://schema.org/Brand"><span itemprop="name">Example</span></span>
+  <div itemprop="offers" itemscope itemtype="https://schema.org/Offer">
+    <meta itemprop="priceCurrency" content="USD"><span itemprop="price">10.00</span>
+    <link itemprop="availability" href="https://schema.org/InStock">
+  </div>
+</div>
+<div vocab="https://schema.org/" typeof="Event"><span property="name">Launch</span></div>
+</body></html>`
+
+func TestExtractStructured(t *testing.T) {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(structuredPage))
+	if err != nil {
+		t.Fatalf("Unexpected error parsing the page: %s", err)
+	}
+
+	want := map[string]interface{}{
+		"opengraph": map[string]interface{}{
+			"title":       "Version 2.0 is out",
+			"type":        "article",
+			"image":       []string{"https://www.example.com/a.png", "https://www.example.com/b.png"},
+			"image_width": "1200",
+		},
+		"article": map[string]interface{}{"published_time": "2020-01-20T10:00:00Z", "tag": "release"},
+		"twitter": map[string]interface{}{"card": "summary_large_image", "site": "@example"},
+		"schema": &SchemaData{
+			Types: []string{"BreadcrumbList", "Event", "FAQPage", "NewsArticle", "Product"},
+			Article: &SchemaArticle{
+				Type:          "NewsArticle",
+				Headline:      "Version 2.0 is out",
+				Authors:       []string{"Ada", "Grace"},
+				Publisher:     "Example",
+				DatePublished: "2020-01-20",
+			},
+			Product: &SchemaProduct{Name: "Crawler", Brand: "Example", Price: "10.00", Currency: "USD", Availability: "InStock"},
+			Breadcrumbs: []SchemaBreadcrumb{
+				{Name: "Home", URL: "https://www.example.com/"},
+				{Name: "Blog", URL: "https://www.example.com/blog"},
+			},
+			FAQ: []SchemaQuestion{{Question: "Is it free?", Answer: "Yes, always."}},
+		},
+	}
+
+	if diff := cmp.Diff(want, extractStructured(doc.Selection)); diff != "" {
+		t.Fatalf(diff)
+	}
+}
+
+func TestExtractStructuredWithoutData(t *testing.T) {
+	doc, _ := goquery.NewDocumentFromReader(strings.NewReader(`<html><head><meta name="description" content="plain"></head><body><p>plain</p></body></html>`))
+	if got := extractStructured(doc.Selection); got != nil {
+		t.Fatalf("a page without structured data shouldn't have any: %v", got)
+	}
+}
@@ -1,16 +1,23 @@
 package serving
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/google/logger"
+	"github.com/julienschmidt/httprouter"
+	"github.com/wambozi/elastic-webcrawler/m/pkg/clients"
 	"github.com/wambozi/elastic-webcrawler/m/pkg/crawler"
 )
 
 // Response is a concrete representation of the response to the client calling the crawl
 type Response struct {
+	ID     string `json:"id,omitempty"`
 	Status int    `json:"status"`
 	URL    string `json:"url"`
 	Type   string `json:"type"`
@@ -38,8 +45,22 @@ func (s *Server) handleCrawl() http.HandlerFunc {
 			return
 		}
 
-		if b.Type != "app-search" && b.Type != "elasticsearch" {
-			eMessage := fmt.Sprintf("Crawl type of: %s is not supported. Must be 'app-search' or 'elasticsearch'", b.Type)
+		if b.Retries == nil {
+			b.Retries = &crawler.Retries{Enabled: s.Defaults.Retries.Enabled, Number: s.Defaults.Retries.Number}
+		}
+
+		if b.Retries.Number < 0 {
+			eMessage := fmt.Sprint("'retries.number' must not be negative.")
+			err := errorResponse{Error: eMessage}
+			ers, _ := json.Marshal(err)
+
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write(ers)
+			return
+		}
+
+		if b.Mode != "" && b.Mode != crawler.ModeUpdate && b.Mode != crawler.ModeRebuild {
+			eMessage := fmt.Sprintf("'mode' of: %s is not supported. Must be '%s' or '%s'", b.Mode, crawler.ModeUpdate, crawler.ModeRebuild)
 			err := errorResponse{Error: eMessage}
 			ers, _ := json.Marshal(err)
 
@@ -48,8 +69,8 @@ func (s *Server) handleCrawl() http.HandlerFunc {
 			return
 		}
 
-		if b.Type == "app-search" && b.Engine == "" {
-			eMessage := fmt.Sprint("Crawl type of 'app-search' requires an 'engine' in the request.")
+		if b.Mode == crawler.ModeRebuild && b.Prune != nil && b.Prune.Enabled {
+			eMessage := fmt.Sprintf("'prune' can't be used with the '%s' mode, which drops stale pages with the previous index.", crawler.ModeRebuild)
 			err := errorResponse{Error: eMessage}
 			ers, _ := json.Marshal(err)
 
@@ -58,8 +79,8 @@ func (s *Server) handleCrawl() http.HandlerFunc {
 			return
 		}
 
-		if b.Type == "elasticsearch" && b.Index == "" {
-			eMessage := fmt.Sprint("Crawl type of 'elasticsearch' requires an 'index' in the request.")
+		if b.Mode == crawler.ModeRebuild && b.Incremental {
+			eMessage := fmt.Sprintf("'incremental' can't be used with the '%s' mode, which writes every page to a new index.", crawler.ModeRebuild)
 			err := errorResponse{Error: eMessage}
 			ers, _ := json.Marshal(err)
 
@@ -68,15 +89,184 @@ func (s *Server) handleCrawl() http.HandlerFunc {
 			return
 		}
 
-		status := crawler.Init(s.ElasticClient, s.AppsearchClient, b, s.Log)
-		res := Response{}
+		if b.Incremental && s.States == nil {
+			eMessage := fmt.Sprint("'incremental' needs Elasticsearch configured to keep the state of crawled pages in.")
+			err := errorResponse{Error: eMessage}
+			ers, _ := json.Marshal(err)
 
-		if b.Type == "elasticsearch" {
-			res = Response{Status: status, URL: b.URL, Type: "elasticsearch", Index: b.Index}
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write(ers)
+			return
+		}
+
+		if b.ImageIndex != "" && b.ImageIndex == b.Index || b.ImageEngine != "" && b.ImageEngine == b.Engine {
+			eMessage := fmt.Sprint("'image_index' and 'image_engine' must differ from the 'index' and 'engine' pages are written to.")
+			err := errorResponse{Error: eMessage}
+			ers, _ := json.Marshal(err)
+
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write(ers)
+			return
 		}
 
-		if b.Type == "app-search" {
-			res = Response{Status: status, URL: b.URL, Type: "app-search", Engine: b.Engine}
+		if b.MaxDepth < 0 || b.MaxPages < 0 {
+			eMessage := fmt.Sprint("'max_depth' and 'max_pages' must not be negative.")
+			err := errorResponse{Error: eMessage}
+			ers, _ := json.Marshal(err)
+
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write(ers)
+			return
+		}
+
+		if b.MaxDuration != "" {
+			if d, err := time.ParseDuration(b.MaxDuration); err != nil || d <= 0 {
+				eMessage := fmt.Sprintf("'max_duration' of: %s is not a positive duration, e.g. '30m'", b.MaxDuration)
+				err := errorResponse{Error: eMessage}
+				ers, _ := json.Marshal(err)
+
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write(ers)
+				return
+			}
+		}
+
+		if b.SlowPage != "" {
+			if d, err := time.ParseDuration(b.SlowPage); err != nil || d <= 0 {
+				eMessage := fmt.Sprintf("'slow_page' of: %s is not a positive duration, e.g. '2s'", b.SlowPage)
+				err := errorResponse{Error: eMessage}
+				ers, _ := json.Marshal(err)
+
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write(ers)
+				return
+			}
+		}
+
+		for _, sitemap := range b.Sitemaps {
+			if _, err := url.ParseRequestURI(sitemap); err != nil {
+				eMessage := fmt.Sprintf("Sitemap: %s is not a valid URL", sitemap)
+				err := errorResponse{Error: eMessage}
+				ers, _ := json.Marshal(err)
+
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write(ers)
+				return
+			}
+		}
+
+		if _, err := crawler.CompileURLRules(b.IncludePatterns, b.ExcludePatterns); err != nil {
+			err := errorResponse{Error: err.Error()}
+			ers, _ := json.Marshal(err)
+
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write(ers)
+			return
+		}
+
+		if _, err := crawler.CompileExtraction(b.Extract); err != nil {
+			err := errorResponse{Error: err.Error()}
+			ers, _ := json.Marshal(err)
+
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write(ers)
+			return
+		}
+
+		if b.Documents == nil {
+			b.Documents = s.Defaults.Documents
+		}
+
+		if err := crawler.CheckDocuments(b.Documents); err != nil {
+			err := errorResponse{Error: err.Error()}
+			ers, _ := json.Marshal(err)
+
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write(ers)
+			return
+		}
+
+		if b.Robots == "" {
+			b.Robots = s.Defaults.Robots
+		}
+
+		if b.TrackingParams == nil {
+			b.TrackingParams = s.Defaults.TrackingParams
+		}
+
+		if b.Robots != "" && b.Robots != crawler.RobotsRespect && b.Robots != crawler.RobotsIgnore {
+			eMessage := fmt.Sprintf("'robots' of: %s is not supported. Must be '%s' or '%s'", b.Robots, crawler.RobotsRespect, crawler.RobotsIgnore)
+			err := errorResponse{Error: eMessage}
+			ers, _ := json.Marshal(err)
+
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write(ers)
+			return
+		}
+
+		// The sinks are built once the request is known to be valid, as they may load mappings
+		sink, err := clients.NewSink(b.Type, clients.SinkConfig{
+			Index:           b.Index,
+			Engine:          b.Engine,
+			ElasticClient:   s.ElasticClient,
+			AppsearchClient: s.AppsearchClient,
+			Bulk:            s.Bulk,
+			Mapping:         b.Mapping,
+			MappingsDir:     s.MappingsDir,
+			LanguageIndices: b.LanguageIndices,
+			Rebuild:         b.Mode == crawler.ModeRebuild,
+			Retain:          s.Retain,
+			Retry:           b.Retries.Policy(),
+			Log:             s.Log,
+		})
+		if err != nil {
+			err := errorResponse{Error: err.Error()}
+			ers, _ := json.Marshal(err)
+
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write(ers)
+			return
+		}
+
+		var images clients.Sink
+		if b.ImageIndex != "" || b.ImageEngine != "" {
+			images, err = clients.NewSink(b.Type, clients.SinkConfig{
+				Index:           b.ImageIndex,
+				Engine:          b.ImageEngine,
+				ElasticClient:   s.ElasticClient,
+				AppsearchClient: s.AppsearchClient,
+				Bulk:            s.Bulk,
+				Mapping:         b.Mapping,
+				MappingsDir:     s.MappingsDir,
+				Rebuild:         b.Mode == crawler.ModeRebuild,
+				Retain:          s.Retain,
+				Retry:           b.Retries.Policy(),
+				Log:             s.Log,
+			})
+			if err != nil {
+				sink.Close(r.Context())
+				eMessage := fmt.Sprintf("Images: %s Set 'image_index' for 'elasticsearch' crawls and 'image_engine' for 'app-search' crawls.", err)
+				err := errorResponse{Error: eMessage}
+				ers, _ := json.Marshal(err)
+
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write(ers)
+				return
+			}
+		}
+
+		job, status := crawler.Init(s.Crawls, sink, images, s.States, b, s.Log)
+		if job == nil {
+			// The crawl never started, so nothing else closes its sinks
+			sink.Close(r.Context())
+			if images != nil {
+				images.Close(r.Context())
+			}
+		}
+		res := Response{Status: status, URL: b.URL, Type: b.Type, Index: b.Index, Engine: b.Engine}
+
+		if job != nil {
+			res.ID = job.ID
 		}
 
 		response, err := json.Marshal(res)
@@ -94,3 +284,141 @@ func (s *Server) handleCrawl() http.HandlerFunc {
 		w.Write(response)
 	}
 }
+
+func (s *Server) handleListCrawls() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		response, err := json.Marshal(s.Crawls.List())
+		if err != nil {
+			er := errorResponse{Error: fmt.Sprintf("Failed to marshal crawls: %v", err)}
+			ers, _ := json.Marshal(er)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write(ers)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write(response)
+	}
+}
+
+func (s *Server) handleGetCrawl() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		id := httprouter.ParamsFromContext(r.Context()).ByName("id")
+		job, ok := s.Crawls.Get(id)
+		if !ok {
+			er := errorResponse{Error: fmt.Sprintf("Crawl with id: %s not found", id)}
+			ers, _ := json.Marshal(er)
+
+			w.WriteHeader(http.StatusNotFound)
+			w.Write(ers)
+			return
+		}
+
+		response, err := json.Marshal(job.Status())
+		if err != nil {
+			er := errorResponse{Error: fmt.Sprintf("Failed to marshal crawl %s: %v", id, err)}
+			ers, _ := json.Marshal(er)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write(ers)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write(response)
+	}
+}
+
+func (s *Server) handleCrawlReport() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := httprouter.ParamsFromContext(r.Context()).ByName("id")
+		job, ok := s.Crawls.Get(id)
+		if !ok {
+			er := errorResponse{Error: fmt.Sprintf("Crawl with id: %s not found", id)}
+			ers, _ := json.Marshal(er)
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			w.Write(ers)
+			return
+		}
+
+		report := job.Report()
+		if r.URL.Query().Get("format") == "csv" || strings.Contains(r.Header.Get("Accept"), "text/csv") {
+			var b bytes.Buffer
+			if err := report.WriteCSV(&b); err != nil {
+				er := errorResponse{Error: fmt.Sprintf("Failed to write the report of crawl %s: %v", id, err)}
+				ers, _ := json.Marshal(er)
+
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write(ers)
+				return
+			}
+
+			w.Header().Set("Content-Type", "text/csv")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "crawl-"+id+"-report.csv"))
+			w.WriteHeader(http.StatusOK)
+			w.Write(b.Bytes())
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		response, err := json.Marshal(report)
+		if err != nil {
+			er := errorResponse{Error: fmt.Sprintf("Failed to marshal the report of crawl %s: %v", id, err)}
+			ers, _ := json.Marshal(er)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write(ers)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write(response)
+	}
+}
+
+func (s *Server) handleCancelCrawl() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		id := httprouter.ParamsFromContext(r.Context()).ByName("id")
+		job, ok := s.Crawls.Get(id)
+		if !ok {
+			er := errorResponse{Error: fmt.Sprintf("Crawl with id: %s not found", id)}
+			ers, _ := json.Marshal(er)
+
+			w.WriteHeader(http.StatusNotFound)
+			w.Write(ers)
+			return
+		}
+
+		if !job.Cancel() {
+			er := errorResponse{Error: fmt.Sprintf("Crawl with id: %s is already %s", id, job.Status().State)}
+			ers, _ := json.Marshal(er)
+
+			w.WriteHeader(http.StatusConflict)
+			w.Write(ers)
+			return
+		}
+
+		response, err := json.Marshal(job.Status())
+		if err != nil {
+			er := errorResponse{Error: fmt.Sprintf("Failed to marshal crawl %s: %v", id, err)}
+			ers, _ := json.Marshal(er)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write(ers)
+			return
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+		w.Write(response)
+	}
+}
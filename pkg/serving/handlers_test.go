@@ -35,7 +35,7 @@ func TestHandleIndex(t *testing.T) {
 		body       string
 		log        *logrus.Logger
 	}{
-		"elasticsearch": {server: &Server{AppsearchClient: ac, ElasticClient: ec, Router: r, Log: l}, statusCode: 202, body: `{"status":201,"url":"https://www.example.com","type":"elasticsearch","index":"test"}`},
+		"elasticsearch": {server: &Server{AppsearchClient: ac, ElasticClient: ec, Crawls: crawler.NewRegistry(), Router: r, Log: l}, statusCode: 202, body: `{"status":201,"url":"https://www.example.com","type":"elasticsearch","index":"test"}`},
 		// TODO: figure out why this panics...
 		// "app-search":    {server: &Server{AppsearchClient: ac, ElasticClient: ec, Router: r, Log: l}, statusCode: 202, body: `{"status":201,"url":"https://www.example.com","type":"app-search","engine":"test"}`},
 		// "bad-request":   {server: &Server{AppsearchClient: ac, ElasticClient: ec, Router: r, Log: l}, statusCode: 400, body: `{"status":201,"url":"https://www.example.com","type":"test","index":"test"}`},
@@ -65,7 +65,17 @@ func TestHandleIndex(t *testing.T) {
 
 			}
 
-			body := buf.String()
+			// The job ID is random, so check that one was assigned and compare the rest of the body
+			var res Response
+			if err := json.Unmarshal(buf.Bytes(), &res); err != nil {
+				t.Fatalf("could not decode response body: %+v", err)
+			}
+			if res.ID == "" {
+				t.Fatalf("response should include a crawl id: %s", buf.String())
+			}
+			res.ID = ""
+			bodyJSON, _ = json.Marshal(res)
+			body := string(bodyJSON)
 
 			gotRes := results{
 				Body:       body,
@@ -86,3 +96,244 @@ func TestHandleIndex(t *testing.T) {
 	}
 
 }
+
+func TestHandleCrawls(t *testing.T) {
+	r := httprouter.New()
+	l := logrus.New()
+	jobs := crawler.NewRegistry()
+	job, err := jobs.Create(crawler.CrawlRequest{Index: "test", URL: "https://www.example.com", Type: "elasticsearch"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating crawl job: %s", err)
+	}
+
+	server := &Server{Crawls: jobs, Router: r, Log: l}
+	server.routes()
+
+	tests := map[string]struct {
+		path       string
+		single     bool
+		statusCode int
+		ids        []string
+	}{
+		"list":      {path: "/crawls", statusCode: 200, ids: []string{job.ID}},
+		"get":       {path: "/crawls/" + job.ID, single: true, statusCode: 200, ids: []string{job.ID}},
+		"not-found": {path: "/crawls/missing", statusCode: 404},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", tc.path, nil)
+			if err != nil {
+				t.Fatalf("new request error: %+v", err)
+			}
+			w := httptest.NewRecorder()
+			server.Router.ServeHTTP(w, req)
+
+			if w.Code != tc.statusCode {
+				t.Fatalf("status code - expected : %d, received : %d", tc.statusCode, w.Code)
+			}
+
+			if tc.statusCode != 200 {
+				return
+			}
+
+			var statuses []crawler.JobStatus
+			if tc.single {
+				var status crawler.JobStatus
+				err = json.Unmarshal(w.Body.Bytes(), &status)
+				statuses = append(statuses, status)
+			} else {
+				err = json.Unmarshal(w.Body.Bytes(), &statuses)
+			}
+			if err != nil {
+				t.Fatalf("could not decode response body: %+v", err)
+			}
+
+			var ids []string
+			for _, s := range statuses {
+				ids = append(ids, s.ID)
+				if s.State != crawler.StateRunning {
+					t.Fatalf("state - expected : %s, received : %s", crawler.StateRunning, s.State)
+				}
+			}
+
+			diff := cmp.Diff(tc.ids, ids)
+			if diff != "" {
+				t.Fatalf(diff)
+			}
+		})
+	}
+}
+
+func TestHandleCancelCrawl(t *testing.T) {
+	r := httprouter.New()
+	l := logrus.New()
+	jobs := crawler.NewRegistry()
+	job, err := jobs.Create(crawler.CrawlRequest{Index: "test", URL: "https://www.example.com", Type: "elasticsearch"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating crawl job: %s", err)
+	}
+
+	server := &Server{Crawls: jobs, Router: r, Log: l}
+	server.routes()
+
+	tests := []struct {
+		name       string
+		path       string
+		statusCode int
+		state      crawler.State
+	}{
+		{name: "cancel", path: "/crawls/" + job.ID, statusCode: 202, state: crawler.StateCancelling},
+		{name: "cancelling", path: "/crawls/" + job.ID, statusCode: 409},
+		{name: "not-found", path: "/crawls/missing", statusCode: 404},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest("DELETE", tc.path, nil)
+			if err != nil {
+				t.Fatalf("new request error: %+v", err)
+			}
+			w := httptest.NewRecorder()
+			server.Router.ServeHTTP(w, req)
+
+			if w.Code != tc.statusCode {
+				t.Fatalf("status code - expected : %d, received : %d", tc.statusCode, w.Code)
+			}
+
+			if tc.state != "" {
+				var status crawler.JobStatus
+				if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+					t.Fatalf("Unexpected error decoding response: %s", err)
+				}
+				if status.State != tc.state {
+					t.Fatalf("state - expected : %s, received : %s", tc.state, status.State)
+				}
+			}
+		})
+	}
+
+}
+
+func TestHandleCrawlValidation(t *testing.T) {
+	r := httprouter.New()
+	l := logrus.New()
+	server := &Server{Crawls: crawler.NewRegistry(), Router: r, Log: l}
+	server.routes()
+
+	tests := map[string]struct {
+		request crawler.CrawlRequest
+	}{
+		"bad-type":            {request: crawler.CrawlRequest{Index: "test", URL: "https://www.example.com", Type: "test"}},
+		"negative-depth":      {request: crawler.CrawlRequest{Index: "test", URL: "https://www.example.com", Type: "elasticsearch", MaxDepth: -1}},
+		"negative-pages":      {request: crawler.CrawlRequest{Index: "test", URL: "https://www.example.com", Type: "elasticsearch", MaxPages: -1}},
+		"bad-robots":          {request: crawler.CrawlRequest{Index: "test", URL: "https://www.example.com", Type: "elasticsearch", Robots: "sometimes"}},
+		"bad-sitemap":         {request: crawler.CrawlRequest{Index: "test", URL: "https://www.example.com", Type: "elasticsearch", Sitemaps: []string{"sitemap.xml"}}},
+		"bad-pattern":         {request: crawler.CrawlRequest{Index: "test", URL: "https://www.example.com", Type: "elasticsearch", ExcludePatterns: []string{"regex:("}}},
+		"negative-retries":    {request: crawler.CrawlRequest{Index: "test", URL: "https://www.example.com", Type: "elasticsearch", Retries: &crawler.Retries{Enabled: true, Number: -1}}},
+		"invalid-mode":        {request: crawler.CrawlRequest{Index: "test", URL: "https://www.example.com", Type: "elasticsearch", Mode: "replace"}},
+		"prune-rebuild":       {request: crawler.CrawlRequest{Index: "test", URL: "https://www.example.com", Type: "elasticsearch", Mode: crawler.ModeRebuild, Prune: &crawler.Prune{Enabled: true}}},
+		"incremental-rebuild": {request: crawler.CrawlRequest{Index: "test", URL: "https://www.example.com", Type: "elasticsearch", Mode: crawler.ModeRebuild, Incremental: true}},
+		"incremental-state":   {request: crawler.CrawlRequest{Index: "test", URL: "https://www.example.com", Type: "elasticsearch", Incremental: true}},
+		"invalid-duration":    {request: crawler.CrawlRequest{Index: "test", URL: "https://www.example.com", Type: "elasticsearch", MaxDuration: "soon"}},
+		"invalid-slow-page":   {request: crawler.CrawlRequest{Index: "test", URL: "https://www.example.com", Type: "elasticsearch", SlowPage: "-1s"}},
+		"invalid-documents":   {request: crawler.CrawlRequest{Index: "test", URL: "https://www.example.com", Type: "elasticsearch", Documents: []string{"xlsx"}}},
+		"same-image-index":    {request: crawler.CrawlRequest{Index: "test", URL: "https://www.example.com", Type: "elasticsearch", ImageIndex: "test"}},
+		"image-engine":        {request: crawler.CrawlRequest{Index: "test", URL: "https://www.example.com", Type: "elasticsearch", ImageEngine: "images"}},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			bodyJSON, err := json.Marshal(tc.request)
+			if err != nil {
+				t.Fatalf("could not encode request: %+v", err)
+			}
+			req, err := http.NewRequest("POST", "/crawl", bytes.NewReader(bodyJSON))
+			if err != nil {
+				t.Fatalf("new request error: %+v", err)
+			}
+			w := httptest.NewRecorder()
+			server.Router.ServeHTTP(w, req)
+
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("status code - expected : %d, received : %d", http.StatusBadRequest, w.Code)
+			}
+		})
+	}
+}
+
+func TestHandleCrawlValidatesBeforeSinks(t *testing.T) {
+	r := httprouter.New()
+	l := logrus.New()
+	server := &Server{Crawls: crawler.NewRegistry(), MappingsDir: "missing", Router: r, Log: l}
+	server.routes()
+
+	// The mapping can't be loaded, but the request is rejected for its depth before the sink is built
+	bodyJSON, err := json.Marshal(crawler.CrawlRequest{Index: "test", URL: "https://www.example.com", Type: "elasticsearch", Mapping: "english", MaxDepth: -1})
+	if err != nil {
+		t.Fatalf("could not encode request: %+v", err)
+	}
+	req, err := http.NewRequest("POST", "/crawl", bytes.NewReader(bodyJSON))
+	if err != nil {
+		t.Fatalf("new request error: %+v", err)
+	}
+	w := httptest.NewRecorder()
+	server.Router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status code - expected : %d, received : %d", http.StatusBadRequest, w.Code)
+	}
+	var res errorResponse
+	json.NewDecoder(w.Body).Decode(&res)
+	if res.Error != "'max_depth' and 'max_pages' must not be negative." {
+		t.Fatalf("the request should be checked before its sink is built: %s", res.Error)
+	}
+}
+
+func TestHandleCrawlReport(t *testing.T) {
+	r := httprouter.New()
+	l := logrus.New()
+	jobs := crawler.NewRegistry()
+	job, err := jobs.Create(crawler.CrawlRequest{Index: "test", URL: "https://www.example.com", Type: "elasticsearch"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating crawl job: %s", err)
+	}
+
+	server := &Server{Crawls: jobs, Router: r, Log: l}
+	server.routes()
+
+	tests := map[string]struct {
+		path        string
+		accept      string
+		statusCode  int
+		contentType string
+		body        string
+	}{
+		"json":      {path: "/crawls/" + job.ID + "/report", statusCode: 200, contentType: "application/json", body: `{"broken_links":[],"redirects":[],"slow_pages":[]}`},
+		"csv":       {path: "/crawls/" + job.ID + "/report?format=csv", statusCode: 200, contentType: "text/csv", body: "type,url,referrer,kind,status_code,error,redirect_chain,target,duration_ms\n"},
+		"accept":    {path: "/crawls/" + job.ID + "/report", accept: "text/csv", statusCode: 200, contentType: "text/csv", body: "type,url,referrer,kind,status_code,error,redirect_chain,target,duration_ms\n"},
+		"not-found": {path: "/crawls/missing/report", statusCode: 404, contentType: "application/json", body: `{"error":"Crawl with id: missing not found"}`},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", tc.path, nil)
+			if err != nil {
+				t.Fatalf("new request error: %+v", err)
+			}
+			req.Header.Set("Accept", tc.accept)
+			w := httptest.NewRecorder()
+			server.Router.ServeHTTP(w, req)
+
+			if w.Code != tc.statusCode {
+				t.Fatalf("status code - expected : %d, received : %d", tc.statusCode, w.Code)
+			}
+			if ct := w.Header().Get("Content-Type"); ct != tc.contentType {
+				t.Fatalf("content type - expected : %s, received : %s", tc.contentType, ct)
+			}
+			if diff := cmp.Diff(tc.body, w.Body.String()); diff != "" {
+				t.Fatalf(diff)
+			}
+		})
+	}
+}
@@ -46,7 +46,7 @@ func (s *Server) reqResLog(h http.HandlerFunc) http.HandlerFunc {
 			bodyBytes, err := ioutil.ReadAll(r.Body)
 			s.Log.Infof("Request body: %s", string(bodyBytes))
 			if err != nil {
-				s.Log.Errorf("Could not ready request body: %w", err)
+				s.Log.Errorf("Could not ready request body: %v", err)
 			}
 			r.Body.Close()
 			r.Body = ioutil.NopCloser(bytes.NewBuffer(bodyBytes))
@@ -15,19 +15,35 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/wambozi/elastic-webcrawler/m/conf"
 	"github.com/wambozi/elastic-webcrawler/m/pkg/clients"
+	"github.com/wambozi/elastic-webcrawler/m/pkg/crawler"
 )
 
-//Server defines storage and a router
+//Server defines storage, the crawl job registry and a router
 type Server struct {
 	AppsearchClient *clients.AppsearchClient
 	ElasticClient   *elasticsearch.Client
+	Crawls          *crawler.Registry
+	Defaults        conf.CrawlerOptions
+	Bulk            clients.BulkOptions
+	MappingsDir     string
+	Retain          int
+	States          clients.StateStore
 	Router          *httprouter.Router
 	Log             *logrus.Logger
 }
 
 //NewServer sets up storage, router and routes
 func NewServer(c *conf.Configuration, ac *clients.AppsearchClient, ec *elasticsearch.Client, r *httprouter.Router, log *logrus.Logger) *Server {
-	server := &Server{AppsearchClient: ac, ElasticClient: ec, Router: r, Log: log}
+	bulk := clients.BulkOptions{
+		FlushDocs:     c.Elasticsearch.BulkFlushDocs,
+		FlushBytes:    c.Elasticsearch.BulkFlushBytes,
+		FlushInterval: time.Duration(c.Elasticsearch.BulkFlushIntervalMillis) * time.Millisecond,
+	}
+	server := &Server{AppsearchClient: ac, ElasticClient: ec, Crawls: crawler.NewRegistry(), Defaults: c.Crawler, Bulk: bulk, MappingsDir: c.Elasticsearch.MappingsDir, Retain: c.Elasticsearch.RebuildRetention, Router: r, Log: log}
+	// Crawl state is kept in Elasticsearch, so incremental crawls need it configured
+	if ec != nil && c.Elasticsearch.Endpoint != "" {
+		server.States = clients.NewElasticStateStore(ec, c.Elasticsearch.StateIndex)
+	}
 	server.routes()
 	return server
 }
@@ -93,4 +109,8 @@ func closeChannel(once *sync.Once, channel chan<- error) {
 
 func (s *Server) routes() {
 	s.Router.HandlerFunc("POST", "/crawl", s.execDurLog(s.reqResLog(s.handleCrawl())))
+	s.Router.HandlerFunc("GET", "/crawls", s.execDurLog(s.reqResLog(s.handleListCrawls())))
+	s.Router.HandlerFunc("GET", "/crawls/:id", s.execDurLog(s.reqResLog(s.handleGetCrawl())))
+	s.Router.HandlerFunc("GET", "/crawls/:id/report", s.execDurLog(s.reqResLog(s.handleCrawlReport())))
+	s.Router.HandlerFunc("DELETE", "/crawls/:id", s.execDurLog(s.reqResLog(s.handleCancelCrawl())))
 }